@@ -0,0 +1,276 @@
+// mockoidc is a stand-in OpenID Connect provider for trying out sign-in
+// locally. It asks for whichever email address to sign in as, and signs the
+// ID tokens with a key made up at startup. Configure it with eg
+//
+//	OAUTH_PROVIDERS = mock
+//	OAUTH_MOCK_KIND = oidc
+//	OAUTH_MOCK_TITLE = Mock OIDC
+//	OAUTH_MOCK_ISSUER = http://localhost:4000
+//	OAUTH_MOCK_CLIENT_ID = gallery
+//	OAUTH_MOCK_CLIENT_SECRET = secret
+package main
+
+import (
+	"Gallery/rand"
+	"crypto"
+	cryptorand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var authorizePage = template.Must(template.New("authorize").Parse(`<!doctype html>
+<html>
+<body>
+  <h1>Mock OIDC sign in</h1>
+  <form method="post">
+    {{range $key, $values := .}}{{range $values}}<input type="hidden" name="{{$key}}" value="{{.}}" />
+    {{end}}{{end}}
+    <p><label>Email <input name="email" type="email" required autofocus /></label></p>
+    <p><label><input name="email_verified" type="checkbox" value="true" checked /> Email is verified</label></p>
+    <p><label>Subject <input name="sub" placeholder="Defaults to the email" /></label></p>
+    <p><button type="submit">Sign in</button></p>
+    <p><button type="submit" name="deny" value="true">Deny</button></p>
+  </form>
+</body>
+</html>
+`))
+
+// grant is an authorization code waiting to be exchanged.
+type grant struct {
+	clientID      string
+	redirectURI   string
+	codeChallenge string
+	claims        map[string]any
+	expiresAt     time.Time
+}
+
+type issuer struct {
+	url          string
+	clientID     string
+	clientSecret string
+	key          *rsa.PrivateKey
+
+	mu     sync.Mutex
+	grants map[string]grant
+}
+
+func main() {
+	addr := flag.String("addr", "localhost:4000", "address to listen on")
+	issuerURL := flag.String("issuer", "http://localhost:4000", "issuer URL, as the app is configured with")
+	clientID := flag.String("client-id", "gallery", "client ID of the app")
+	clientSecret := flag.String("client-secret", "secret", "client secret of the app")
+	flag.Parse()
+
+	key, err := rsa.GenerateKey(cryptorand.Reader, 2048)
+	if err != nil {
+		log.Fatal(err)
+	}
+	iss := &issuer{
+		url:          strings.TrimSuffix(*issuerURL, "/"),
+		clientID:     *clientID,
+		clientSecret: *clientSecret,
+		key:          key,
+		grants:       make(map[string]grant),
+	}
+	http.HandleFunc("/.well-known/openid-configuration", iss.discovery)
+	http.HandleFunc("/jwks", iss.jwks)
+	http.HandleFunc("/authorize", iss.authorize)
+	http.HandleFunc("/token", iss.token)
+	fmt.Printf("Mock OIDC issuer %v listening on %v\n", iss.url, *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (iss *issuer) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                iss.url,
+		"authorization_endpoint":                iss.url + "/authorize",
+		"token_endpoint":                        iss.url + "/token",
+		"jwks_uri":                              iss.url + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (iss *issuer) jwks(w http.ResponseWriter, r *http.Request) {
+	pub := iss.key.PublicKey
+	writeJSON(w, http.StatusOK, map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": "mock",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+// GET /authorize shows the sign in form, which posts back to itself.
+func (iss *issuer) authorize(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	if r.Form.Get("client_id") != iss.clientID {
+		http.Error(w, "Unknown client_id", http.StatusBadRequest)
+		return
+	}
+	if r.Form.Get("code_challenge_method") != "S256" {
+		http.Error(w, "PKCE with S256 is required", http.StatusBadRequest)
+		return
+	}
+	redirectURI, err := url.Parse(r.Form.Get("redirect_uri"))
+	if err != nil || redirectURI.Scheme == "" {
+		http.Error(w, "Invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if r.Method == http.MethodGet {
+		params := url.Values{}
+		for _, key := range []string{"client_id", "redirect_uri", "state", "nonce", "code_challenge", "code_challenge_method"} {
+			params.Set(key, r.Form.Get(key))
+		}
+		authorizePage.Execute(w, params)
+		return
+	}
+
+	query := redirectURI.Query()
+	query.Set("state", r.Form.Get("state"))
+	if r.Form.Get("deny") != "" {
+		query.Set("error", "access_denied")
+		redirectURI.RawQuery = query.Encode()
+		http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+		return
+	}
+	email := strings.ToLower(r.Form.Get("email"))
+	sub := r.Form.Get("sub")
+	if sub == "" {
+		sub = email
+	}
+	code, err := rand.String(32)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	iss.mu.Lock()
+	iss.grants[code] = grant{
+		clientID:      iss.clientID,
+		redirectURI:   r.Form.Get("redirect_uri"),
+		codeChallenge: r.Form.Get("code_challenge"),
+		claims: map[string]any{
+			"sub":            sub,
+			"email":          email,
+			"email_verified": r.Form.Get("email_verified") == "true",
+			"nonce":          r.Form.Get("nonce"),
+		},
+		expiresAt: time.Now().Add(time.Minute),
+	}
+	iss.mu.Unlock()
+	query.Set("code", code)
+	redirectURI.RawQuery = query.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func tokenError(w http.ResponseWriter, code, description string) {
+	writeJSON(w, http.StatusBadRequest, map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+// POST /token exchanges a code for an ID token.
+func (iss *issuer) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID != iss.clientID || subtle.ConstantTimeCompare([]byte(clientSecret), []byte(iss.clientSecret)) != 1 {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError(w, "unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+	code := r.PostForm.Get("code")
+	iss.mu.Lock()
+	g, ok := iss.grants[code]
+	delete(iss.grants, code)
+	iss.mu.Unlock()
+	if !ok || time.Now().After(g.expiresAt) {
+		tokenError(w, "invalid_grant", "unknown or expired code")
+		return
+	}
+	if r.PostForm.Get("redirect_uri") != g.redirectURI {
+		tokenError(w, "invalid_grant", "redirect_uri does not match")
+		return
+	}
+	challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(challenge[:]) != g.codeChallenge {
+		tokenError(w, "invalid_grant", "code_verifier does not match")
+		return
+	}
+
+	now := time.Now()
+	claims := map[string]any{
+		"iss": iss.url,
+		"aud": g.clientID,
+		"iat": now.Unix(),
+		"exp": now.Add(5 * time.Minute).Unix(),
+	}
+	for key, value := range g.claims {
+		claims[key] = value
+	}
+	idToken, err := iss.sign(claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	accessToken, err := rand.String(32)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func (iss *issuer) sign(claims map[string]any) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "mock"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(nil, iss.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
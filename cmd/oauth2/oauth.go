@@ -17,8 +17,8 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	dropboxID := os.Getenv("DROPBOX_APP_ID")
-	dropboxSecret := os.Getenv("DROPBOX_APP_SECRET")
+	dropboxID := os.Getenv("OAUTH_DROPBOX_CLIENT_ID")
+	dropboxSecret := os.Getenv("OAUTH_DROPBOX_CLIENT_SECRET")
 
 	ctx := context.Background()
 	conf := &oauth2.Config{
@@ -0,0 +1,260 @@
+package controllers
+
+import (
+	"Gallery/context"
+	"Gallery/errors"
+	"Gallery/models"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// cloudBrowser is the folder browser of a cloud storage provider on the
+// gallery edit page. The provider and folder being browsed are in the cloud
+// and folder query parameters, "/" being the root; a provider is only listed
+// while it is being browsed.
+type cloudBrowser struct {
+	Provider   string
+	Title      string
+	Connected  bool
+	ConnectURL string
+	BrowseURL  string
+	Browsing   bool
+	Path       string
+	// UpURL is the link to the parent folder, empty at the root.
+	UpURL   string
+	Folders []cloudFolder
+	// Images is the number of images directly in the folder, which the
+	// import would copy.
+	Images int
+	Error  string
+}
+
+type cloudFolder struct {
+	Name string
+	URL  string
+}
+
+func cloudFolderURL(gallery *models.Gallery, provider, folder string) string {
+	query := url.Values{
+		"cloud":  {provider},
+		"folder": {folder},
+	}
+	return fmt.Sprintf("/galleries/%d/edit?%s#cloud-%s", gallery.ID, query.Encode(), provider)
+}
+
+// remotePath turns the folder in a form or link, where "/" is the root, into
+// the path the provider expects. ok is false for relative paths.
+func remotePath(folder string) (string, bool) {
+	if !strings.HasPrefix(folder, "/") {
+		return "", false
+	}
+	folder = path.Clean(folder)
+	if folder == "/" {
+		return "", true
+	}
+	return folder, true
+}
+
+// cloudBrowsers returns the folder browser of every provider with files.
+func (g Galleries) cloudBrowsers(r *http.Request, gallery *models.Gallery) ([]cloudBrowser, error) {
+	var browsers []cloudBrowser
+	for _, provider := range g.Providers.WithFiles() {
+		browser, err := g.cloudBrowser(r, gallery, provider)
+		if err != nil {
+			return nil, err
+		}
+		browsers = append(browsers, browser)
+	}
+	return browsers, nil
+}
+
+// cloudBrowser lists the folder being browsed for the edit page. Problems
+// talking to the provider are shown in the browser rather than failing the
+// page.
+func (g Galleries) cloudBrowser(r *http.Request, gallery *models.Gallery, provider *models.OAuthProvider) (cloudBrowser, error) {
+	browser := cloudBrowser{
+		Provider: provider.Name,
+		Title:    provider.Title,
+	}
+	returnTo := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	browser.ConnectURL = fmt.Sprintf("/oauth/%s/connect?return_to=%s", provider.Name, url.QueryEscape(returnTo))
+	browser.BrowseURL = cloudFolderURL(gallery, provider.Name, "/")
+	user := context.User(r.Context())
+	client, err := g.OAuthService.Client(r.Context(), provider.Config, user.ID, provider.Name)
+	if err != nil {
+		if errors.Is(err, models.ErrReconnect) {
+			browser.Error = fmt.Sprintf("Your %v connection has expired. Please connect again.", provider.Title)
+			return browser, nil
+		}
+		if errors.Is(err, models.ErrNotFound) {
+			return browser, nil
+		}
+		return browser, err
+	}
+	browser.Connected = true
+	if r.URL.Query().Get("cloud") != provider.Name {
+		return browser, nil
+	}
+	folder, ok := remotePath(r.URL.Query().Get("folder"))
+	if !ok {
+		return browser, nil
+	}
+	browser.Browsing = true
+	browser.Path = "/" + strings.TrimPrefix(folder, "/")
+	if browser.Path != "/" {
+		browser.UpURL = cloudFolderURL(gallery, provider.Name, path.Dir(browser.Path))
+	}
+	entries, err := models.ListFolder(provider.Files, client, folder)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrReconnect):
+			browser.Connected = false
+			browser.Error = fmt.Sprintf("Your %v connection has expired. Please connect again.", provider.Title)
+		case errors.Is(err, models.ErrNotFound):
+			browser.Error = fmt.Sprintf("This folder no longer exists in your %v.", provider.Title)
+		default:
+			fmt.Println(err)
+			browser.Error = fmt.Sprintf("%v could not be reached. Please try again later.", provider.Title)
+		}
+		return browser, nil
+	}
+	for _, entry := range entries {
+		if entry.Folder {
+			browser.Folders = append(browser.Folders, cloudFolder{
+				Name: entry.Name,
+				URL:  cloudFolderURL(gallery, provider.Name, entry.Path),
+			})
+			continue
+		}
+		if g.GalleryService.IsImageFilename(entry.Name) {
+			browser.Images++
+		}
+	}
+	return browser, nil
+}
+
+// fileProvider looks up the named provider, which must have files.
+func (g Galleries) fileProvider(w http.ResponseWriter, name string) (*models.OAuthProvider, bool) {
+	provider, ok := g.Providers[name]
+	if !ok || provider.Files == nil {
+		http.Error(w, "Invalid provider", http.StatusNotFound)
+		return nil, false
+	}
+	return provider, true
+}
+
+// POST /galleries/{id}/images/import/{provider}
+func (g Galleries) ImportFolder(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userCan(models.PermissionUpload))
+	if err != nil {
+		return
+	}
+	provider, ok := g.fileProvider(w, chi.URLParam(r, "provider"))
+	if !ok {
+		return
+	}
+	folder, ok := remotePath(r.FormValue("path"))
+	if !ok {
+		http.Error(w, "Invalid folder", http.StatusBadRequest)
+		return
+	}
+	user := context.User(r.Context())
+	client, err := g.OAuthService.Client(r.Context(), provider.Config, user.ID, provider.Name)
+	var entries []models.ZipEntryResult
+	if err == nil {
+		entries, err = g.GalleryService.ImportFolder(provider.Files, client, gallery.ID, user.ID, folder)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrReconnect):
+			g.renderEdit(w, r, gallery, errors.Public(err, fmt.Sprintf("Your %v connection has expired. Please connect again.", provider.Title)))
+		case errors.Is(err, models.ErrNotFound):
+			// Either the account is not connected or the folder is gone.
+			g.renderEdit(w, r, gallery, errors.Public(err, fmt.Sprintf("Unable to find that folder in your %v.", provider.Title)))
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+	var errs []error
+	for _, entry := range entries {
+		result := newUploadResult(entry.Name, entry.Image, entry.Err)
+		if result.err != nil {
+			errs = append(errs, result.err)
+		}
+	}
+	if len(errs) > 0 {
+		g.renderEdit(w, r, gallery, errs...)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// POST /galleries/{id}/sync
+func (g Galleries) LinkFolder(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userCan(models.PermissionManage))
+	if err != nil {
+		return
+	}
+	provider, ok := g.fileProvider(w, r.FormValue("provider"))
+	if !ok {
+		return
+	}
+	folder, ok := remotePath(r.FormValue("path"))
+	if !ok {
+		http.Error(w, "Invalid folder", http.StatusBadRequest)
+		return
+	}
+	user := context.User(r.Context())
+	_, err = g.SyncService.Link(gallery.ID, user.ID, provider.Name, folder)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit#sync", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// POST /galleries/{id}/sync/run
+func (g Galleries) SyncGallery(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userCan(models.PermissionManage))
+	if err != nil {
+		return
+	}
+	err = g.SyncService.SyncSoon(gallery.ID)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "The gallery is not linked to a folder", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit#sync", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// POST /galleries/{id}/sync/delete
+func (g Galleries) UnlinkGallery(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userCan(models.PermissionManage))
+	if err != nil {
+		return
+	}
+	err = g.SyncService.Unlink(gallery.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
@@ -0,0 +1,357 @@
+package controllers
+
+import (
+	"Gallery/context"
+	"Gallery/errors"
+	"Gallery/models"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type Collections struct {
+	Templates struct {
+		Show Template
+		Edit Template
+	}
+	CollectionService *models.CollectionService
+	GalleryService    *models.GalleryService
+}
+
+type collectionOpt func(http.ResponseWriter, *http.Request, *models.Collection) error
+
+// breadcrumb is one step of the path shown above galleries and collections.
+type breadcrumb struct {
+	Title string
+	URL   string
+}
+
+// collectionOption is a collection offered as the target of a move.
+type collectionOption struct {
+	ID   int
+	Path string
+}
+
+// POST /collections
+func (c Collections) Create(w http.ResponseWriter, r *http.Request) {
+	title := strings.TrimSpace(r.FormValue("title"))
+	if title == "" {
+		http.Error(w, "A title is required", http.StatusBadRequest)
+		return
+	}
+	parentID, _ := strconv.Atoi(r.FormValue("parent_id"))
+	user := context.User(r.Context())
+	collection, err := c.CollectionService.Create(user.ID, parentID, title)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Collection not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/collections/%d", collection.ID), http.StatusFound)
+}
+
+// GET /collections/{id}
+func (c Collections) Show(w http.ResponseWriter, r *http.Request) {
+	collection, err := c.collectionByID(w, r, userCanViewCollection)
+	if err != nil {
+		return
+	}
+	type Item struct {
+		ID         int
+		Title      string
+		Visibility models.Visibility
+	}
+	var data struct {
+		ID          int
+		Title       string
+		Visibility  models.Visibility
+		IsOwner     bool
+		Breadcrumbs []breadcrumb
+		Collections []Item
+		Galleries   []Item
+	}
+	var userID int
+	if user := context.User(r.Context()); user != nil {
+		userID = user.ID
+	}
+	data.ID = collection.ID
+	data.Title = collection.Title
+	data.Visibility = collection.Visibility
+	data.IsOwner = userID == collection.UserID
+	data.Breadcrumbs, err = collectionBreadcrumbs(c.CollectionService, userID, collection.ParentID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	children, err := c.CollectionService.Children(collection.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, child := range children {
+		if child.CanView(userID) {
+			data.Collections = append(data.Collections, Item{
+				ID:         child.ID,
+				Title:      child.Title,
+				Visibility: child.Visibility,
+			})
+		}
+	}
+	galleries, err := c.GalleryService.ByCollection(collection.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, gallery := range galleries {
+		// Unlisted galleries are left out for visitors, who could not open
+		// them without the share link anyway.
+		if gallery.CanView(userID, "") {
+			data.Galleries = append(data.Galleries, Item{
+				ID:         gallery.ID,
+				Title:      gallery.Title,
+				Visibility: gallery.Visibility,
+			})
+		}
+	}
+	c.Templates.Show.Execute(w, r, data)
+}
+
+// GET /collections/{id}/edit
+func (c Collections) Edit(w http.ResponseWriter, r *http.Request) {
+	collection, err := c.collectionByID(w, r, userMustOwnCollection)
+	if err != nil {
+		return
+	}
+	c.renderEdit(w, r, collection)
+}
+
+func (c Collections) renderEdit(w http.ResponseWriter, r *http.Request, collection *models.Collection, errs ...error) {
+	var data struct {
+		ID                 int
+		Title              string
+		ParentID           int
+		Visibility         models.Visibility
+		VisibilityOverride models.Visibility
+		Breadcrumbs        []breadcrumb
+		Parents            []collectionOption
+	}
+	data.ID = collection.ID
+	data.Title = collection.Title
+	data.ParentID = collection.ParentID
+	data.Visibility = collection.Visibility
+	data.VisibilityOverride = collection.VisibilityOverride
+	var err error
+	data.Breadcrumbs, err = collectionBreadcrumbs(c.CollectionService, collection.UserID, collection.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	collections, err := c.CollectionService.ByUserID(collection.UserID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.Parents = collectionOptions(collections, collection.ID)
+	c.Templates.Edit.Execute(w, r, data, errs...)
+}
+
+// POST /collections/{id}
+func (c Collections) Update(w http.ResponseWriter, r *http.Request) {
+	collection, err := c.collectionByID(w, r, userMustOwnCollection)
+	if err != nil {
+		return
+	}
+	title := strings.TrimSpace(r.FormValue("title"))
+	if title == "" {
+		http.Error(w, "A title is required", http.StatusBadRequest)
+		return
+	}
+	visibility, ok := parseVisibilityOverride(r.FormValue("visibility"))
+	if !ok {
+		http.Error(w, "Invalid visibility", http.StatusBadRequest)
+		return
+	}
+	collection.Title = title
+	collection.VisibilityOverride = visibility
+	err = c.CollectionService.Update(collection)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/collections/%d/edit", collection.ID), http.StatusFound)
+}
+
+// POST /collections/{id}/move
+func (c Collections) Move(w http.ResponseWriter, r *http.Request) {
+	collection, err := c.collectionByID(w, r, userMustOwnCollection)
+	if err != nil {
+		return
+	}
+	parentID, err := strconv.Atoi(r.FormValue("parent_id"))
+	if err != nil {
+		http.Error(w, "Invalid collection", http.StatusBadRequest)
+		return
+	}
+	err = c.CollectionService.Move(collection, parentID)
+	if err != nil {
+		var validationErr models.ValidationError
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			http.Error(w, "Collection not found", http.StatusNotFound)
+		case errors.As(err, &validationErr):
+			c.renderEdit(w, r, collection, errors.Public(err, fmt.Sprintf("Unable to move the collection: %v.", validationErr.Issue)))
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/collections/%d/edit", collection.ID), http.StatusFound)
+}
+
+// POST /collections/{id}/delete
+func (c Collections) Delete(w http.ResponseWriter, r *http.Request) {
+	collection, err := c.collectionByID(w, r, userMustOwnCollection)
+	if err != nil {
+		return
+	}
+	err = c.CollectionService.Delete(collection)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if collection.ParentID != 0 {
+		http.Redirect(w, r, fmt.Sprintf("/collections/%d", collection.ParentID), http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/galleries", http.StatusFound)
+}
+
+func (c Collections) collectionByID(w http.ResponseWriter, r *http.Request, opts ...collectionOpt) (*models.Collection, error) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return nil, err
+	}
+	collection, err := c.CollectionService.ByID(id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Collection not found", http.StatusNotFound)
+			return nil, err
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return nil, err
+	}
+	for _, opt := range opts {
+		err = opt(w, r, collection)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return collection, nil
+}
+
+// userCanViewCollection reports collections the user may not see as missing,
+// like userCanViewGallery.
+func userCanViewCollection(w http.ResponseWriter, r *http.Request, collection *models.Collection) error {
+	var userID int
+	if user := context.User(r.Context()); user != nil {
+		userID = user.ID
+	}
+	if !collection.CanView(userID) {
+		http.Error(w, "Collection not found", http.StatusNotFound)
+		return fmt.Errorf("user cannot view this collection")
+	}
+	return nil
+}
+
+func userMustOwnCollection(w http.ResponseWriter, r *http.Request, collection *models.Collection) error {
+	user := context.User(r.Context())
+	if user.ID != collection.UserID {
+		http.Error(w, "You are not authorized to edit the collection", http.StatusForbidden)
+		return fmt.Errorf("user does not own this collection")
+	}
+	return nil
+}
+
+// parseVisibilityOverride parses the visibility field of the gallery and
+// collection forms, where "inherit" clears the override.
+func parseVisibilityOverride(s string) (models.Visibility, bool) {
+	if s == "inherit" {
+		return "", true
+	}
+	return models.ParseVisibility(s)
+}
+
+// collectionBreadcrumbs returns the path down to and including the
+// collection, leaving out any collection the user cannot view so that the
+// titles of private collections do not leak through a shared gallery.
+func collectionBreadcrumbs(cs *models.CollectionService, userID, collectionID int) ([]breadcrumb, error) {
+	if collectionID == 0 {
+		return nil, nil
+	}
+	ancestors, err := cs.Ancestors(collectionID)
+	if err != nil {
+		return nil, err
+	}
+	var crumbs []breadcrumb
+	for _, ancestor := range ancestors {
+		if ancestor.CanView(userID) {
+			crumbs = append(crumbs, breadcrumb{
+				Title: ancestor.Title,
+				URL:   fmt.Sprintf("/collections/%d", ancestor.ID),
+			})
+		}
+	}
+	return crumbs, nil
+}
+
+// collectionOptions lists the collections with their full paths, sorted by
+// path. The collection excludeID and everything inside it are left out, as
+// a collection cannot be moved into itself.
+func collectionOptions(collections []models.Collection, excludeID int) []collectionOption {
+	byID := make(map[int]models.Collection, len(collections))
+	for _, collection := range collections {
+		byID[collection.ID] = collection
+	}
+	var options []collectionOption
+	for _, collection := range collections {
+		var titles []string
+		excluded := false
+		// The depth limit guards against a corrupt tree.
+		for id, depth := collection.ID, 0; id != 0 && depth < 100; depth++ {
+			if id == excludeID {
+				excluded = true
+				break
+			}
+			titles = append([]string{byID[id].Title}, titles...)
+			id = byID[id].ParentID
+		}
+		if !excluded {
+			options = append(options, collectionOption{
+				ID:   collection.ID,
+				Path: strings.Join(titles, " / "),
+			})
+		}
+	}
+	sort.Slice(options, func(i, j int) bool {
+		return options[i].Path < options[j].Path
+	})
+	return options
+}
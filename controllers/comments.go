@@ -0,0 +1,171 @@
+package controllers
+
+import (
+	"Gallery/context"
+	"Gallery/errors"
+	"Gallery/models"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// comment is a comment as shown on the gallery page.
+type comment struct {
+	ID        int
+	GalleryID int
+	ImageID   int
+	Author    string
+	Body      string
+	CreatedAt time.Time
+	Deleted   bool
+	// ReplyForm and DeleteAction are empty when the viewer may not reply
+	// to or delete the comment.
+	ReplyForm    *commentForm
+	DeleteAction string
+	Replies      []comment
+}
+
+// commentForm is the form for a new comment on the gallery, on an image or
+// in reply to another comment.
+type commentForm struct {
+	Action   string
+	ImageID  int
+	ParentID int
+}
+
+// commentAction returns the path comment forms post to. The share token is
+// passed along so that viewers of an unlisted gallery can comment.
+func commentAction(galleryID int, shareToken, path string) string {
+	action := fmt.Sprintf("/galleries/%d/comments%s", galleryID, path)
+	if shareToken != "" {
+		action += "?share=" + url.QueryEscape(shareToken)
+	}
+	return action
+}
+
+// commentsView turns the comment threads into what show.gohtml renders.
+// Commenters can delete their own comments and the gallery owner can delete
+// any of them.
+func commentsView(threads []*models.Comment, userID int, canReply, canModerate bool, shareToken string) []comment {
+	var comments []comment
+	for _, thread := range threads {
+		replies := commentsView(thread.Replies, userID, canReply, canModerate, shareToken)
+		// Deleted comments are only kept as the parent of their replies.
+		if thread.Deleted && len(replies) == 0 {
+			continue
+		}
+		view := comment{
+			ID:        thread.ID,
+			GalleryID: thread.GalleryID,
+			ImageID:   thread.ImageID,
+			Author:    thread.Author,
+			Body:      thread.Body,
+			CreatedAt: thread.CreatedAt,
+			Deleted:   thread.Deleted,
+			Replies:   replies,
+		}
+		if canReply && !thread.Deleted {
+			view.ReplyForm = &commentForm{
+				Action:   commentAction(thread.GalleryID, shareToken, ""),
+				ImageID:  thread.ImageID,
+				ParentID: thread.ID,
+			}
+		}
+		if !thread.Deleted && (canModerate || (userID != 0 && thread.UserID == userID)) {
+			view.DeleteAction = commentAction(thread.GalleryID, shareToken, fmt.Sprintf("/%d/delete", thread.ID))
+		}
+		comments = append(comments, view)
+	}
+	return comments
+}
+
+// POST /galleries/{id}/comments
+func (g Galleries) CreateComment(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userCanViewGallery)
+	if err != nil {
+		return
+	}
+	if gallery.CommentsDisabled {
+		http.Error(w, "Comments are turned off for this gallery", http.StatusForbidden)
+		return
+	}
+	// Both are optional: a comment without an image is on the gallery, and
+	// one without a parent starts a new thread.
+	imageID, _ := strconv.Atoi(r.FormValue("image_id"))
+	parentID, _ := strconv.Atoi(r.FormValue("parent_id"))
+	user := context.User(r.Context())
+	created, err := g.CommentService.Create(gallery.ID, imageID, parentID, user.ID, r.FormValue("body"))
+	if err != nil {
+		var validationErr models.ValidationError
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			http.Error(w, "Comment not found", http.StatusNotFound)
+		case errors.As(err, &validationErr):
+			g.renderShow(w, r, gallery, errors.Public(err, fmt.Sprintf("Unable to post the comment: %v.", validationErr.Issue)))
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+	http.Redirect(w, r, galleryPageURL(gallery, r.FormValue("share"), fmt.Sprintf("comment-%d", created.ID)), http.StatusFound)
+}
+
+// POST /galleries/{id}/comments/{commentID}/delete
+func (g Galleries) DeleteComment(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userCanViewGallery)
+	if err != nil {
+		return
+	}
+	commentID, err := strconv.Atoi(chi.URLParam(r, "commentID"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+	existing, err := g.CommentService.ByID(commentID)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Comment not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if existing.GalleryID != gallery.ID {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return
+	}
+	user := context.User(r.Context())
+	if existing.UserID != user.ID {
+		role, err := g.role(w, r, gallery)
+		if err != nil {
+			return
+		}
+		if !role.Can(models.PermissionManage) {
+			http.Error(w, "You can only delete your own comments", http.StatusForbidden)
+			return
+		}
+	}
+	err = g.CommentService.Delete(existing.ID)
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, galleryPageURL(gallery, r.FormValue("share"), fmt.Sprintf("comment-%d", existing.ID)), http.StatusFound)
+}
+
+// galleryPageURL links to an element on the gallery page, keeping the share
+// token the viewer used to open it.
+func galleryPageURL(gallery *models.Gallery, shareToken, anchor string) string {
+	u := fmt.Sprintf("/galleries/%d", gallery.ID)
+	if shareToken != "" {
+		u += "?share=" + url.QueryEscape(shareToken)
+	}
+	return u + "#" + anchor
+}
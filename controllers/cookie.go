@@ -7,6 +7,11 @@ import (
 
 const (
 	CookieSession = "session"
+	// CookieProofing identifies a viewer's favourites in proofing galleries.
+	CookieProofing = "proofing"
+	// CookieOIDCState ties a sign in at a provider to the browser that
+	// started it.
+	CookieOIDCState = "oidc_state"
 )
 
 func newCookie(name, value string) *http.Cookie {
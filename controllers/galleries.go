@@ -2,13 +2,19 @@ package controllers
 
 import (
 	"Gallery/context"
+	"Gallery/errors"
 	"Gallery/models"
-	"errors"
+	"encoding/json"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
 	"net/url"
+	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"golang.org/x/sync/errgroup"
@@ -16,12 +22,30 @@ import (
 
 type Galleries struct {
 	Templates struct {
-		New   Template
-		Edit  Template
-		Index Template
-		Show  Template
+		New        Template
+		Edit       Template
+		Index      Template
+		Show       Template
+		Trash      Template
+		Search     Template
+		Selections Template
+		Invitation Template
 	}
-	GalleryService *models.GalleryService
+	GalleryService    *models.GalleryService
+	UploadService     *models.UploadService
+	QuotaService      *models.QuotaService
+	CollectionService *models.CollectionService
+	CommentService    *models.CommentService
+	SelectionService  *models.SelectionService
+	EmailService      *models.EmailService
+	OAuthService      *models.OAuthService
+	SyncService       *models.SyncService
+	// Providers are the configured OAuth providers. Images can be imported
+	// from those with files.
+	Providers models.Providers
+	// TrashRetention is how long deleted galleries and images stay in the
+	// trash. Defaults to models.DefaultTrashRetention.
+	TrashRetention time.Duration
 }
 
 type galleryOpt func(http.ResponseWriter, *http.Request, *models.Gallery) error
@@ -45,6 +69,10 @@ func (g Galleries) Create(w http.ResponseWriter, r *http.Request) {
 
 	gallery, err := g.GalleryService.Create(data.Title, data.UserID)
 	if err != nil {
+		var quotaErr models.QuotaError
+		if errors.As(err, &quotaErr) {
+			err = errors.Public(err, fmt.Sprintf("Unable to create the gallery: %v.", quotaErr.Issue))
+		}
 		g.Templates.New.Execute(w, r, data, err)
 		return
 	}
@@ -55,22 +83,108 @@ func (g Galleries) Create(w http.ResponseWriter, r *http.Request) {
 }
 
 func (g Galleries) Edit(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	gallery, err := g.galleryByID(w, r, g.userCan(models.PermissionUpload))
 	if err != nil {
 		return
 	}
+	g.renderEdit(w, r, gallery)
+}
+
+func (g Galleries) renderEdit(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, errs ...error) {
 	type Image struct {
+		ID              int
 		GalleryID       int
 		Filename        string
 		FilenameEscaped string
+		Caption         string
+		AltText         string
+		Tags            string
+		IsCover         bool
 	}
 	var data struct {
-		ID     int
-		Title  string
-		Images []Image
+		ID                 int
+		Title              string
+		Description        string
+		KeepMetadata       bool
+		CommentsDisabled   bool
+		Proofing           bool
+		Visibility         models.Visibility
+		VisibilityOverride models.Visibility
+		ShareURL           string
+		CollectionID       int
+		Collections        []collectionOption
+		Breadcrumbs        []breadcrumb
+		Images             []Image
+		// CanEdit and CanManage hide the parts of the page the user's role
+		// does not allow; contributors only see the upload forms.
+		CanEdit       bool
+		CanManage     bool
+		Collaborators []models.Collaborator
+		Roles         []models.Role
+		Clouds        []cloudBrowser
+		// Sync is the folder the gallery is kept in sync with, if any, and
+		// SyncTitle the name of its provider.
+		Sync      *models.GallerySync
+		SyncTitle string
+	}
+	role, err := g.role(w, r, gallery)
+	if err != nil {
+		return
 	}
 	data.ID = gallery.ID
 	data.Title = gallery.Title
+	data.Description = gallery.Description
+	data.KeepMetadata = gallery.KeepMetadata
+	data.CommentsDisabled = gallery.CommentsDisabled
+	data.Proofing = gallery.Proofing
+	data.Visibility = gallery.Visibility
+	data.VisibilityOverride = gallery.VisibilityOverride
+	data.CanEdit = role.Can(models.PermissionEdit)
+	data.CanManage = role.Can(models.PermissionManage)
+	if data.CanManage {
+		if gallery.Visibility == models.VisibilityUnlisted {
+			data.ShareURL = shareURL(r, gallery)
+		}
+		data.CollectionID = gallery.CollectionID
+		collections, err := g.CollectionService.ByUserID(gallery.UserID)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		data.Collections = collectionOptions(collections, 0)
+		data.Collaborators, err = g.GalleryService.Collaborators(gallery.ID)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		data.Roles = []models.Role{models.RoleViewer, models.RoleContributor, models.RoleEditor}
+		data.Sync, err = g.SyncService.ByGalleryID(gallery.ID)
+		if err != nil && !errors.Is(err, models.ErrNotFound) {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		if data.Sync != nil {
+			data.SyncTitle = data.Sync.Provider
+			if provider, ok := g.Providers[data.Sync.Provider]; ok {
+				data.SyncTitle = provider.Title
+			}
+		}
+	}
+	data.Breadcrumbs, err = collectionBreadcrumbs(g.CollectionService, context.User(r.Context()).ID, gallery.CollectionID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.Clouds, err = g.cloudBrowsers(r, gallery)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
 	images, err := g.GalleryService.Images(gallery.ID)
 	//fmt.Println(images)
 	if err != nil {
@@ -80,29 +194,47 @@ func (g Galleries) Edit(w http.ResponseWriter, r *http.Request) {
 	}
 	for _, image := range images {
 		data.Images = append(data.Images, Image{
+			ID:              image.ID,
 			GalleryID:       image.GalleryID,
 			Filename:        image.Filename,
 			FilenameEscaped: url.PathEscape(image.Filename),
+			Caption:         image.Caption,
+			AltText:         image.AltText,
+			Tags:            strings.Join(image.Tags, ", "),
+			IsCover:         image.ID == gallery.CoverImageID,
 		})
 	}
 	//fmt.Println(data)
-	g.Templates.Edit.Execute(w, r, data)
+	g.Templates.Edit.Execute(w, r, data, errs...)
 }
 
 func (g Galleries) Update(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	gallery, err := g.galleryByID(w, r, g.userCan(models.PermissionEdit))
 	if err != nil {
 		return
 	}
 
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "You are not authorized to edit this gallery", http.StatusForbidden)
+	role, err := g.role(w, r, gallery)
+	if err != nil {
 		return
 	}
 
 	title := r.FormValue("title")
 	gallery.Title = title
+	gallery.Description = strings.TrimSpace(r.FormValue("description"))
+	// Only the owner decides who can see and comment on the gallery and
+	// what is kept in the files; the form does not show these settings to editors.
+	if role.Can(models.PermissionManage) {
+		gallery.KeepMetadata = r.FormValue("keep_metadata") == "true"
+		gallery.CommentsDisabled = r.FormValue("comments_disabled") == "true"
+		gallery.Proofing = r.FormValue("proofing") == "true"
+		visibility, ok := parseVisibilityOverride(r.FormValue("visibility"))
+		if !ok {
+			http.Error(w, "Invalid visibility", http.StatusBadRequest)
+			return
+		}
+		gallery.VisibilityOverride = visibility
+	}
 	err = g.GalleryService.Update(gallery)
 	if err != nil {
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
@@ -114,64 +246,260 @@ func (g Galleries) Update(w http.ResponseWriter, r *http.Request) {
 
 func (g Galleries) Index(w http.ResponseWriter, r *http.Request) {
 	type Gallery struct {
-		ID    int
-		Title string
+		ID         int
+		Title      string
+		Visibility models.Visibility
+		Collection string
+		// CoverURL is the thumbnail of the cover image, empty for a gallery
+		// without images.
+		CoverURL string
 	}
 	var data struct {
-		Galleries []Gallery
+		Galleries   []Gallery
+		Collections []collectionOption
+		// Shared are the galleries other users shared with this one.
+		Shared []models.SharedGallery
+		Pages  pageLinks
+		Usage  struct {
+			Bytes        string
+			MaxBytes     string
+			Percent      int
+			Galleries    int
+			MaxGalleries int
+		}
 	}
 
 	user := context.User(r.Context())
-	galleries, err := g.GalleryService.ByUserID(user.ID)
+	galleries, page, err := g.GalleryService.ByUserIDPage(user.ID, listOptions(r))
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.Pages = newPageLinks("/galleries", nil, page, models.GallerySorts)
+	quota, err := g.QuotaService.ForUser(user.ID)
 	if err != nil {
 		fmt.Println(err)
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
+	usage, err := g.QuotaService.Usage(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.Usage.Bytes = models.FormatBytes(usage.Bytes)
+	data.Usage.Galleries = usage.Galleries
+	data.Usage.MaxGalleries = quota.MaxGalleries
+	if quota.MaxBytes > 0 {
+		data.Usage.MaxBytes = models.FormatBytes(quota.MaxBytes)
+		data.Usage.Percent = int(min(100, usage.Bytes*100/quota.MaxBytes))
+	}
+
+	collections, err := g.CollectionService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.Collections = collectionOptions(collections, 0)
+	paths := make(map[int]string)
+	for _, collection := range data.Collections {
+		paths[collection.ID] = collection.Path
+	}
 
 	for _, gallery := range galleries {
+		var coverURL string
+		if gallery.Cover != "" {
+			coverURL = fmt.Sprintf("/galleries/%d/images/%s?size=thumb", gallery.ID, url.PathEscape(gallery.Cover))
+		}
 		data.Galleries = append(data.Galleries, Gallery{
-			ID:    gallery.ID,
-			Title: gallery.Title,
+			ID:         gallery.ID,
+			Title:      gallery.Title,
+			Visibility: gallery.Visibility,
+			Collection: paths[gallery.CollectionID],
+			CoverURL:   coverURL,
 		})
 	}
-
+	data.Shared, err = g.GalleryService.SharedWith(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
 	g.Templates.Index.Execute(w, r, data)
 }
 
 func (g Galleries) Show(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r)
+	gallery, err := g.galleryByID(w, r, g.userCanViewGallery)
 	if err != nil {
 		return
 	}
+	g.renderShow(w, r, gallery)
+}
+
+func (g Galleries) renderShow(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, errs ...error) {
 	type Image struct {
+		ID              int
 		GalleryID       int
 		Filename        string
 		FilenameEscaped string
+		Camera          string
+		Alt             string
+		Caption         string
+		Tags            []string
+		Comments        []comment
+		CommentForm     *commentForm
+		Favourite       bool
 	}
 	var data struct {
-		ID     int
-		Title  string
-		Images []Image
+		ID          int
+		Title       string
+		Description string
+		// ShareToken is passed along on image URLs so that viewers of an
+		// unlisted gallery can load its images.
+		ShareToken string
+		// Tag is the tag the images are filtered by, if any.
+		Tag         string
+		Tags        []models.TagCount
+		Breadcrumbs []breadcrumb
+		Images      []Image
+		// CanComment is false for visitors who are not signed in and when
+		// comments are turned off.
+		CanComment       bool
+		CommentsDisabled bool
+		SignedIn         bool
+		Comments         []comment
+		CommentForm      *commentForm
+		// Proofing galleries let the viewer pick favourites. Selection is
+		// nil until they pick the first one.
+		Proofing  bool
+		Selection *models.Selection
+		Pages     pageLinks
 	}
 	data.ID = gallery.ID
 	data.Title = gallery.Title
-	images, err := g.GalleryService.Images(gallery.ID)
+	data.Description = gallery.Description
+	if gallery.Visibility == models.VisibilityUnlisted {
+		data.ShareToken = gallery.ShareToken
+	}
+	var userID int
+	if user := context.User(r.Context()); user != nil {
+		userID = user.ID
+	}
+	data.SignedIn = userID != 0
+	data.CommentsDisabled = gallery.CommentsDisabled
+	data.CanComment = data.SignedIn && !gallery.CommentsDisabled
+	var err error
+	data.Breadcrumbs, err = collectionBreadcrumbs(g.CollectionService, userID, gallery.CollectionID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.Tag = strings.ToLower(strings.TrimSpace(r.FormValue("tag")))
+	images, page, err := g.GalleryService.ImagesPage(gallery.ID, data.Tag, listOptions(r))
 	//fmt.Println(images)
 	if err != nil {
 		fmt.Println(err)
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
+	data.Pages = newPageLinks(fmt.Sprintf("/galleries/%d", gallery.ID), url.Values{
+		"tag":   {data.Tag},
+		"share": {r.FormValue("share")},
+	}, page, models.ImageSorts)
+	data.Tags, err = g.GalleryService.Tags(gallery.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	role, err := g.role(w, r, gallery)
+	if err != nil {
+		return
+	}
+	comments, err := g.CommentService.ByGallery(gallery.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if data.CanComment {
+		data.CommentForm = &commentForm{
+			Action: commentAction(gallery.ID, data.ShareToken, ""),
+		}
+	}
+	favourites := make(map[int]bool)
+	data.Proofing = gallery.Proofing
+	if gallery.Proofing {
+		token, err := viewerToken(w, r, false)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		if token != "" {
+			data.Selection, err = g.SelectionService.ByViewer(gallery.ID, token)
+			if err != nil && !errors.Is(err, models.ErrNotFound) {
+				fmt.Println(err)
+				http.Error(w, "Something went wrong", http.StatusInternalServerError)
+				return
+			}
+		}
+		if data.Selection != nil {
+			ids, err := g.SelectionService.ImageIDs(data.Selection.ID)
+			if err != nil {
+				fmt.Println(err)
+				http.Error(w, "Something went wrong", http.StatusInternalServerError)
+				return
+			}
+			for _, id := range ids {
+				favourites[id] = true
+			}
+		}
+	}
+	imageComments := make(map[int][]comment)
+	for _, thread := range commentsView(models.CommentThreads(comments), userID, data.CanComment,
+		role.Can(models.PermissionManage), data.ShareToken) {
+		if thread.ImageID == 0 {
+			data.Comments = append(data.Comments, thread)
+			continue
+		}
+		imageComments[thread.ImageID] = append(imageComments[thread.ImageID], thread)
+	}
 	for _, image := range images {
+		// Fall back to the caption, then the filename, so that no photo is
+		// announced as decorative by screen readers.
+		alt := image.AltText
+		if alt == "" {
+			alt = image.Caption
+		}
+		if alt == "" {
+			alt = image.Filename
+		}
 		data.Images = append(data.Images, Image{
+			ID:              image.ID,
 			GalleryID:       image.GalleryID,
 			Filename:        image.Filename, // 将特殊字符编码以在URL中使用
 			FilenameEscaped: url.PathEscape(image.Filename),
+			Camera:          image.Metadata.Camera(),
+			Alt:             alt,
+			Caption:         image.Caption,
+			Tags:            image.Tags,
+			Comments:        imageComments[image.ID],
+			Favourite:       favourites[image.ID],
 		})
+		if data.CanComment {
+			data.Images[len(data.Images)-1].CommentForm = &commentForm{
+				Action:  data.CommentForm.Action,
+				ImageID: image.ID,
+			}
+		}
 	}
 	//fmt.Println(data)
-	g.Templates.Show.Execute(w, r, data)
+	g.Templates.Show.Execute(w, r, data, errs...)
 }
 
 // opts 用于功能扩展
@@ -200,17 +528,68 @@ func (g Galleries) galleryByID(w http.ResponseWriter, r *http.Request, opts ...g
 	return gallery, nil
 }
 
-func userMustOwnGallery(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
-	user := context.User(r.Context())
-	if user.ID != gallery.UserID {
-		http.Error(w, "You are not authorized to edit the gallery", http.StatusForbidden)
-		return fmt.Errorf("user does have access to this gallery")
+// userCanViewGallery enforces the gallery's visibility. Collaborators can
+// view the gallery whatever its visibility. Galleries the user may not see
+// are reported as missing so their IDs cannot be probed.
+func (g Galleries) userCanViewGallery(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
+	var userID int
+	if user := context.User(r.Context()); user != nil {
+		userID = user.ID
+	}
+	if gallery.CanView(userID, r.FormValue("share")) {
+		return nil
+	}
+	role, err := g.GalleryService.Role(gallery, userID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return err
+	}
+	if !role.Can(models.PermissionView) {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return fmt.Errorf("user cannot view this gallery")
 	}
 	return nil
 }
 
+// userCan requires the current user to have a role in the gallery that
+// grants perm. Users who cannot even view the gallery are told it does not
+// exist.
+func (g Galleries) userCan(perm models.Permission) galleryOpt {
+	return func(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
+		role, err := g.role(w, r, gallery)
+		if err != nil {
+			return err
+		}
+		if !role.Can(perm) {
+			if role.Can(models.PermissionView) || gallery.CanView(0, r.FormValue("share")) {
+				http.Error(w, "You are not authorized to edit the gallery", http.StatusForbidden)
+			} else {
+				http.Error(w, "Gallery not found", http.StatusNotFound)
+			}
+			return fmt.Errorf("user does not have permission %d on this gallery", perm)
+		}
+		return nil
+	}
+}
+
+// role looks up the current user's role in the gallery.
+func (g Galleries) role(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) (models.Role, error) {
+	var userID int
+	if user := context.User(r.Context()); user != nil {
+		userID = user.ID
+	}
+	role, err := g.GalleryService.Role(gallery, userID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return models.RoleNone, err
+	}
+	return role, nil
+}
+
 func (g Galleries) Delete(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	gallery, err := g.galleryByID(w, r, g.userCan(models.PermissionManage))
 	if err != nil {
 		return
 	}
@@ -224,31 +603,115 @@ func (g Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 
 func (g Galleries) Image(w http.ResponseWriter, r *http.Request) {
 	filename := g.filename(w, r)
-	galleryID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	gallery, err := g.galleryByID(w, r, g.userCanViewGallery)
 	if err != nil {
-		http.Error(w, "Invalid ID", http.StatusNotFound)
 		return
 	}
-	image, err := g.GalleryService.Image(galleryID, filename)
+	image, err := g.GalleryService.Image(gallery.ID, filename)
 	if err != nil {
 		if errors.Is(err, models.ErrNotFound) {
-			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			http.Error(w, "Image not found", http.StatusNotFound)
 			return
 		}
 		fmt.Println(err)
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	var size models.ImageSize
+	if sizeParam := r.FormValue("size"); sizeParam != "" {
+		var ok bool
+		size, ok = models.ParseImageSize(sizeParam)
+		if !ok {
+			http.Error(w, "Invalid size", http.StatusBadRequest)
+			return
+		}
+	}
+	// Stream the image from whichever store is configured rather than serving
+	// a local path, so any server instance can answer the request.
+	rc, info, err := g.GalleryService.OpenImage(image, size)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
 	}
-	http.ServeFile(w, r, image.Path)
+	defer rc.Close()
+	w.Header().Set("Content-Type", image.ContentType)
+	// Stored bytes never change for a blob, so its hash identifies them.
+	// Legacy images are only validated by their modification time.
+	if image.BlobHash != "" {
+		etag := image.BlobHash
+		if size.Width > 0 {
+			etag = fmt.Sprintf("%s-%d", etag, size.Width)
+		}
+		w.Header().Set("ETag", `"`+etag+`"`)
+	}
+	// ServeContent answers conditional and range requests, such as a
+	// browser resuming the download of a large original.
+	http.ServeContent(w, r, image.Filename, info.LastModified, rc)
 }
 
-func (g Galleries) DeleteImage(w http.ResponseWriter, r *http.Request) {
-	filename := g.filename(w, r)
-	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+// GET /galleries/{id}/download.zip?variant=originals|web
+func (g Galleries) Download(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userCanViewGallery)
 	if err != nil {
 		return
 	}
-	err = g.GalleryService.DeleteImage(gallery.ID, filename)
+	var size models.ImageSize
+	switch r.FormValue("variant") {
+	case "", "originals":
+	case "web":
+		size = models.SizeLarge
+	default:
+		http.Error(w, "Invalid variant", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": zipFilename(gallery),
+	}))
+	// The archive is streamed as it is written, so once it has started an
+	// error can only be logged; the client sees a truncated download.
+	err = g.GalleryService.WriteZip(w, gallery.ID, size)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+func zipFilename(gallery *models.Gallery) string {
+	name := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r < ' ' {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(gallery.Title))
+	if name == "" {
+		name = fmt.Sprintf("gallery-%d", gallery.ID)
+	}
+	return name + ".zip"
+}
+
+// POST /galleries/{id}/move
+func (g Galleries) Move(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userCan(models.PermissionManage))
+	if err != nil {
+		return
+	}
+	collectionID, err := strconv.Atoi(r.FormValue("collection_id"))
+	if err != nil {
+		http.Error(w, "Invalid collection", http.StatusBadRequest)
+		return
+	}
+	err = g.GalleryService.Move(gallery, collectionID)
 	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Collection not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
@@ -256,49 +719,430 @@ func (g Galleries) DeleteImage(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, editPath, http.StatusFound)
 }
 
-func (g Galleries) filename(w http.ResponseWriter, r *http.Request) string {
-	filename := chi.URLParam(r, "filename") //从中获得名为"filename"的参数
-	filename = filepath.Base(filename)      // 返回基本文件名部分，不包含路径
-	return filename
+// POST /galleries/{id}/share
+func (g Galleries) ResetShareLink(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userCan(models.PermissionManage))
+	if err != nil {
+		return
+	}
+	err = g.GalleryService.ResetShareToken(gallery)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
 }
 
-func (g Galleries) UploadImage(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+func shareURL(r *http.Request, gallery *models.Gallery) string {
+	return absoluteURL(r, fmt.Sprintf("/galleries/%d?share=%s", gallery.ID, url.QueryEscape(gallery.ShareToken)))
+}
+
+// absoluteURL turns a path on this site into a URL that works outside of it,
+// eg in an email.
+func absoluteURL(r *http.Request, path string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, r.Host, path)
+}
+
+// POST /galleries/{id}/collaborators
+func (g Galleries) AddCollaborator(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userCan(models.PermissionManage))
 	if err != nil {
 		return
 	}
-	err = r.ParseMultipartForm(5 << 20) //5MB
+	role, ok := models.ParseRole(r.FormValue("role"))
+	if !ok {
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		return
+	}
+	user := context.User(r.Context())
+	collaborator, err := g.GalleryService.AddCollaborator(gallery, user.ID, r.FormValue("email"), role)
 	if err != nil {
+		var validationErr models.ValidationError
+		if errors.As(err, &validationErr) {
+			g.renderEdit(w, r, gallery, errors.Public(err, fmt.Sprintf("Unable to share the gallery: %v.", validationErr.Issue)))
+			return
+		}
+		fmt.Println(err)
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
-	fileHeaders := r.MultipartForm.File["images"]
-	for _, fileHeader := range fileHeaders {
-		file, err := fileHeader.Open()
+	if collaborator.Token != "" {
+		acceptURL := absoluteURL(r, "/invitations/accept?token="+url.QueryEscape(collaborator.Token))
+		err = g.EmailService.InviteCollaborator(collaborator.Email, user.Email, gallery.Title, role, acceptURL)
 		if err != nil {
+			fmt.Println(err)
+			g.renderEdit(w, r, gallery, errors.Public(err, fmt.Sprintf("The invitation email to %s could not be sent. Add them again to send a new one.", collaborator.Email)))
+			return
+		}
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// GET /invitations/accept?token=
+//
+// The link in an invitation email. Signed in users are asked to accept it;
+// anyone else is asked to sign in first.
+func (g Galleries) Invitation(w http.ResponseWriter, r *http.Request) {
+	g.renderInvitation(w, r, r.FormValue("token"))
+}
+
+// POST /invitations/accept
+func (g Galleries) AcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	token := r.FormValue("token")
+	collaborator, err := g.GalleryService.AcceptInvitation(token, user.ID)
+	if err != nil {
+		var validationErr models.ValidationError
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			http.Error(w, "This invitation has been accepted or withdrawn", http.StatusNotFound)
+		case errors.As(err, &validationErr):
+			g.renderInvitation(w, r, token, errors.Public(err, fmt.Sprintf("Unable to accept the invitation: %v.", validationErr.Issue)))
+		default:
+			fmt.Println(err)
 			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+	galleryPath := fmt.Sprintf("/galleries/%d", collaborator.GalleryID)
+	http.Redirect(w, r, galleryPath, http.StatusFound)
+}
+
+func (g Galleries) renderInvitation(w http.ResponseWriter, r *http.Request, token string, errs ...error) {
+	invitation, err := g.GalleryService.Invitation(token)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "This invitation has been accepted or withdrawn", http.StatusNotFound)
 			return
 		}
-		defer file.Close()
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	var data struct {
+		Token        string
+		Email        string
+		Role         models.Role
+		GalleryTitle string
+	}
+	data.Token = token
+	data.Email = invitation.Email
+	data.Role = invitation.Role
+	data.GalleryTitle = invitation.Gallery.Title
+	g.Templates.Invitation.Execute(w, r, data, errs...)
+}
 
-		err = g.GalleryService.CreateImage(gallery.ID, fileHeader.Filename, file)
+// POST /galleries/{id}/collaborators/{collaboratorID}/delete
+func (g Galleries) RemoveCollaborator(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userCan(models.PermissionManage))
+	if err != nil {
+		return
+	}
+	collaboratorID, err := strconv.Atoi(chi.URLParam(r, "collaboratorID"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+	err = g.GalleryService.RemoveCollaborator(gallery.ID, collaboratorID)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Collaborator not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+func (g Galleries) DeleteImage(w http.ResponseWriter, r *http.Request) {
+	filename := g.filename(w, r)
+	gallery, err := g.galleryByID(w, r, g.userCan(models.PermissionUpload))
+	if err != nil {
+		return
+	}
+	role, err := g.role(w, r, gallery)
+	if err != nil {
+		return
+	}
+	if !role.Can(models.PermissionEdit) {
+		// Contributors may only delete the images they uploaded.
+		image, err := g.GalleryService.Image(gallery.ID, filename)
 		if err != nil {
-			var fileErr models.FileError
-			if errors.As(err, &fileErr) {
-				msg := fmt.Sprintf("%v has an invalid content type or extension. Only png, gif, and jpg files can be uploaded.", fileHeader.Filename)
-				http.Error(w, msg, http.StatusBadRequest)
+			if errors.Is(err, models.ErrNotFound) {
+				http.Error(w, "Image not found", http.StatusNotFound)
 				return
 			}
+			fmt.Println(err)
 			http.Error(w, "Something went wrong", http.StatusInternalServerError)
 			return
 		}
+		if image.UploadedBy != context.User(r.Context()).ID {
+			http.Error(w, "You can only delete images you uploaded", http.StatusForbidden)
+			return
+		}
+	}
+	err = g.GalleryService.DeleteImage(gallery.ID, filename)
+	if err != nil {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// POST /galleries/{id}/images/{filename}
+func (g Galleries) UpdateImage(w http.ResponseWriter, r *http.Request) {
+	filename := g.filename(w, r)
+	gallery, err := g.galleryByID(w, r, g.userCan(models.PermissionEdit))
+	if err != nil {
+		return
+	}
+	image, err := g.GalleryService.Image(gallery.ID, filename)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	image.Caption = r.FormValue("caption")
+	image.AltText = r.FormValue("alt_text")
+	image.Tags, err = models.ParseTags(r.FormValue("tags"))
+	if err == nil {
+		err = g.GalleryService.UpdateImageDetails(&image)
+	}
+	if err != nil {
+		var validationErr models.ValidationError
+		if errors.As(err, &validationErr) {
+			err = errors.Public(err, fmt.Sprintf("Unable to update %v: %v.", filename, validationErr.Issue))
+			g.renderEdit(w, r, gallery, err)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// POST /galleries/{id}/images/order
+func (g Galleries) ReorderImages(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userCan(models.PermissionEdit))
+	if err != nil {
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+	var imageIDs []int
+	for _, value := range r.PostForm["image_id"] {
+		imageID, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "Invalid image", http.StatusBadRequest)
+			return
+		}
+		imageIDs = append(imageIDs, imageID)
+	}
+	err = g.GalleryService.ReorderImages(gallery.ID, imageIDs)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	// The edit page saves the order in the background after each drop.
+	if wantsJSON(r) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// POST /galleries/{id}/cover
+func (g Galleries) SetCover(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userCan(models.PermissionEdit))
+	if err != nil {
+		return
+	}
+	imageID, err := strconv.Atoi(r.FormValue("image_id"))
+	if err != nil {
+		http.Error(w, "Invalid image", http.StatusBadRequest)
+		return
+	}
+	err = g.GalleryService.SetCover(gallery, imageID)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
 	}
 	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
 	http.Redirect(w, r, editPath, http.StatusFound)
 }
 
+func (g Galleries) filename(w http.ResponseWriter, r *http.Request) string {
+	filename := chi.URLParam(r, "filename") //从中获得名为"filename"的参数
+	filename = filepath.Base(filename)      // 返回基本文件名部分，不包含路径
+	return filename
+}
+
+// uploadResult reports the outcome of uploading a single file.
+type uploadResult struct {
+	Filename string `json:"filename"`
+	// Image is the name the image was stored under, which differs from
+	// Filename when the gallery already has an image of that name.
+	Image string `json:"image,omitempty"`
+	Error string `json:"error,omitempty"`
+	err   error
+}
+
+func newUploadResult(filename string, image *models.Image, err error) uploadResult {
+	result := uploadResult{Filename: filename}
+	if err != nil {
+		fmt.Println(err)
+		result.err = uploadError(filename, err)
+		result.Error = result.err.(interface{ Public() string }).Public()
+		return result
+	}
+	result.Image = image.Filename
+	return result
+}
+
+// uploadError turns the error returned when creating an image into one that
+// can be shown to the user.
+func uploadError(filename string, err error) error {
+	var fileErr models.FileError
+	if errors.As(err, &fileErr) {
+		msg := fmt.Sprintf("%v could not be uploaded (%v). Only png, gif, and jpg files, or a zip of them, can be uploaded.", filename, fileErr.Issue)
+		return errors.Public(err, msg)
+	}
+	var quotaErr models.QuotaError
+	if errors.As(err, &quotaErr) {
+		return errors.Public(err, fmt.Sprintf("%v could not be uploaded: %v.", filename, quotaErr.Issue))
+	}
+	return errors.Public(err, fmt.Sprintf("%v could not be uploaded. Please try again.", filename))
+}
+
+// uploadFile creates an image from the file, or one for every entry if the
+// file is a ZIP archive.
+func (g Galleries) uploadFile(galleryID, userID int, filename string, contents io.Reader) []uploadResult {
+	if !strings.EqualFold(path.Ext(filename), ".zip") {
+		image, err := g.GalleryService.CreateImage(galleryID, userID, filename, contents)
+		return []uploadResult{newUploadResult(filename, image, err)}
+	}
+	entries, err := g.GalleryService.ImportZip(galleryID, userID, contents)
+	if err != nil {
+		return []uploadResult{newUploadResult(filename, nil, err)}
+	}
+	var results []uploadResult
+	for _, entry := range entries {
+		results = append(results, newUploadResult(filename+"/"+entry.Name, entry.Image, entry.Err))
+	}
+	return results
+}
+
+// POST /galleries/{id}/images
+//
+// Files are streamed one at a time with r.MultipartReader so a large batch is
+// never held in memory or spilled to disk. The CSRF middleware has to parse
+// the whole form to find its token when it is not sent in the X-CSRF-Token
+// header, in which case the parsed files are used instead; LimitFormUploads
+// caps the size of such forms. A file that fails does not stop the rest of
+// the batch.
+func (g Galleries) UploadImage(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userCan(models.PermissionUpload))
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	var results []uploadResult
+	if r.MultipartForm != nil {
+		for _, fileHeader := range r.MultipartForm.File["images"] {
+			file, err := fileHeader.Open()
+			if err != nil {
+				results = append(results, newUploadResult(fileHeader.Filename, nil, err))
+				continue
+			}
+			results = append(results, g.uploadFile(gallery.ID, user.ID, fileHeader.Filename, file)...)
+			file.Close()
+		}
+	} else {
+		mr, err := r.MultipartReader()
+		if err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				// The request was cut off. Report the files received so far.
+				results = append(results, newUploadResult("The remaining files", nil, err))
+				break
+			}
+			filename := part.FileName()
+			if part.FormName() != "images" || filename == "" {
+				part.Close()
+				continue
+			}
+			results = append(results, g.uploadFile(gallery.ID, user.ID, filename, part)...)
+			part.Close()
+		}
+	}
+
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, results)
+		return
+	}
+	var errs []error
+	for _, result := range results {
+		if result.err != nil {
+			errs = append(errs, result.err)
+		}
+	}
+	if len(errs) > 0 {
+		g.renderEdit(w, r, gallery, errs...)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
 func (g Galleries) ImageViaURL(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	gallery, err := g.galleryByID(w, r, g.userCan(models.PermissionUpload))
 	if err != nil {
 		return
 	}
@@ -308,20 +1152,32 @@ func (g Galleries) ImageViaURL(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	files := r.PostForm["files"]
+	user := context.User(r.Context())
 
+	// Each download reports into its own slot so one failure does not hide
+	// the others.
+	results := make([]uploadResult, len(files))
 	eg := errgroup.Group{}
-	for _, file := range files {
-		imageFile := file
+	for i, file := range files {
+		i, imageFile := i, file
 		eg.Go(func() error {
-			return g.GalleryService.CreateImageViaURL(gallery.ID, imageFile)
+			image, err := g.GalleryService.CreateImageViaURL(gallery.ID, user.ID, imageFile)
+			results[i] = newUploadResult(path.Base(imageFile), image, err)
+			return nil
 		})
 	}
-	err = eg.Wait()
-	if err != nil {
-		http.Error(w, "Unable to download all images", http.StatusInternalServerError)
+	eg.Wait()
+
+	var errs []error
+	for _, result := range results {
+		if result.err != nil {
+			errs = append(errs, result.err)
+		}
+	}
+	if len(errs) > 0 {
+		g.renderEdit(w, r, gallery, errs...)
 		return
 	}
-
 	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
 	http.Redirect(w, r, editPath, http.StatusFound)
 }
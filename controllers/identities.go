@@ -0,0 +1,262 @@
+package controllers
+
+import (
+	"Gallery/context"
+	"Gallery/errors"
+	"Gallery/models"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/oauth2"
+)
+
+// signInProvider looks up the provider named in the URL, which users must be
+// able to sign in with.
+func (u Users) signInProvider(w http.ResponseWriter, r *http.Request) (*models.OAuthProvider, bool) {
+	name := strings.ToLower(chi.URLParam(r, "provider"))
+	provider, ok := u.Providers[name]
+	if !ok || provider.OIDC == nil {
+		http.Error(w, "Invalid provider", http.StatusNotFound)
+		return nil, false
+	}
+	return provider, true
+}
+
+// GET /signin/{provider}
+func (u Users) OIDCSignIn(w http.ResponseWriter, r *http.Request) {
+	provider, ok := u.signInProvider(w, r)
+	if !ok {
+		return
+	}
+	u.startOIDC(w, r, provider, 0, "/galleries")
+}
+
+// GET /users/me/identities/{provider}/link
+func (u Users) LinkIdentity(w http.ResponseWriter, r *http.Request) {
+	provider, ok := u.signInProvider(w, r)
+	if !ok {
+		return
+	}
+	user := context.User(r.Context())
+	u.startOIDC(w, r, provider, user.ID, "/users/me")
+}
+
+func oidcCallbackPath(provider *models.OAuthProvider) string {
+	return "/signin/" + provider.Name + "/callback"
+}
+
+// oidcStateCookie holds the state of the authorization the browser started,
+// which the callback checks so that nobody can complete their own sign in in
+// someone else's browser. It is only sent to the provider's callback.
+func oidcStateCookie(provider *models.OAuthProvider, state string) *http.Cookie {
+	cookie := newCookie(CookieOIDCState, state)
+	cookie.Path = oidcCallbackPath(provider)
+	cookie.MaxAge = int(models.OAuthStateDuration.Seconds())
+	cookie.SameSite = http.SameSiteLaxMode
+	return cookie
+}
+
+// startOIDC sends the user to the provider to sign in, or to link their
+// account there if userID is set. The provider sends them back to
+// OIDCCallback either way.
+func (u Users) startOIDC(w http.ResponseWriter, r *http.Request, provider *models.OAuthProvider, userID int, returnTo string) {
+	state, err := u.OAuthService.CreateState(userID, provider.Name, returnTo)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, oidcStateCookie(provider, state.State))
+	opts := append([]oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("redirect_uri", redirectURI(u.BaseURL, oidcCallbackPath(provider))),
+		oauth2.S256ChallengeOption(state.Verifier),
+		oauth2.SetAuthURLParam("nonce", state.Nonce),
+	}, provider.AuthOptions()...)
+	url := provider.Config.AuthCodeURL(state.State, opts...)
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// GET /signin/{provider}/callback
+func (u Users) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	provider, ok := u.signInProvider(w, r)
+	if !ok {
+		return
+	}
+	stateCookie, err := readCookie(r, CookieOIDCState)
+	if err != nil || subtle.ConstantTimeCompare([]byte(stateCookie), []byte(r.FormValue("state"))) != 1 {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	cookie := oidcStateCookie(provider, "")
+	cookie.MaxAge = -1
+	http.SetCookie(w, cookie)
+	state, err := u.OAuthService.ConsumeState(r.FormValue("state"), provider.Name)
+	if err != nil {
+		if !errors.Is(err, models.ErrNotFound) {
+			fmt.Println(err)
+		}
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	user := context.User(r.Context())
+	if state.UserID != 0 && (user == nil || user.ID != state.UserID) {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	// The user declined, or the provider refused to sign them in.
+	if r.FormValue("error") != "" {
+		if state.UserID == 0 {
+			http.Redirect(w, r, "/signin", http.StatusFound)
+		} else {
+			http.Redirect(w, r, state.ReturnTo, http.StatusFound)
+		}
+		return
+	}
+
+	token, err := provider.Config.Exchange(
+		r.Context(),
+		r.FormValue("code"),
+		oauth2.SetAuthURLParam("redirect_uri", redirectURI(u.BaseURL, oidcCallbackPath(provider))),
+		oauth2.VerifierOption(state.Verifier),
+	)
+	var claims *models.IDClaims
+	if err == nil {
+		rawIDToken, _ := token.Extra("id_token").(string)
+		claims, err = provider.OIDC.Verify(r.Context(), rawIDToken, state.Nonce)
+	}
+	if err != nil {
+		fmt.Println(err)
+		err = errors.Public(err, fmt.Sprintf("%v could not confirm who you are. Please try again.", provider.Title))
+		if state.UserID == 0 {
+			u.renderSignIn(w, r, "", err)
+		} else {
+			u.renderAccount(w, r, err)
+		}
+		return
+	}
+
+	if state.UserID != 0 {
+		_, err = u.IdentityService.Link(state.UserID, provider.Name, claims)
+		if err != nil {
+			if errors.Is(err, models.ErrIdentityTaken) {
+				u.renderAccount(w, r, errors.Public(err, fmt.Sprintf("That %v account is linked to another user, or you have linked another one already.", provider.Title)))
+				return
+			}
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, state.ReturnTo, http.StatusFound)
+		return
+	}
+
+	signedIn, err := u.IdentityService.SignIn(provider.Name, claims)
+	if err != nil {
+		var validationErr models.ValidationError
+		switch {
+		case errors.As(err, &validationErr):
+			u.renderSignIn(w, r, claims.Email, errors.Public(err, fmt.Sprintf("Unable to sign in with %v: %v.", provider.Title, validationErr.Issue)))
+		case errors.Is(err, models.ErrIdentityTaken):
+			u.renderSignIn(w, r, claims.Email, errors.Public(err, fmt.Sprintf("Another %v account is linked to %v. Sign in with that one instead.", provider.Title, claims.Email)))
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+	session, err := u.SessionService.Create(signedIn.ID, clientIP(r), r.UserAgent())
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	setCookie(w, CookieSession, session.Token)
+	http.Redirect(w, r, state.ReturnTo, http.StatusFound)
+}
+
+// POST /users/me/identities/{provider}/delete
+//
+// Providers that are no longer configured can still be unlinked.
+func (u Users) UnlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	err := u.IdentityService.Unlink(user.ID, chi.URLParam(r, "provider"))
+	if err != nil {
+		var validationErr models.ValidationError
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			http.Error(w, "Account not found", http.StatusNotFound)
+		case errors.As(err, &validationErr):
+			u.renderAccount(w, r, errors.Public(err, fmt.Sprintf("Unable to unlink the account: %v.", validationErr.Issue)))
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+	http.Redirect(w, r, "/users/me", http.StatusFound)
+}
+
+func (u Users) renderSignIn(w http.ResponseWriter, r *http.Request, email string, errs ...error) {
+	var data struct {
+		Email     string
+		Providers []*models.OAuthProvider
+	}
+	data.Email = email
+	data.Providers = u.Providers.SignIn()
+	u.Templates.SignIn.Execute(w, r, data, errs...)
+}
+
+func (u Users) renderAccount(w http.ResponseWriter, r *http.Request, errs ...error) {
+	type Identity struct {
+		Provider string
+		Title    string
+		Linked   bool
+		Email    string
+		// LinkURL is empty if the provider is no longer configured.
+		LinkURL string
+	}
+	var data struct {
+		Email string
+		// HasPassword is false for users who signed up with a provider.
+		HasPassword bool
+		Identities  []Identity
+	}
+	user := context.User(r.Context())
+	data.Email = user.Email
+	data.HasPassword = user.PasswordHash != ""
+	linked, err := u.IdentityService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	byProvider := make(map[string]models.Identity)
+	for _, identity := range linked {
+		byProvider[identity.Provider] = identity
+	}
+	for _, provider := range u.Providers.SignIn() {
+		identity, ok := byProvider[provider.Name]
+		delete(byProvider, provider.Name)
+		data.Identities = append(data.Identities, Identity{
+			Provider: provider.Name,
+			Title:    provider.Title,
+			Linked:   ok,
+			Email:    identity.Email,
+			LinkURL:  fmt.Sprintf("/users/me/identities/%s/link", provider.Name),
+		})
+	}
+	for _, identity := range linked {
+		if _, ok := byProvider[identity.Provider]; ok {
+			data.Identities = append(data.Identities, Identity{
+				Provider: identity.Provider,
+				Title:    identity.Provider,
+				Linked:   true,
+				Email:    identity.Email,
+			})
+		}
+	}
+	u.Templates.Account.Execute(w, r, data, errs...)
+}
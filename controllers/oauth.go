@@ -1,112 +1,147 @@
 package controllers
 
 import (
-	"bytes"
-	"encoding/json"
+	"Gallery/context"
+	"Gallery/errors"
+	"Gallery/models"
 	"fmt"
-	"io"
 	"net/http"
 	"strings"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/gorilla/csrf"
 	"golang.org/x/oauth2"
 )
 
 type OAuth struct {
-	ProviderConfigs map[string]*oauth2.Config
+	Providers    models.Providers
+	OAuthService *models.OAuthService
+	// BaseURL is where users reach the site, eg "https://gallery.example.com".
+	BaseURL string
+}
+
+// provider looks up the provider named in the URL. Providers users sign in
+// with are linked from the account page instead, see Users.LinkIdentity.
+func (oa OAuth) provider(w http.ResponseWriter, r *http.Request) (*models.OAuthProvider, bool) {
+	name := strings.ToLower(chi.URLParam(r, "provider"))
+	provider, ok := oa.Providers[name]
+	if !ok || provider.OIDC != nil {
+		http.Error(w, "Invalid OAuth2 Service", http.StatusBadRequest)
+		return nil, false
+	}
+	return provider, true
 }
 
 // GET /oauth/{provider}/connect
+//
+// The state sent to the provider is random and kept server side along with
+// the PKCE verifier, so a code can only be redeemed by the user who started
+// the authorization, once.
 func (oa OAuth) Connect(w http.ResponseWriter, r *http.Request) {
-	provider := chi.URLParam(r, "provider")
-	provider = strings.ToLower(provider)
-	config, ok := oa.ProviderConfigs[provider]
-
+	provider, ok := oa.provider(w, r)
 	if !ok {
-		http.Error(w, "Invalid OAuth2 Service", http.StatusBadRequest)
 		return
 	}
-
-	state := csrf.Token(r)
-	setCookie(w, "oauth_state", state)
-	url := config.AuthCodeURL(
-		state,
-		oauth2.SetAuthURLParam("redirect_url", redirectURI(r, provider)),
-	)
+	// Where to send the user once the account is connected, eg back to the
+	// gallery they were importing into.
+	returnTo := r.FormValue("return_to")
+	if !isLocalPath(returnTo) {
+		returnTo = ""
+	}
+	user := context.User(r.Context())
+	state, err := oa.OAuthService.CreateState(user.ID, provider.Name, returnTo)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	opts := append([]oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("redirect_uri", redirectURI(oa.BaseURL, "/oauth/"+provider.Name+"/callback")),
+		oauth2.S256ChallengeOption(state.Verifier),
+	}, provider.AuthOptions()...)
+	url := provider.Config.AuthCodeURL(state.State, opts...)
 	http.Redirect(w, r, url, http.StatusFound)
 }
 
-func redirectURI(r *http.Request, provider string) string {
-	if r.Host == "localhost:3000" {
-		return fmt.Sprintf("http://localhost:3000/oauth/%s/callback", provider)
-	}
-	return fmt.Sprintf("https://casts.lenslocked.com/oauth/%s/callback", provider)
+// isLocalPath reports whether path is an absolute path on this site, and so
+// safe to redirect to.
+func isLocalPath(path string) bool {
+	return strings.HasPrefix(path, "/") && !strings.HasPrefix(path, "//") && !strings.HasPrefix(path, "/\\")
+}
+
+// redirectURI is the absolute URL of the callback at path that a provider
+// sends the user back to. It is built from the configured base URL rather
+// than the request, as it has to match a redirect URI registered with the
+// provider.
+func redirectURI(baseURL, path string) string {
+	return baseURL + path
 }
 
+// GET /oauth/{provider}/callback
 func (oa OAuth) Callback(w http.ResponseWriter, r *http.Request) {
-	provider := chi.URLParam(r, "provider")
-	provider = strings.ToLower(provider)
-	config, ok := oa.ProviderConfigs[provider]
+	provider, ok := oa.provider(w, r)
 	if !ok {
-		http.Error(w, "Invalid OAuth2 Service", http.StatusBadRequest)
 		return
 	}
-
-	state := r.FormValue("state")
-	cookieState, err := readCookie(r, "oauth_state")
-	if err != nil || cookieState != state {
-		if err != nil {
+	user := context.User(r.Context())
+	state, err := oa.OAuthService.ConsumeState(r.FormValue("state"), provider.Name)
+	if err != nil {
+		if !errors.Is(err, models.ErrNotFound) {
 			fmt.Println(err)
 		}
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
-	deleteCookie(w, "oauth_state")
+	if state.UserID != user.ID {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	returnTo := state.ReturnTo
+	if returnTo == "" {
+		returnTo = "/galleries"
+	}
+	// The user declined, or the provider refused to authorize us.
+	if r.FormValue("error") != "" {
+		http.Redirect(w, r, returnTo, http.StatusFound)
+		return
+	}
 
-	code := r.FormValue("code")
-	token, err := config.Exchange(
+	token, err := provider.Config.Exchange(
 		r.Context(),
-		code,
+		r.FormValue("code"),
 		// Dropbox requires us to also set the redirect_uri here so it can verify the access code
-		oauth2.SetAuthURLParam("redirect_uri", redirectURI(r, provider)),
+		oauth2.SetAuthURLParam("redirect_uri", redirectURI(oa.BaseURL, "/oauth/"+provider.Name+"/callback")),
+		oauth2.VerifierOption(state.Verifier),
 	)
 	if err != nil {
+		fmt.Println(err)
 		http.Error(w, "Something went wrong", http.StatusBadRequest)
 		return
 	}
-
-	// Persist the user's oauth token so we can use it in the future...
-	// For now, we just print it out.
-
-	// w.Header().Set("Content-Type", "application/json")
-	// enc := json.NewEncoder(w)
-	// enc.SetIndent("", "  ")
-	// enc.Encode(token)
-
-	client := config.Client(r.Context(), token)
-	resp, err := client.Post(
-		"https://api.dropboxapi.com/2/files/list_folder",
-		"application/json",
-		strings.NewReader(`{"path": ""}`),
-	)
+	err = oa.OAuthService.Save(user.ID, provider.Name, token)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
-	defer resp.Body.Close()
+	http.Redirect(w, r, returnTo, http.StatusFound)
+}
 
-	unpretty, err := io.ReadAll(resp.Body)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+// POST /oauth/{provider}/disconnect
+func (oa OAuth) Disconnect(w http.ResponseWriter, r *http.Request) {
+	provider, ok := oa.provider(w, r)
+	if !ok {
 		return
 	}
-	var pretty bytes.Buffer
-	err = json.Indent(&pretty, unpretty, "", "  ")
+	user := context.User(r.Context())
+	err := oa.OAuthService.Delete(user.ID, provider.Name)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	pretty.WriteTo(w)
+	returnTo := r.FormValue("return_to")
+	if !isLocalPath(returnTo) {
+		returnTo = "/galleries"
+	}
+	http.Redirect(w, r, returnTo, http.StatusFound)
 }
@@ -0,0 +1,79 @@
+package controllers
+
+import (
+	"Gallery/models"
+	"net/http"
+	"net/url"
+)
+
+// pageLinks are the links shown around a paginated listing.
+type pageLinks struct {
+	PrevURL string
+	NextURL string
+	Sorts   []sortLink
+}
+
+type sortLink struct {
+	Label   string
+	URL     string
+	Current bool
+}
+
+var sortLabels = map[string]string{
+	"title":    "Title",
+	"newest":   "Newest",
+	"oldest":   "Oldest",
+	"custom":   "Custom order",
+	"filename": "Filename",
+	"taken":    "Date taken",
+}
+
+// listOptions reads the sort order and cursor of a listing from the query
+// string.
+func listOptions(r *http.Request) models.ListOptions {
+	return models.ListOptions{
+		Sort:   r.URL.Query().Get("sort"),
+		Cursor: r.URL.Query().Get("cursor"),
+	}
+}
+
+// newPageLinks builds the links of a listing at path. keep are the query
+// parameters, such as a tag filter, that the links carry over.
+func newPageLinks(path string, keep url.Values, page models.Page, sorts []string) pageLinks {
+	link := func(sort, cursor string) string {
+		query := url.Values{}
+		for key, values := range keep {
+			for _, value := range values {
+				if value != "" {
+					query.Add(key, value)
+				}
+			}
+		}
+		// The default sort order is left out to keep URLs short.
+		if sort != sorts[0] {
+			query.Set("sort", sort)
+		}
+		if cursor != "" {
+			query.Set("cursor", cursor)
+		}
+		if len(query) == 0 {
+			return path
+		}
+		return path + "?" + query.Encode()
+	}
+	var links pageLinks
+	if page.Prev != "" {
+		links.PrevURL = link(page.Sort, page.Prev)
+	}
+	if page.Next != "" {
+		links.NextURL = link(page.Sort, page.Next)
+	}
+	for _, sort := range sorts {
+		links.Sorts = append(links.Sorts, sortLink{
+			Label:   sortLabels[sort],
+			URL:     link(sort, ""),
+			Current: sort == page.Sort,
+		})
+	}
+	return links
+}
@@ -0,0 +1,275 @@
+package controllers
+
+import (
+	"Gallery/context"
+	"Gallery/errors"
+	"Gallery/models"
+	"Gallery/rand"
+	"encoding/csv"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// proofingTokenBytes is the size of the random viewer token kept in the
+// proofing cookie.
+const proofingTokenBytes = 32
+
+// viewerToken returns the token that identifies the viewer's selections. If
+// the viewer has none yet and create is true, a new one is set in the
+// proofing cookie; otherwise "" is returned.
+func viewerToken(w http.ResponseWriter, r *http.Request, create bool) (string, error) {
+	token, err := readCookie(r, CookieProofing)
+	if err == nil && token != "" {
+		return token, nil
+	}
+	if !create {
+		return "", nil
+	}
+	token, err = rand.String(proofingTokenBytes)
+	if err != nil {
+		return "", err
+	}
+	cookie := newCookie(CookieProofing, token)
+	// Keep the selection across browser restarts, as clients often take a
+	// few days to choose.
+	cookie.MaxAge = 365 * 24 * 60 * 60
+	http.SetCookie(w, cookie)
+	return token, nil
+}
+
+// userMustAllowProofing rejects favourites on galleries that are not in
+// proofing mode.
+func userMustAllowProofing(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
+	if !gallery.Proofing {
+		http.Error(w, "This gallery does not take selections", http.StatusNotFound)
+		return fmt.Errorf("gallery is not in proofing mode")
+	}
+	return nil
+}
+
+// POST /galleries/{id}/favourites
+func (g Galleries) ToggleFavourite(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userCanViewGallery, userMustAllowProofing)
+	if err != nil {
+		return
+	}
+	imageID, err := strconv.Atoi(r.FormValue("image_id"))
+	if err != nil {
+		http.Error(w, "Invalid image", http.StatusBadRequest)
+		return
+	}
+	token, err := viewerToken(w, r, true)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	var userID int
+	if user := context.User(r.Context()); user != nil {
+		userID = user.ID
+	}
+	_, err = g.SelectionService.Toggle(gallery.ID, imageID, token, userID)
+	if err != nil {
+		var validationErr models.ValidationError
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			http.Error(w, "Image not found", http.StatusNotFound)
+		case errors.As(err, &validationErr):
+			g.renderShow(w, r, gallery, errors.Public(err, fmt.Sprintf("Unable to change your favourites: %v.", validationErr.Issue)))
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+	http.Redirect(w, r, galleryPageURL(gallery, r.FormValue("share"), fmt.Sprintf("image-%d", imageID)), http.StatusFound)
+}
+
+// POST /galleries/{id}/selection
+func (g Galleries) SubmitSelection(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userCanViewGallery, userMustAllowProofing)
+	if err != nil {
+		return
+	}
+	token, err := viewerToken(w, r, false)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	selection, err := g.SelectionService.ByViewer(gallery.ID, token)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			g.renderShow(w, r, gallery, errors.Public(err, "Pick at least one favourite before submitting your selection."))
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	err = g.SelectionService.Submit(selection, r.FormValue("name"), r.FormValue("note"))
+	if err != nil {
+		var validationErr models.ValidationError
+		if errors.As(err, &validationErr) {
+			g.renderShow(w, r, gallery, errors.Public(err, fmt.Sprintf("Unable to submit your selection: %v.", validationErr.Issue)))
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, galleryPageURL(gallery, r.FormValue("share"), "selection"), http.StatusFound)
+}
+
+// GET /galleries/{id}/selections
+func (g Galleries) Selections(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userCan(models.PermissionManage))
+	if err != nil {
+		return
+	}
+	g.renderSelections(w, r, gallery)
+}
+
+func (g Galleries) renderSelections(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, errs ...error) {
+	var data struct {
+		ID         int
+		Title      string
+		Proofing   bool
+		Selections []models.Selection
+	}
+	data.ID = gallery.ID
+	data.Title = gallery.Title
+	data.Proofing = gallery.Proofing
+	var err error
+	data.Selections, err = g.SelectionService.Submitted(gallery.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	g.Templates.Selections.Execute(w, r, data, errs...)
+}
+
+// GET /galleries/{id}/selections/{selectionID}/export?format=csv|txt
+func (g Galleries) ExportSelection(w http.ResponseWriter, r *http.Request) {
+	gallery, selection, err := g.selectionByID(w, r)
+	if err != nil {
+		return
+	}
+	images, err := g.SelectionService.Images(selection.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	format := r.FormValue("format")
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+			"filename": selectionFilename(gallery, selection) + ".csv",
+		}))
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"filename", "caption", "tags"})
+		for _, image := range images {
+			cw.Write([]string{image.Filename, image.Caption, strings.Join(image.Tags, ", ")})
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			fmt.Println(err)
+		}
+	case "txt":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+			"filename": selectionFilename(gallery, selection) + ".txt",
+		}))
+		for _, image := range images {
+			fmt.Fprintln(w, image.Filename)
+		}
+	default:
+		http.Error(w, "Invalid format", http.StatusBadRequest)
+	}
+}
+
+// POST /galleries/{id}/selections/{selectionID}/copy
+func (g Galleries) CopySelection(w http.ResponseWriter, r *http.Request) {
+	gallery, selection, err := g.selectionByID(w, r)
+	if err != nil {
+		return
+	}
+	images, err := g.SelectionService.Images(selection.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	user := context.User(r.Context())
+	title := fmt.Sprintf("%s - %s's selection", gallery.Title, selection.Name)
+	copied, skipped, err := g.GalleryService.CopyImages(user.ID, title, images)
+	if err != nil {
+		var quotaErr models.QuotaError
+		if errors.As(err, &quotaErr) {
+			g.renderSelections(w, r, gallery, errors.Public(err, fmt.Sprintf("Unable to copy the selection: %v.", quotaErr.Issue)))
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if len(skipped) > 0 {
+		var names []string
+		for _, image := range skipped {
+			names = append(names, image.Filename)
+		}
+		err = fmt.Errorf("copy selection: %d images skipped", len(skipped))
+		g.renderEdit(w, r, copied, errors.Public(err, fmt.Sprintf(
+			"These images were deleted, or uploaded before images could be shared between galleries, and were not copied: %s.",
+			strings.Join(names, ", "))))
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/galleries/%d/edit", copied.ID), http.StatusFound)
+}
+
+// selectionByID looks up a submitted selection of a gallery the user
+// manages.
+func (g Galleries) selectionByID(w http.ResponseWriter, r *http.Request) (*models.Gallery, *models.Selection, error) {
+	gallery, err := g.galleryByID(w, r, g.userCan(models.PermissionManage))
+	if err != nil {
+		return nil, nil, err
+	}
+	selectionID, err := strconv.Atoi(chi.URLParam(r, "selectionID"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return nil, nil, err
+	}
+	selection, err := g.SelectionService.ByID(selectionID)
+	if err == nil && (selection.GalleryID != gallery.ID || !selection.Submitted()) {
+		err = models.ErrNotFound
+	}
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Selection not found", http.StatusNotFound)
+			return nil, nil, err
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return nil, nil, err
+	}
+	return gallery, selection, nil
+}
+
+// selectionFilename names exported selections after the gallery and the
+// viewer, without an extension.
+func selectionFilename(gallery *models.Gallery, selection *models.Selection) string {
+	return strings.TrimSuffix(zipFilename(gallery), ".zip") + " - " + strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r < ' ' {
+			return '_'
+		}
+		return r
+	}, selection.Name)
+}
@@ -0,0 +1,97 @@
+package controllers
+
+import (
+	"Gallery/context"
+	"Gallery/models"
+	"fmt"
+	"html"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const searchPageSize = 20
+
+// GET /search?q=...&page=N
+func (g Galleries) Search(w http.ResponseWriter, r *http.Request) {
+	type Result struct {
+		Kind         models.SearchResultKind
+		GalleryID    int
+		GalleryTitle string
+		Filename     string
+		URL          string
+		ThumbURL     string
+		Headline     template.HTML
+	}
+	var data struct {
+		Query    string
+		Page     int
+		PrevURL  string
+		NextURL  string
+		Searched bool
+		Results  []Result
+	}
+	data.Query = strings.TrimSpace(r.FormValue("q"))
+	data.Page = 1
+	if page, err := strconv.Atoi(r.FormValue("page")); err == nil && page > 1 {
+		data.Page = page
+	}
+	if data.Query == "" {
+		g.Templates.Search.Execute(w, r, data)
+		return
+	}
+	data.Searched = true
+
+	var userID int
+	if user := context.User(r.Context()); user != nil {
+		userID = user.ID
+	}
+	// One extra result is fetched to find out whether there is a next page.
+	offset := (data.Page - 1) * searchPageSize
+	results, err := g.GalleryService.Search(userID, data.Query, offset, searchPageSize+1)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if len(results) > searchPageSize {
+		results = results[:searchPageSize]
+		data.NextURL = searchURL(data.Query, data.Page+1)
+	}
+	if data.Page > 1 {
+		data.PrevURL = searchURL(data.Query, data.Page-1)
+	}
+	for _, result := range results {
+		item := Result{
+			Kind:         result.Kind,
+			GalleryID:    result.GalleryID,
+			GalleryTitle: result.GalleryTitle,
+			Filename:     result.Filename,
+			URL:          fmt.Sprintf("/galleries/%d", result.GalleryID),
+			Headline:     highlight(result.Headline),
+		}
+		if result.Kind == models.SearchResultImage {
+			imageURL := fmt.Sprintf("/galleries/%d/images/%s", result.GalleryID, url.PathEscape(result.Filename))
+			item.URL = imageURL + "?size=large"
+			item.ThumbURL = imageURL + "?size=thumb"
+		}
+		data.Results = append(data.Results, item)
+	}
+	g.Templates.Search.Execute(w, r, data)
+}
+
+func searchURL(query string, page int) string {
+	return fmt.Sprintf("/search?q=%s&page=%d", url.QueryEscape(query), page)
+}
+
+// highlight escapes a search headline and marks up the matched words.
+func highlight(headline string) template.HTML {
+	escaped := html.EscapeString(headline)
+	escaped = strings.NewReplacer(
+		models.HighlightStart, "<mark>",
+		models.HighlightEnd, "</mark>",
+	).Replace(escaped)
+	return template.HTML(escaped)
+}
@@ -0,0 +1,110 @@
+package controllers
+
+import (
+	"Gallery/context"
+	"Gallery/errors"
+	"Gallery/models"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// clientIP is the address the request came from, as recorded for sessions.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// GET /users/me/sessions
+func (u Users) Sessions(w http.ResponseWriter, r *http.Request) {
+	type Session struct {
+		ID         int
+		Current    bool
+		Device     string
+		IPAddress  string
+		CreatedAt  string
+		LastSeenAt string
+	}
+	var data struct {
+		Sessions []Session
+	}
+	token, err := readCookie(r, CookieSession)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	sessions, err := u.SessionService.Sessions(token)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, session := range sessions {
+		device := session.UserAgent
+		if device == "" {
+			device = "Unknown device"
+		}
+		data.Sessions = append(data.Sessions, Session{
+			ID:         session.ID,
+			Current:    session.Current,
+			Device:     device,
+			IPAddress:  session.IPAddress,
+			CreatedAt:  session.CreatedAt.Format(time.DateTime),
+			LastSeenAt: session.LastSeenAt.Format(time.DateTime),
+		})
+	}
+	u.Templates.Sessions.Execute(w, r, data)
+}
+
+// POST /users/me/sessions/{sessionID}/delete
+func (u Users) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	sessionID, err := strconv.Atoi(chi.URLParam(r, "sessionID"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+	token, err := readCookie(r, CookieSession)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	current, err := u.SessionService.DeleteByID(token, sessionID)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	// Revoking the session in use is the same as signing out.
+	if current {
+		deleteCookie(w, CookieSession)
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/users/me/sessions", http.StatusFound)
+}
+
+// POST /users/me/sessions/delete
+//
+// Signs the user out everywhere, including here.
+func (u Users) RevokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	err := u.SessionService.DeleteAll(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	deleteCookie(w, CookieSession)
+	http.Redirect(w, r, "/signin", http.StatusFound)
+}
@@ -0,0 +1,141 @@
+package controllers
+
+import (
+	"Gallery/context"
+	"Gallery/errors"
+	"Gallery/models"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// GET /trash
+func (g Galleries) Trash(w http.ResponseWriter, r *http.Request) {
+	g.renderTrash(w, r)
+}
+
+func (g Galleries) renderTrash(w http.ResponseWriter, r *http.Request, errs ...error) {
+	type Gallery struct {
+		ID        int
+		Title     string
+		DeletedAt string
+		PurgeAt   string
+	}
+	type Image struct {
+		ID           int
+		Filename     string
+		GalleryTitle string
+		DeletedAt    string
+		PurgeAt      string
+	}
+	var data struct {
+		Galleries []Gallery
+		Images    []Image
+	}
+
+	user := context.User(r.Context())
+	galleries, err := g.GalleryService.TrashedGalleries(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	images, err := g.GalleryService.TrashedImages(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	// Trashed images always belong to one of the user's live galleries.
+	liveGalleries, err := g.GalleryService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	titles := make(map[int]string)
+	for _, gallery := range liveGalleries {
+		titles[gallery.ID] = gallery.Title
+	}
+
+	for _, gallery := range galleries {
+		data.Galleries = append(data.Galleries, Gallery{
+			ID:        gallery.ID,
+			Title:     gallery.Title,
+			DeletedAt: formatDate(gallery.DeletedAt),
+			PurgeAt:   formatDate(gallery.DeletedAt.Add(g.trashRetention())),
+		})
+	}
+	for _, image := range images {
+		data.Images = append(data.Images, Image{
+			ID:           image.ID,
+			Filename:     image.Filename,
+			GalleryTitle: titles[image.GalleryID],
+			DeletedAt:    formatDate(image.DeletedAt),
+			PurgeAt:      formatDate(image.DeletedAt.Add(g.trashRetention())),
+		})
+	}
+	g.Templates.Trash.Execute(w, r, data, errs...)
+}
+
+// POST /trash/galleries/{id}/restore
+func (g Galleries) RestoreGallery(w http.ResponseWriter, r *http.Request) {
+	g.trashAction(w, r, g.GalleryService.RestoreGallery)
+}
+
+// POST /trash/galleries/{id}/delete
+func (g Galleries) PurgeGallery(w http.ResponseWriter, r *http.Request) {
+	g.trashAction(w, r, g.GalleryService.PurgeGallery)
+}
+
+// POST /trash/images/{id}/restore
+func (g Galleries) RestoreImage(w http.ResponseWriter, r *http.Request) {
+	g.trashAction(w, r, g.GalleryService.RestoreImage)
+}
+
+// POST /trash/images/{id}/delete
+func (g Galleries) PurgeImage(w http.ResponseWriter, r *http.Request) {
+	g.trashAction(w, r, g.GalleryService.PurgeImage)
+}
+
+// trashAction applies action to the item in the URL on behalf of the current
+// user and returns to the trash. The services only act on the user's own
+// items, reporting anything else as not found.
+func (g Galleries) trashAction(w http.ResponseWriter, r *http.Request, action func(userID, id int) error) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+	user := context.User(r.Context())
+	err = action(user.ID, id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Not found in the trash", http.StatusNotFound)
+			return
+		}
+		var quotaErr models.QuotaError
+		if errors.As(err, &quotaErr) {
+			g.renderTrash(w, r, errors.Public(err, fmt.Sprintf("Unable to restore: %v.", quotaErr.Issue)))
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/trash", http.StatusFound)
+}
+
+func (g Galleries) trashRetention() time.Duration {
+	if g.TrashRetention > 0 {
+		return g.TrashRetention
+	}
+	return models.DefaultTrashRetention
+}
+
+func formatDate(t time.Time) string {
+	return t.Format("Jan 2, 2006")
+}
@@ -0,0 +1,208 @@
+package controllers
+
+import (
+	"Gallery/context"
+	"Gallery/errors"
+	"Gallery/models"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Resumable uploads send a file in chunks so that an interrupted upload can
+// carry on from the last chunk the server received instead of restarting.
+// The protocol is a small subset of tus (https://tus.io):
+//
+//	POST   /galleries/{id}/uploads            Upload-Length, Upload-Filename
+//	HEAD   /galleries/{id}/uploads/{uploadID} returns Upload-Offset
+//	PATCH  /galleries/{id}/uploads/{uploadID} Upload-Offset, chunk as body
+//	DELETE /galleries/{id}/uploads/{uploadID} cancels the upload
+//
+// The PATCH that completes the upload responds with the uploadResult for the
+// file. A PATCH with an empty body at the final offset retries creating the
+// image if that failed.
+
+const uploadChunkContentType = "application/offset+octet-stream"
+
+// DefaultMaxFormUpload is the default limit of LimitFormUploads.
+const DefaultMaxFormUpload = 256 << 20
+
+// LimitFormUploads caps the size of multipart forms that do not send their
+// CSRF token in the X-CSRF-Token header, and must run before the CSRF
+// middleware. Only the upload page's script sends the header. Without it the
+// middleware reads the token from the form, which makes net/http buffer the
+// whole body, files and all, before the handler can stream it; forms
+// submitted without JavaScript therefore upload through a temporary file
+// and are limited to maxBytes.
+func LimitFormUploads(maxBytes int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			multipart := strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data")
+			if multipart && r.Header.Get("X-CSRF-Token") == "" {
+				if r.ContentLength > maxBytes {
+					http.Error(w, fmt.Sprintf("Uploads without JavaScript are limited to %d MB at a time. Please upload fewer files at once.", maxBytes>>20), http.StatusRequestEntityTooLarge)
+					return
+				}
+				r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// POST /galleries/{id}/uploads
+func (g Galleries) CreateUpload(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userCan(models.PermissionUpload))
+	if err != nil {
+		return
+	}
+	size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	filename, err := url.PathUnescape(r.Header.Get("Upload-Filename"))
+	if err != nil || filename == "" {
+		http.Error(w, "Invalid Upload-Filename", http.StatusBadRequest)
+		return
+	}
+	user := context.User(r.Context())
+	upload, err := g.UploadService.Create(gallery.ID, user.ID, filename, size)
+	if err != nil {
+		writeJSON(w, uploadErrorStatus(err), newUploadResult(filename, nil, err))
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/galleries/%d/uploads/%s", gallery.ID, upload.ID))
+	w.Header().Set("Upload-Offset", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// HEAD /galleries/{id}/uploads/{uploadID}
+func (g Galleries) UploadOffset(w http.ResponseWriter, r *http.Request) {
+	upload, err := g.uploadByID(w, r)
+	if err != nil {
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Size, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+// PATCH /galleries/{id}/uploads/{uploadID}
+func (g Galleries) UploadChunk(w http.ResponseWriter, r *http.Request) {
+	upload, err := g.uploadByID(w, r)
+	if err != nil {
+		return
+	}
+	if r.Header.Get("Content-Type") != uploadChunkContentType {
+		http.Error(w, "Content-Type must be "+uploadChunkContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	if r.ContentLength < 0 {
+		http.Error(w, "Content-Length is required", http.StatusLengthRequired)
+		return
+	}
+	if r.ContentLength > models.MaxUploadChunk {
+		http.Error(w, "Chunk is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	body := http.MaxBytesReader(w, r.Body, models.MaxUploadChunk)
+	err = g.UploadService.WriteChunk(upload, offset, body, r.ContentLength)
+	if err != nil {
+		var fileErr models.FileError
+		switch {
+		case errors.Is(err, models.ErrUploadOffset):
+			w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+			http.Error(w, "Upload-Offset does not match", http.StatusConflict)
+		case errors.Is(err, models.ErrNotFound):
+			http.Error(w, "Upload not found", http.StatusNotFound)
+		case errors.As(err, &fileErr):
+			http.Error(w, fileErr.Issue, http.StatusBadRequest)
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	if !upload.Complete() {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	image, err := g.UploadService.Finish(upload)
+	result := newUploadResult(upload.Filename, image, err)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Upload not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, uploadErrorStatus(err), result)
+		return
+	}
+	writeJSON(w, http.StatusCreated, result)
+}
+
+// DELETE /galleries/{id}/uploads/{uploadID}
+func (g Galleries) CancelUpload(w http.ResponseWriter, r *http.Request) {
+	upload, err := g.uploadByID(w, r)
+	if err != nil {
+		return
+	}
+	err = g.UploadService.Delete(upload)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// uploadErrorStatus is the status code used when a file cannot be uploaded.
+// Only server errors are worth retrying.
+func uploadErrorStatus(err error) int {
+	var fileErr models.FileError
+	var quotaErr models.QuotaError
+	switch {
+	case errors.As(err, &fileErr):
+		return http.StatusBadRequest
+	case errors.As(err, &quotaErr):
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// uploadByID looks up the upload in the URL, which must belong to both the
+// gallery in the URL and the current user.
+func (g Galleries) uploadByID(w http.ResponseWriter, r *http.Request) (*models.Upload, error) {
+	gallery, err := g.galleryByID(w, r, g.userCan(models.PermissionUpload))
+	if err != nil {
+		return nil, err
+	}
+	upload, err := g.UploadService.ByID(chi.URLParam(r, "uploadID"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Upload not found", http.StatusNotFound)
+			return nil, err
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return nil, err
+	}
+	user := context.User(r.Context())
+	if upload.GalleryID != gallery.ID || upload.UserID != user.ID {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return nil, fmt.Errorf("upload belongs to another gallery or user")
+	}
+	return upload, nil
+}
@@ -18,11 +18,20 @@ type Users struct {
 		ForgotPassword Template
 		CheckYourEmail Template
 		ResetPassword  Template
+		Account        Template
+		Sessions       Template
 	}
 	UserService          *models.UserService
 	SessionService       *models.SessionService
 	PasswordResetService *models.PasswordResetService
 	EmailService         *models.EmailService
+	OAuthService         *models.OAuthService
+	IdentityService      *models.IdentityService
+	// Providers are the configured OAuth providers. Users can sign in with
+	// those that support OpenID Connect.
+	Providers models.Providers
+	// BaseURL is where users reach the site, eg "https://gallery.example.com".
+	BaseURL string
 }
 
 func (u Users) New(w http.ResponseWriter, r *http.Request) {
@@ -34,11 +43,7 @@ func (u Users) New(w http.ResponseWriter, r *http.Request) {
 }
 
 func (u Users) SignIn(w http.ResponseWriter, r *http.Request) {
-	var data struct {
-		Email string
-	}
-	data.Email = r.FormValue("email")
-	u.Templates.SignIn.Execute(w, r, data)
+	u.renderSignIn(w, r, r.FormValue("email"))
 }
 
 func (u Users) Create(w http.ResponseWriter, r *http.Request) {
@@ -59,7 +64,7 @@ func (u Users) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	session, err := u.SessionService.Create(user.ID) // 为这个用户创建会话
+	session, err := u.SessionService.Create(user.ID, clientIP(r), r.UserAgent()) // 为这个用户创建会话
 	if err != nil {
 		fmt.Println(err)
 		http.Redirect(w, r, "/signin", http.StatusFound) // 重定向的目的是为了防止用户困惑是否注册成功
@@ -98,7 +103,7 @@ func (u Users) ProcessSignIn(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	session, err := u.SessionService.Create(user.ID) // 登陆进入创建Session
+	session, err := u.SessionService.Create(user.ID, clientIP(r), r.UserAgent()) // 登陆进入创建Session
 	if err != nil {
 		fmt.Println(err)
 		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
@@ -127,13 +132,12 @@ func (u Users) ProcessSignIn(w http.ResponseWriter, r *http.Request) {
 // }
 
 func (u Users) CurrentUser(w http.ResponseWriter, r *http.Request) {
-	user := context.User(r.Context())
 	// 使用RequireUser去重定向了
 	// if user == nil {
 	// 	http.Redirect(w, r, "/signin", http.StatusFound)
 	// 	return
 	// }
-	fmt.Fprintf(w, "Current user: %s\n", user.Email)
+	u.renderAccount(w, r)
 }
 
 // 中间件,自己测试用
@@ -314,10 +318,17 @@ func (u Users) ProcessResetPassword(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
 		return
 	}
+	// Whoever knew the old password may still be signed in somewhere.
+	err = u.SessionService.DeleteAll(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
 
 	// Sign the user in now that they have reset their password.
 	// Any errors from this point onward should redirect to the sign in page.
-	session, err := u.SessionService.Create(user.ID)
+	session, err := u.SessionService.Create(user.ID, clientIP(r), r.UserAgent())
 	if err != nil {
 		fmt.Println(err)
 		http.Redirect(w, r, "/signin", http.StatusFound)
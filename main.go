@@ -6,15 +6,18 @@ import (
 	"Gallery/models"
 	"Gallery/templates"
 	"Gallery/views"
+	"encoding/hex"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/gorilla/csrf"
 	"github.com/joho/godotenv"
-	"golang.org/x/oauth2"
 )
 
 type config struct {
@@ -26,8 +29,38 @@ type config struct {
 	}
 	Server struct {
 		Address string
+		// BaseURL is where users reach the server, which OAuth providers
+		// send them back to.
+		BaseURL string
+	}
+	// OAuthProviders are the providers users can connect their accounts at.
+	OAuthProviders []models.ProviderConfig
+	// OAuthTokenKey encrypts the stored OAuth tokens.
+	OAuthTokenKey []byte
+	// Quota holds the default limits for every user. Zero means unlimited.
+	Quota models.Quota
+	// TrashRetention is how long deleted items stay in the trash.
+	TrashRetention time.Duration
+	// SyncInterval is how often galleries linked to a folder are synced.
+	SyncInterval time.Duration
+	// MaxFormUpload limits uploads from forms submitted without JavaScript.
+	MaxFormUpload int64
+	// SessionIdleTimeout and SessionMaxAge are how long users stay signed in
+	// without using the site, and at most.
+	SessionIdleTimeout time.Duration
+	SessionMaxAge      time.Duration
+	Storage            struct {
+		// Backend is either "disk" (the default) or "s3".
+		Backend   string
+		ImagesDir string
+		S3        struct {
+			Endpoint        string
+			Region          string
+			Bucket          string
+			AccessKeyID     string
+			SecretAccessKey string
+		}
 	}
-	OAuthProviders map[string]*oauth2.Config
 }
 
 func loadEnvConfig() (config, error) {
@@ -64,24 +97,155 @@ func loadEnvConfig() (config, error) {
 
 	// cfg.Server.Address = ":3000"
 	cfg.Server.Address = os.Getenv("SERVER_ADDRESS")
+	cfg.Server.BaseURL = strings.TrimSuffix(os.Getenv("SERVER_BASE_URL"), "/")
+	if cfg.Server.BaseURL == "" {
+		host := cfg.Server.Address
+		if strings.HasPrefix(host, ":") {
+			host = "localhost" + host
+		}
+		cfg.Server.BaseURL = "http://" + host
+	}
+	baseURL, err := url.Parse(cfg.Server.BaseURL)
+	if err != nil || (baseURL.Scheme != "http" && baseURL.Scheme != "https") || baseURL.Host == "" {
+		return cfg, fmt.Errorf("SERVER_BASE_URL: %q is not an http or https URL", cfg.Server.BaseURL)
+	}
+
+	cfg.Storage.Backend = os.Getenv("STORAGE_BACKEND")
+	cfg.Storage.ImagesDir = os.Getenv("IMAGES_DIR")
+	cfg.Storage.S3.Endpoint = os.Getenv("S3_ENDPOINT")
+	cfg.Storage.S3.Region = os.Getenv("S3_REGION")
+	cfg.Storage.S3.Bucket = os.Getenv("S3_BUCKET")
+	cfg.Storage.S3.AccessKeyID = os.Getenv("S3_ACCESS_KEY_ID")
+	cfg.Storage.S3.SecretAccessKey = os.Getenv("S3_SECRET_ACCESS_KEY")
+
+	cfg.Quota.MaxBytes, err = parseEnvInt("QUOTA_MAX_BYTES")
+	if err != nil {
+		return cfg, err
+	}
+	maxImages, err := parseEnvInt("QUOTA_MAX_IMAGES_PER_GALLERY")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Quota.MaxImagesPerGallery = int(maxImages)
+	maxGalleries, err := parseEnvInt("QUOTA_MAX_GALLERIES")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Quota.MaxGalleries = int(maxGalleries)
+	cfg.Quota.MaxFileSize, err = parseEnvInt("QUOTA_MAX_FILE_SIZE")
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.MaxFormUpload, err = parseEnvInt("MAX_FORM_UPLOAD_SIZE")
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.MaxFormUpload == 0 {
+		cfg.MaxFormUpload = controllers.DefaultMaxFormUpload
+	}
+
+	cfg.TrashRetention = models.DefaultTrashRetention
+	if retention := os.Getenv("TRASH_RETENTION"); retention != "" {
+		cfg.TrashRetention, err = time.ParseDuration(retention)
+		if err != nil {
+			return cfg, fmt.Errorf("TRASH_RETENTION: %w", err)
+		}
+	}
+
+	cfg.SyncInterval = models.DefaultSyncInterval
+	if interval := os.Getenv("SYNC_INTERVAL"); interval != "" {
+		cfg.SyncInterval, err = time.ParseDuration(interval)
+		if err != nil {
+			return cfg, fmt.Errorf("SYNC_INTERVAL: %w", err)
+		}
+	}
+
+	cfg.SessionIdleTimeout = models.DefaultSessionIdleTimeout
+	if timeout := os.Getenv("SESSION_IDLE_TIMEOUT"); timeout != "" {
+		cfg.SessionIdleTimeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			return cfg, fmt.Errorf("SESSION_IDLE_TIMEOUT: %w", err)
+		}
+	}
+	cfg.SessionMaxAge = models.DefaultSessionMaxAge
+	if maxAge := os.Getenv("SESSION_MAX_AGE"); maxAge != "" {
+		cfg.SessionMaxAge, err = time.ParseDuration(maxAge)
+		if err != nil {
+			return cfg, fmt.Errorf("SESSION_MAX_AGE: %w", err)
+		}
+	}
 
-	// cfg.OAuthProviders
-	cfg.OAuthProviders = make(map[string]*oauth2.Config)
-	dbxConfig := &oauth2.Config{
-		ClientID:     os.Getenv("DROPBOX_APP_ID"),
-		ClientSecret: os.Getenv("DROPBOX_APP_SECRECT"),
-		Scopes:       []string{"files.metadata.read", "files.content.read"}, // 类似请求的权限
-		Endpoint: oauth2.Endpoint{
-			AuthURL:  "https://www.dropbox.com/oauth2/authorize", // 用来获得认证，资源服务器的认证
-			TokenURL: "https://api.dropboxapi.com/oauth2/token",  // 用于获得访问的token，令牌端点URL
-		},
+	// OAUTH_PROVIDERS lists the providers by name, each configured by the
+	// OAUTH_<NAME>_* settings.
+	for _, name := range strings.Split(os.Getenv("OAUTH_PROVIDERS"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		provider, err := loadProviderConfig(name)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.OAuthProviders = append(cfg.OAuthProviders, provider)
 	}
 
-	cfg.OAuthProviders["dropbox"] = dbxConfig
+	// The key is 32 random bytes, hex encoded, eg from `openssl rand -hex 32`.
+	cfg.OAuthTokenKey, err = hex.DecodeString(os.Getenv("OAUTH_TOKEN_KEY"))
+	if err != nil {
+		return cfg, fmt.Errorf("OAUTH_TOKEN_KEY: %w", err)
+	}
+	if len(cfg.OAuthProviders) > 0 && len(cfg.OAuthTokenKey) != models.OAuthTokenKeyBytes {
+		return cfg, fmt.Errorf("OAUTH_TOKEN_KEY must be %d hex encoded bytes", models.OAuthTokenKeyBytes)
+	}
 
 	return cfg, nil
 }
 
+// loadProviderConfig reads the settings of the named OAuth provider. Only the
+// client ID and secret are required for a kind with defaults, eg dropbox, and
+// an oidc provider also needs its issuer.
+func loadProviderConfig(name string) (models.ProviderConfig, error) {
+	prefix := "OAUTH_" + strings.ToUpper(name) + "_"
+	provider := models.ProviderConfig{
+		Name:         name,
+		Kind:         os.Getenv(prefix + "KIND"),
+		Title:        os.Getenv(prefix + "TITLE"),
+		ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+		ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+		AuthURL:      os.Getenv(prefix + "AUTH_URL"),
+		TokenURL:     os.Getenv(prefix + "TOKEN_URL"),
+		APIURL:       os.Getenv(prefix + "API_URL"),
+		ContentURL:   os.Getenv(prefix + "CONTENT_URL"),
+		Issuer:       os.Getenv(prefix + "ISSUER"),
+		JWKSURL:      os.Getenv(prefix + "JWKS_URL"),
+	}
+	if scopes := os.Getenv(prefix + "SCOPES"); scopes != "" {
+		provider.Scopes = strings.Fields(scopes)
+	}
+	if params := os.Getenv(prefix + "AUTH_PARAMS"); params != "" {
+		var err error
+		provider.AuthParams, err = url.ParseQuery(params)
+		if err != nil {
+			return provider, fmt.Errorf("%vAUTH_PARAMS: %w", prefix, err)
+		}
+	}
+	return provider, nil
+}
+
+// parseEnvInt reads an optional integer setting, returning 0 if it is unset.
+func parseEnvInt(key string) (int64, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%v: %w", key, err)
+	}
+	return n, nil
+}
+
 func main() {
 	cfg, err := loadEnvConfig()
 	if err != nil {
@@ -111,16 +275,137 @@ func run(cfg config) error {
 		DB: db,
 	}
 	sessionService := &models.SessionService{
-		DB: db,
+		DB:          db,
+		IdleTimeout: cfg.SessionIdleTimeout,
+		MaxAge:      cfg.SessionMaxAge,
 	}
 	pwResetService := &models.PasswordResetService{
 		DB: db,
 	}
+	var imageStore models.ImageStore
+	switch cfg.Storage.Backend {
+	case "", "disk":
+		imagesDir := cfg.Storage.ImagesDir
+		if imagesDir == "" {
+			imagesDir = "images"
+		}
+		imageStore = &models.DiskStore{Dir: imagesDir}
+	case "s3":
+		imageStore = &models.S3Store{
+			Endpoint:        cfg.Storage.S3.Endpoint,
+			Region:          cfg.Storage.S3.Region,
+			Bucket:          cfg.Storage.S3.Bucket,
+			AccessKeyID:     cfg.Storage.S3.AccessKeyID,
+			SecretAccessKey: cfg.Storage.S3.SecretAccessKey,
+		}
+	default:
+		return fmt.Errorf("unknown storage backend %q", cfg.Storage.Backend)
+	}
+
+	quotaService := &models.QuotaService{
+		DB:       db,
+		Defaults: cfg.Quota,
+	}
 	galleryService := &models.GalleryService{
+		DB:     db,
+		Store:  imageStore,
+		Quotas: quotaService,
+	}
+	collectionService := &models.CollectionService{
 		DB: db,
 	}
+	commentService := &models.CommentService{
+		DB: db,
+	}
+	selectionService := &models.SelectionService{
+		DB:             db,
+		GalleryService: galleryService,
+	}
+	uploadService := &models.UploadService{
+		DB:             db,
+		GalleryService: galleryService,
+	}
+	oauthService := &models.OAuthService{
+		DB:  db,
+		Key: cfg.OAuthTokenKey,
+	}
+	identityService := &models.IdentityService{
+		DB: db,
+	}
+	providers := make(models.Providers)
+	for _, providerConfig := range cfg.OAuthProviders {
+		provider, err := models.NewOAuthProvider(providerConfig)
+		if err != nil {
+			return err
+		}
+		providers[provider.Name] = provider
+	}
+	syncService := &models.SyncService{
+		DB:             db,
+		OAuthService:   oauthService,
+		GalleryService: galleryService,
+		Providers:      providers,
+		Interval:       cfg.SyncInterval,
+	}
 	emailService := models.NewEmailService(cfg.SMTP)
 
+	// Move images stored before the images and blobs tables existed into
+	// blobs. Until they are, legacy rows are still served from their old
+	// location.
+	go func() {
+		err := galleryService.ImportLegacyImages()
+		if err != nil {
+			fmt.Println(err)
+		}
+	}()
+
+	// Remove resumable uploads that were abandoned part way, anything that
+	// has been in the trash for longer than the retention period, and expired
+	// sessions.
+	go func() {
+		for range time.Tick(time.Hour) {
+			err := uploadService.DeleteExpired()
+			if err != nil {
+				fmt.Println(err)
+			}
+			err = galleryService.PurgeTrash(cfg.TrashRetention)
+			if err != nil {
+				fmt.Println(err)
+			}
+			err = oauthService.DeleteExpiredStates()
+			if err != nil {
+				fmt.Println(err)
+			}
+			err = sessionService.DeleteExpired()
+			if err != nil {
+				fmt.Println(err)
+			}
+		}
+	}()
+	// Remove stored files queued for deletion by deleted images, galleries
+	// and uploads.
+	go func() {
+		for range time.Tick(time.Minute) {
+			err := galleryService.CleanupStorage()
+			if err != nil {
+				fmt.Println(err)
+			}
+		}
+	}()
+
+	// Import what changed in the folders galleries are linked to. Each
+	// gallery is only synced once its interval has passed.
+	if len(providers.WithFiles()) > 0 {
+		go func() {
+			for range time.Tick(time.Minute) {
+				err := syncService.SyncDue()
+				if err != nil {
+					fmt.Println(err)
+				}
+			}
+		}()
+	}
+
 	// set up middleware
 	umw := controllers.UserMiddleware{
 		SessionService: sessionService,
@@ -139,26 +424,55 @@ func run(cfg config) error {
 		SessionService:       sessionService,
 		PasswordResetService: pwResetService,
 		EmailService:         emailService,
+		OAuthService:         oauthService,
+		IdentityService:      identityService,
+		Providers:            providers,
+		BaseURL:              cfg.Server.BaseURL,
 	}
 	galleriesC := controllers.Galleries{
-		GalleryService: galleryService,
+		GalleryService:    galleryService,
+		UploadService:     uploadService,
+		QuotaService:      quotaService,
+		CollectionService: collectionService,
+		CommentService:    commentService,
+		SelectionService:  selectionService,
+		EmailService:      emailService,
+		OAuthService:      oauthService,
+		SyncService:       syncService,
+		Providers:         providers,
+		TrashRetention:    cfg.TrashRetention,
+	}
+	collectionsC := controllers.Collections{
+		CollectionService: collectionService,
+		GalleryService:    galleryService,
 	}
 	oauthC := controllers.OAuth{
-		ProviderConfigs: cfg.OAuthProviders,
+		Providers:    providers,
+		OAuthService: oauthService,
+		BaseURL:      cfg.Server.BaseURL,
 	}
 	galleriesC.Templates.New = views.Must(views.ParseFS(templates.FS, "galleries/new.gohtml", "tailwind.gohtml"))
 	galleriesC.Templates.Edit = views.Must(views.ParseFS(templates.FS, "galleries/edit.gohtml", "tailwind.gohtml"))
 	galleriesC.Templates.Index = views.Must(views.ParseFS(templates.FS, "galleries/index.gohtml", "tailwind.gohtml"))
 	galleriesC.Templates.Show = views.Must(views.ParseFS(templates.FS, "galleries/show.gohtml", "tailwind.gohtml"))
+	galleriesC.Templates.Trash = views.Must(views.ParseFS(templates.FS, "galleries/trash.gohtml", "tailwind.gohtml"))
+	galleriesC.Templates.Search = views.Must(views.ParseFS(templates.FS, "galleries/search.gohtml", "tailwind.gohtml"))
+	galleriesC.Templates.Selections = views.Must(views.ParseFS(templates.FS, "galleries/selections.gohtml", "tailwind.gohtml"))
+	galleriesC.Templates.Invitation = views.Must(views.ParseFS(templates.FS, "galleries/invitation.gohtml", "tailwind.gohtml"))
+	collectionsC.Templates.Show = views.Must(views.ParseFS(templates.FS, "collections/show.gohtml", "tailwind.gohtml"))
+	collectionsC.Templates.Edit = views.Must(views.ParseFS(templates.FS, "collections/edit.gohtml", "tailwind.gohtml"))
 	usersC.Templates.New = views.Must(views.ParseFS(templates.FS, "signup.gohtml", "tailwind.gohtml"))
 	usersC.Templates.SignIn = views.Must(views.ParseFS(templates.FS, "signin.gohtml", "tailwind.gohtml"))
 	usersC.Templates.ForgotPassword = views.Must(views.ParseFS(templates.FS, "forgot-pw.gohtml", "tailwind.gohtml"))
 	usersC.Templates.CheckYourEmail = views.Must(views.ParseFS(templates.FS, "check-your-email.gohtml", "tailwind.gohtml"))
 	usersC.Templates.ResetPassword = views.Must(views.ParseFS(templates.FS, "reset-pw.gohtml", "tailwind.gohtml"))
+	usersC.Templates.Account = views.Must(views.ParseFS(templates.FS, "account.gohtml", "tailwind.gohtml"))
+	usersC.Templates.Sessions = views.Must(views.ParseFS(templates.FS, "sessions.gohtml", "tailwind.gohtml"))
 	// Set up router and routes
 	// "/"表示所有路由的默认访问处理句柄
 	// r.Get("/", controllers.StaticHandler(views.Must(views.ParseFS(templates.FS, "home.gohtml", "layout-parts.gohtml"))))
 	r := chi.NewRouter()
+	r.Use(controllers.LimitFormUploads(cfg.MaxFormUpload))
 	r.Use(csrfMw) // 添加中间件
 	r.Use(umw.SetUser)
 
@@ -171,6 +485,8 @@ func run(cfg config) error {
 	r.Post("/signup", usersC.Create)
 	r.Get("/signin", usersC.SignIn)
 	r.Post("/signin", usersC.ProcessSignIn)
+	r.Get("/signin/{provider}", usersC.OIDCSignIn)
+	r.Get("/signin/{provider}/callback", usersC.OIDCCallback)
 	r.With(umw.RequireUser).Post("/signout", usersC.ProcessSignOut)
 	r.Get("/forgot-pw", usersC.ForgotPassword)
 	r.Post("/forgot-pw", usersC.ProcessForgotPassword)
@@ -180,12 +496,25 @@ func run(cfg config) error {
 	r.Route("/users/me", func(r chi.Router) {
 		r.Use(umw.RequireUser)
 		r.Get("/", usersC.CurrentUser)
+		r.Get("/identities/{provider}/link", usersC.LinkIdentity)
+		r.Post("/identities/{provider}/delete", usersC.UnlinkIdentity)
+		r.Get("/sessions", usersC.Sessions)
+		r.Post("/sessions/delete", usersC.RevokeAllSessions)
+		r.Post("/sessions/{sessionID}/delete", usersC.RevokeSession)
 	})
 	// r.Get("/users/me", controllers.MakeMiddleware(usersC.CurrentUser))
 
+	r.Get("/invitations/accept", galleriesC.Invitation)
+	r.With(umw.RequireUser).Post("/invitations/accept", galleriesC.AcceptInvitation)
+
+	r.Get("/search", galleriesC.Search)
 	r.Route("/galleries", func(r chi.Router) { // 定义一个路由前缀为/galleries的路由组
 		r.Get("/{id}", galleriesC.Show)
 		r.Get("/{id}/images/{filename}", galleriesC.Image)
+		r.Get("/{id}/download.zip", galleriesC.Download)
+		// Anonymous share link viewers can pick favourites too.
+		r.Post("/{id}/favourites", galleriesC.ToggleFavourite)
+		r.Post("/{id}/selection", galleriesC.SubmitSelection)
 		r.Group(func(r chi.Router) { // 定义另外一个路由组，便于使用中间件，不会改变路由的路径
 			r.Use(umw.RequireUser)
 			r.Get("/", galleriesC.Index)
@@ -194,11 +523,31 @@ func run(cfg config) error {
 			r.Get("/{id}/edit", galleriesC.Edit)
 			r.Post("/{id}", galleriesC.Update)
 			r.Post("/{id}/delete", galleriesC.Delete)
+			r.Post("/{id}/share", galleriesC.ResetShareLink)
+			r.Post("/{id}/move", galleriesC.Move)
+			r.Post("/{id}/collaborators", galleriesC.AddCollaborator)
+			r.Post("/{id}/collaborators/{collaboratorID}/delete", galleriesC.RemoveCollaborator)
+			r.Post("/{id}/comments", galleriesC.CreateComment)
+			r.Post("/{id}/comments/{commentID}/delete", galleriesC.DeleteComment)
+			r.Get("/{id}/selections", galleriesC.Selections)
+			r.Get("/{id}/selections/{selectionID}/export", galleriesC.ExportSelection)
+			r.Post("/{id}/selections/{selectionID}/copy", galleriesC.CopySelection)
 			// Make sure this is requires a user
 			r.Post("/{id}/images/{filename}/delete", galleriesC.DeleteImage)
 			r.Post("/{id}/images", galleriesC.UploadImage)
+			r.Post("/{id}/uploads", galleriesC.CreateUpload)
+			r.Head("/{id}/uploads/{uploadID}", galleriesC.UploadOffset)
+			r.Patch("/{id}/uploads/{uploadID}", galleriesC.UploadChunk)
+			r.Delete("/{id}/uploads/{uploadID}", galleriesC.CancelUpload)
 			// Add this line
 			r.Post("/{id}/images/url", galleriesC.ImageViaURL)
+			r.Post("/{id}/images/order", galleriesC.ReorderImages)
+			r.Post("/{id}/images/import/{provider}", galleriesC.ImportFolder)
+			r.Post("/{id}/sync", galleriesC.LinkFolder)
+			r.Post("/{id}/sync/run", galleriesC.SyncGallery)
+			r.Post("/{id}/sync/delete", galleriesC.UnlinkGallery)
+			r.Post("/{id}/cover", galleriesC.SetCover)
+			r.Post("/{id}/images/{filename}", galleriesC.UpdateImage)
 			r.Post("/{id}/images/{filename}/delete", galleriesC.DeleteImage)
 		})
 	})
@@ -208,10 +557,30 @@ func run(cfg config) error {
 	// assetsHandler := http.FileServer(http.Dir("assets"))
 	// r.Get("/assets/*", http.StripPrefix("/assets", assetsHandler).ServeHTTP) // 删除路由后的前缀，然后由句柄处理
 
+	r.Route("/collections", func(r chi.Router) {
+		r.Get("/{id}", collectionsC.Show)
+		r.Group(func(r chi.Router) {
+			r.Use(umw.RequireUser)
+			r.Post("/", collectionsC.Create)
+			r.Get("/{id}/edit", collectionsC.Edit)
+			r.Post("/{id}", collectionsC.Update)
+			r.Post("/{id}/move", collectionsC.Move)
+			r.Post("/{id}/delete", collectionsC.Delete)
+		})
+	})
+	r.Route("/trash", func(r chi.Router) {
+		r.Use(umw.RequireUser)
+		r.Get("/", galleriesC.Trash)
+		r.Post("/galleries/{id}/restore", galleriesC.RestoreGallery)
+		r.Post("/galleries/{id}/delete", galleriesC.PurgeGallery)
+		r.Post("/images/{id}/restore", galleriesC.RestoreImage)
+		r.Post("/images/{id}/delete", galleriesC.PurgeImage)
+	})
 	r.Route("/oauth/{provider}", func(r chi.Router) {
 		r.Use(umw.RequireUser)
 		r.Get("/connect", oauthC.Connect)
 		r.Get("/callback", oauthC.Callback)
+		r.Post("/disconnect", oauthC.Disconnect)
 	})
 
 	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE images (
+    id SERIAL PRIMARY KEY,
+    gallery_id INT NOT NULL REFERENCES galleries (id) ON DELETE CASCADE,
+    filename TEXT NOT NULL,
+    content_type TEXT NOT NULL,
+    size BIGINT NOT NULL DEFAULT 0,
+    uploaded_by INT REFERENCES users (id) ON DELETE SET NULL,
+    position INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (gallery_id, filename)
+);
+CREATE INDEX images_gallery_id_position_idx ON images (gallery_id, position);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE images;
+-- +goose StatementEnd
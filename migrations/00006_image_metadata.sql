@@ -0,0 +1,31 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE images
+    ADD COLUMN taken_at TIMESTAMPTZ,
+    ADD COLUMN camera_make TEXT NOT NULL DEFAULT '',
+    ADD COLUMN camera_model TEXT NOT NULL DEFAULT '',
+    ADD COLUMN lens TEXT NOT NULL DEFAULT '',
+    ADD COLUMN exposure_time TEXT NOT NULL DEFAULT '',
+    ADD COLUMN f_number DOUBLE PRECISION NOT NULL DEFAULT 0,
+    ADD COLUMN iso INT NOT NULL DEFAULT 0,
+    ADD COLUMN focal_length DOUBLE PRECISION NOT NULL DEFAULT 0,
+    ADD COLUMN orientation INT NOT NULL DEFAULT 1;
+ALTER TABLE galleries
+    ADD COLUMN keep_metadata BOOLEAN NOT NULL DEFAULT false;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE galleries
+    DROP COLUMN keep_metadata;
+ALTER TABLE images
+    DROP COLUMN taken_at,
+    DROP COLUMN camera_make,
+    DROP COLUMN camera_model,
+    DROP COLUMN lens,
+    DROP COLUMN exposure_time,
+    DROP COLUMN f_number,
+    DROP COLUMN iso,
+    DROP COLUMN focal_length,
+    DROP COLUMN orientation;
+-- +goose StatementEnd
@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE blobs (
+    hash TEXT PRIMARY KEY,
+    size BIGINT NOT NULL,
+    content_type TEXT NOT NULL,
+    ref_count INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+-- Images uploaded before blobs existed keep a NULL blob_hash and are still
+-- read from their original gallery-N/filename location.
+ALTER TABLE images
+    ADD COLUMN blob_hash TEXT REFERENCES blobs (hash);
+CREATE INDEX images_blob_hash_idx ON images (blob_hash);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE images
+    DROP COLUMN blob_hash;
+DROP TABLE blobs;
+-- +goose StatementEnd
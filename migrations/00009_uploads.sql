@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE uploads (
+    id TEXT PRIMARY KEY,
+    gallery_id INT NOT NULL REFERENCES galleries (id) ON DELETE CASCADE,
+    user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    filename TEXT NOT NULL,
+    size BIGINT NOT NULL,
+    "offset" BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX uploads_updated_at_idx ON uploads (updated_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE uploads;
+-- +goose StatementEnd
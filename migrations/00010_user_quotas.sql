@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Per-user overrides of the default quotas. A NULL column falls back to the
+-- configured default and 0 means unlimited.
+CREATE TABLE user_quotas (
+    user_id INT PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    max_bytes BIGINT,
+    max_images_per_gallery INT,
+    max_galleries INT,
+    max_file_size BIGINT
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE user_quotas;
+-- +goose StatementEnd
@@ -0,0 +1,82 @@
+-- +goose Up
+-- +goose StatementBegin
+-- storage_cleanup is an outbox of stored objects to remove. Rows are written
+-- in the same transaction that deletes the rows referencing the objects, and
+-- a worker deletes the objects afterwards, retrying until it succeeds. That
+-- way the database and the image store always converge, however a deletion
+-- is interrupted.
+CREATE TABLE storage_cleanup (
+    id BIGSERIAL PRIMARY KEY,
+    kind TEXT NOT NULL CHECK (kind IN ('blob', 'legacy_image', 'prefix')),
+    target TEXT NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX storage_cleanup_next_attempt_at_idx ON storage_cleanup (next_attempt_at);
+
+-- Triggers queue the cleanup so that it also happens when rows are removed
+-- by ON DELETE CASCADE, eg when a user is deleted.
+CREATE FUNCTION release_image_storage() RETURNS trigger AS $$
+DECLARE
+    remaining INT;
+BEGIN
+    IF OLD.blob_hash IS NULL THEN
+        INSERT INTO storage_cleanup (kind, target)
+        VALUES ('legacy_image', OLD.gallery_id || '/' || OLD.filename);
+        RETURN OLD;
+    END IF;
+    UPDATE blobs
+    SET ref_count = ref_count - 1
+    WHERE hash = OLD.blob_hash
+    RETURNING ref_count INTO remaining;
+    IF remaining <= 0 THEN
+        DELETE FROM blobs WHERE hash = OLD.blob_hash;
+        INSERT INTO storage_cleanup (kind, target) VALUES ('blob', OLD.blob_hash);
+    END IF;
+    RETURN OLD;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER images_release_storage
+    AFTER DELETE ON images
+    FOR EACH ROW EXECUTE FUNCTION release_image_storage();
+
+CREATE FUNCTION release_prefix_storage() RETURNS trigger AS $$
+BEGIN
+    INSERT INTO storage_cleanup (kind, target)
+    VALUES ('prefix', format(TG_ARGV[0], OLD.id));
+    RETURN OLD;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Images uploaded before blobs existed live below gallery-N/.
+CREATE TRIGGER galleries_release_storage
+    AFTER DELETE ON galleries
+    FOR EACH ROW EXECUTE FUNCTION release_prefix_storage('gallery-%s/');
+
+CREATE TRIGGER uploads_release_storage
+    AFTER DELETE ON uploads
+    FOR EACH ROW EXECUTE FUNCTION release_prefix_storage('uploads/%s/');
+
+-- Deleting a user used to fail while they had galleries.
+ALTER TABLE galleries
+    DROP CONSTRAINT galleries_user_id_fkey,
+    ADD CONSTRAINT galleries_user_id_fkey
+        FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE galleries
+    DROP CONSTRAINT galleries_user_id_fkey,
+    ADD CONSTRAINT galleries_user_id_fkey
+        FOREIGN KEY (user_id) REFERENCES users (id);
+DROP TRIGGER uploads_release_storage ON uploads;
+DROP TRIGGER galleries_release_storage ON galleries;
+DROP TRIGGER images_release_storage ON images;
+DROP FUNCTION release_prefix_storage();
+DROP FUNCTION release_image_storage();
+DROP TABLE storage_cleanup;
+-- +goose StatementEnd
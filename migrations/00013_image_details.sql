@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE images
+    ADD COLUMN caption TEXT NOT NULL DEFAULT '',
+    ADD COLUMN alt_text TEXT NOT NULL DEFAULT '',
+    ADD COLUMN tags TEXT[] NOT NULL DEFAULT '{}';
+-- Filtering a gallery by tag uses tags @> ARRAY[tag].
+CREATE INDEX images_tags_idx ON images USING GIN (tags);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE images
+    DROP COLUMN caption,
+    DROP COLUMN alt_text,
+    DROP COLUMN tags;
+-- +goose StatementEnd
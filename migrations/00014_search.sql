@@ -0,0 +1,59 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE galleries
+    ADD COLUMN description TEXT NOT NULL DEFAULT '',
+    ADD COLUMN search tsvector;
+ALTER TABLE images
+    ADD COLUMN search tsvector;
+
+-- The search vectors are kept up to date by triggers rather than generated
+-- columns because array_to_string is not immutable. Filenames are split on
+-- punctuation so that "beach_day-2.jpg" matches "beach".
+CREATE FUNCTION galleries_search_update() RETURNS trigger AS $$
+BEGIN
+    NEW.search :=
+        setweight(to_tsvector('english', NEW.title), 'A') ||
+        setweight(to_tsvector('english', NEW.description), 'B');
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER galleries_search_update
+    BEFORE INSERT OR UPDATE OF title, description ON galleries
+    FOR EACH ROW EXECUTE FUNCTION galleries_search_update();
+
+CREATE FUNCTION images_search_update() RETURNS trigger AS $$
+BEGIN
+    NEW.search :=
+        setweight(to_tsvector('english', array_to_string(NEW.tags, ' ')), 'A') ||
+        setweight(to_tsvector('english', NEW.caption), 'B') ||
+        setweight(to_tsvector('english', regexp_replace(NEW.filename, '[[:punct:]]+', ' ', 'g')), 'C') ||
+        setweight(to_tsvector('english', NEW.alt_text), 'D');
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER images_search_update
+    BEFORE INSERT OR UPDATE OF filename, caption, alt_text, tags ON images
+    FOR EACH ROW EXECUTE FUNCTION images_search_update();
+
+-- Fill in the vectors of existing rows.
+UPDATE galleries SET title = title;
+UPDATE images SET filename = filename;
+
+CREATE INDEX galleries_search_idx ON galleries USING GIN (search);
+CREATE INDEX images_search_idx ON images USING GIN (search);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TRIGGER images_search_update ON images;
+DROP TRIGGER galleries_search_update ON galleries;
+DROP FUNCTION images_search_update();
+DROP FUNCTION galleries_search_update();
+ALTER TABLE images
+    DROP COLUMN search;
+ALTER TABLE galleries
+    DROP COLUMN description,
+    DROP COLUMN search;
+-- +goose StatementEnd
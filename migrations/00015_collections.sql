@@ -0,0 +1,67 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Collections group galleries, and other collections, into a tree such as
+-- client -> event -> gallery.
+CREATE TABLE collections (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    parent_id INT REFERENCES collections (id) ON DELETE CASCADE,
+    title TEXT NOT NULL,
+    -- NULL inherits the visibility of the parent collection.
+    visibility TEXT CHECK (visibility IN ('private', 'unlisted', 'public')),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX collections_user_id_parent_id_idx ON collections (user_id, parent_id);
+
+ALTER TABLE galleries
+    ADD COLUMN collection_id INT REFERENCES collections (id) ON DELETE SET NULL;
+CREATE INDEX galleries_collection_id_idx ON galleries (collection_id);
+
+-- A NULL gallery visibility now means the gallery inherits the visibility of
+-- its collection. Existing galleries keep the visibility they have.
+ALTER TABLE galleries
+    ALTER COLUMN visibility DROP NOT NULL,
+    ALTER COLUMN visibility DROP DEFAULT;
+
+-- Galleries always have a share token, so that the share URL works as soon
+-- as the gallery becomes unlisted, whether directly or through a collection.
+UPDATE galleries
+SET share_token = replace(gen_random_uuid()::text || gen_random_uuid()::text, '-', '')
+WHERE share_token IS NULL;
+
+-- collection_visibility walks up from the collection to the first ancestor
+-- (or itself) that sets a visibility.
+CREATE FUNCTION collection_visibility(collection_id INT) RETURNS TEXT AS $$
+    WITH RECURSIVE chain AS (
+        SELECT parent_id, visibility, 0 AS depth
+        FROM collections
+        WHERE id = collection_id
+        UNION ALL
+        SELECT c.parent_id, c.visibility, chain.depth + 1
+        FROM collections c JOIN chain ON c.id = chain.parent_id
+        WHERE chain.visibility IS NULL AND chain.depth < 100
+    )
+    SELECT visibility FROM chain WHERE visibility IS NOT NULL ORDER BY depth LIMIT 1;
+$$ LANGUAGE sql STABLE;
+
+-- gallery_visibility is the visibility that applies to a gallery. Galleries
+-- and collections that inherit from nothing are private.
+CREATE FUNCTION gallery_visibility(visibility TEXT, collection_id INT) RETURNS TEXT AS $$
+    SELECT COALESCE(visibility, collection_visibility(collection_id), 'private');
+$$ LANGUAGE sql STABLE;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+-- Keep galleries visible to the same people by storing what they inherit.
+UPDATE galleries
+SET visibility = gallery_visibility(visibility, collection_id)
+WHERE visibility IS NULL;
+DROP FUNCTION gallery_visibility(TEXT, INT);
+DROP FUNCTION collection_visibility(INT);
+ALTER TABLE galleries
+    ALTER COLUMN visibility SET DEFAULT 'private',
+    ALTER COLUMN visibility SET NOT NULL,
+    DROP COLUMN collection_id;
+DROP TABLE collections;
+-- +goose StatementEnd
@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Collaborators are invited by email, so they can be added before they have
+-- an account. They get access once they sign in with that address.
+CREATE TABLE gallery_collaborators (
+    id SERIAL PRIMARY KEY,
+    gallery_id INT NOT NULL REFERENCES galleries (id) ON DELETE CASCADE,
+    email TEXT NOT NULL,
+    role TEXT NOT NULL CHECK (role IN ('viewer', 'contributor', 'editor')),
+    invited_by INT REFERENCES users (id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (gallery_id, email)
+);
+CREATE INDEX gallery_collaborators_email_idx ON gallery_collaborators (email);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE gallery_collaborators;
+-- +goose StatementEnd
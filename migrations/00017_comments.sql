@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE galleries ADD COLUMN comments_disabled BOOLEAN NOT NULL DEFAULT false;
+-- Comments with no image_id are on the gallery itself. Deleted comments keep
+-- their row, without the body, so that the replies to them stay in place.
+CREATE TABLE comments (
+    id SERIAL PRIMARY KEY,
+    gallery_id INT NOT NULL REFERENCES galleries (id) ON DELETE CASCADE,
+    image_id INT REFERENCES images (id) ON DELETE CASCADE,
+    parent_id INT REFERENCES comments (id) ON DELETE CASCADE,
+    user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    body TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    deleted_at TIMESTAMPTZ
+);
+CREATE INDEX comments_gallery_id_idx ON comments (gallery_id, created_at);
+CREATE INDEX comments_image_id_idx ON comments (image_id) WHERE image_id IS NOT NULL;
+CREATE INDEX comments_parent_id_idx ON comments (parent_id) WHERE parent_id IS NOT NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE comments;
+ALTER TABLE galleries DROP COLUMN comments_disabled;
+-- +goose StatementEnd
@@ -0,0 +1,32 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE galleries ADD COLUMN proofing BOOLEAN NOT NULL DEFAULT false;
+-- A selection is one viewer's favourites in a proofing gallery. Viewers are
+-- told apart by a random token kept in a cookie, so anonymous share link
+-- viewers can make a selection too; only its hash is stored.
+CREATE TABLE proof_selections (
+    id SERIAL PRIMARY KEY,
+    gallery_id INT NOT NULL REFERENCES galleries (id) ON DELETE CASCADE,
+    viewer_token_hash TEXT NOT NULL,
+    user_id INT REFERENCES users (id) ON DELETE SET NULL,
+    name TEXT NOT NULL DEFAULT '',
+    note TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    submitted_at TIMESTAMPTZ,
+    UNIQUE (gallery_id, viewer_token_hash)
+);
+CREATE TABLE proof_selection_images (
+    selection_id INT NOT NULL REFERENCES proof_selections (id) ON DELETE CASCADE,
+    image_id INT NOT NULL REFERENCES images (id) ON DELETE CASCADE,
+    PRIMARY KEY (selection_id, image_id)
+);
+CREATE INDEX proof_selections_submitted_idx ON proof_selections (gallery_id, submitted_at)
+    WHERE submitted_at IS NOT NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE proof_selection_images;
+DROP TABLE proof_selections;
+ALTER TABLE galleries DROP COLUMN proofing;
+-- +goose StatementEnd
@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Existing galleries are dated by their first image, if they have one.
+ALTER TABLE galleries ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+UPDATE galleries
+SET created_at = COALESCE(
+    (SELECT MIN(created_at) FROM images WHERE images.gallery_id = galleries.id), created_at);
+-- Indexes for the keyset pagination of each sort order.
+CREATE INDEX galleries_user_id_title_idx ON galleries (user_id, COALESCE(title, ''), id) WHERE deleted_at IS NULL;
+CREATE INDEX galleries_user_id_created_at_idx ON galleries (user_id, created_at, id) WHERE deleted_at IS NULL;
+CREATE INDEX images_gallery_id_created_at_idx ON images (gallery_id, created_at, id) WHERE deleted_at IS NULL;
+CREATE INDEX images_gallery_id_taken_at_idx ON images (gallery_id, COALESCE(taken_at, 'infinity'), id)
+    WHERE deleted_at IS NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX images_gallery_id_taken_at_idx;
+DROP INDEX images_gallery_id_created_at_idx;
+DROP INDEX galleries_user_id_created_at_idx;
+DROP INDEX galleries_user_id_title_idx;
+ALTER TABLE galleries DROP COLUMN created_at;
+-- +goose StatementEnd
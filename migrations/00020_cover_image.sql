@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Galleries without a cover, or whose cover is in the trash, show their
+-- first image instead.
+ALTER TABLE galleries ADD COLUMN cover_image_id INT REFERENCES images (id) ON DELETE SET NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE galleries DROP COLUMN cover_image_id;
+-- +goose StatementEnd
@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+-- token holds the OAuth token as JSON, encrypted with AES-GCM (see
+-- models/oauth.go). Only one account per provider can be connected.
+CREATE TABLE oauth_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    provider TEXT NOT NULL,
+    token BYTEA NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (user_id, provider)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE oauth_tokens;
+-- +goose StatementEnd
@@ -0,0 +1,34 @@
+-- +goose Up
+-- +goose StatementBegin
+-- A gallery can be linked to a folder in its owner's cloud account. cursor is
+-- the provider's marker of the last listing, so each sync only fetches what
+-- changed since.
+CREATE TABLE gallery_syncs (
+    gallery_id INT PRIMARY KEY REFERENCES galleries (id) ON DELETE CASCADE,
+    user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    provider TEXT NOT NULL,
+    folder TEXT NOT NULL,
+    cursor TEXT NOT NULL DEFAULT '',
+    next_sync_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_synced_at TIMESTAMPTZ,
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX gallery_syncs_next_sync_at_idx ON gallery_syncs (next_sync_at);
+
+-- The files a sync imported, and the revision imported, so that unchanged
+-- files are not imported twice when a listing is repeated.
+CREATE TABLE gallery_sync_files (
+    gallery_id INT NOT NULL REFERENCES galleries (id) ON DELETE CASCADE,
+    remote_id TEXT NOT NULL,
+    rev TEXT NOT NULL,
+    image_id INT REFERENCES images (id) ON DELETE SET NULL,
+    PRIMARY KEY (gallery_id, remote_id)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE gallery_sync_files;
+DROP TABLE gallery_syncs;
+-- +goose StatementEnd
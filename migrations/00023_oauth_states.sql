@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+-- An authorization in progress. The state sent to the provider is only
+-- stored hashed, and the PKCE verifier never leaves the server.
+CREATE TABLE oauth_states (
+    id SERIAL PRIMARY KEY,
+    state_hash TEXT UNIQUE NOT NULL,
+    user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    provider TEXT NOT NULL,
+    verifier TEXT NOT NULL,
+    return_to TEXT NOT NULL DEFAULT '',
+    expires_at TIMESTAMPTZ NOT NULL
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE oauth_states;
+-- +goose StatementEnd
@@ -0,0 +1,30 @@
+-- +goose Up
+-- +goose StatementBegin
+-- An account at an OpenID Connect provider the user signs in with. subject is
+-- the provider's ID for the account, which never changes.
+CREATE TABLE user_identities (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    provider TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    email TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (provider, subject),
+    UNIQUE (user_id, provider)
+);
+-- Signing in starts an authorization before there is a user, and ID tokens
+-- are tied to the authorization by a nonce.
+ALTER TABLE oauth_states
+    ALTER COLUMN user_id DROP NOT NULL,
+    ADD COLUMN nonce TEXT NOT NULL DEFAULT '';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DELETE FROM oauth_states
+WHERE user_id IS NULL;
+ALTER TABLE oauth_states
+    ALTER COLUMN user_id SET NOT NULL,
+    DROP COLUMN nonce;
+DROP TABLE user_identities;
+-- +goose StatementEnd
@@ -0,0 +1,29 @@
+-- +goose Up
+-- +goose StatementBegin
+-- A user can be signed in on any number of devices, each with its own
+-- session.
+ALTER TABLE sessions
+    DROP CONSTRAINT sessions_user_id_key,
+    ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    ADD COLUMN last_seen_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    ADD COLUMN ip_address TEXT NOT NULL DEFAULT '',
+    ADD COLUMN user_agent TEXT NOT NULL DEFAULT '';
+CREATE INDEX sessions_user_id_idx ON sessions (user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+-- Only the most recently used session of each user is kept.
+DELETE FROM sessions
+WHERE id NOT IN (
+    SELECT DISTINCT ON (user_id) id
+    FROM sessions
+    ORDER BY user_id, last_seen_at DESC, id DESC);
+DROP INDEX sessions_user_id_idx;
+ALTER TABLE sessions
+    ADD CONSTRAINT sessions_user_id_key UNIQUE (user_id),
+    DROP COLUMN created_at,
+    DROP COLUMN last_seen_at,
+    DROP COLUMN ip_address,
+    DROP COLUMN user_agent;
+-- +goose StatementEnd
@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Whether the user has shown they own their email address, by following a
+-- link sent to it or signing in with a provider that checked it. Provider
+-- accounts are only linked to users by a verified address.
+ALTER TABLE users
+    ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT false;
+-- Users without a password were created by signing in with a provider.
+UPDATE users
+SET email_verified = true
+WHERE password_hash = '';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE users
+    DROP COLUMN email_verified;
+-- +goose StatementEnd
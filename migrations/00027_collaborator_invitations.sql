@@ -0,0 +1,26 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Anyone can sign up with any email address, so collaborators only get access
+-- once they accept the invitation sent to theirs, which ties it to their
+-- user. token_hash is the hash of the invitation's token while it is pending.
+ALTER TABLE gallery_collaborators
+    ADD COLUMN user_id INT REFERENCES users (id) ON DELETE CASCADE,
+    ADD COLUMN token_hash TEXT UNIQUE,
+    ADD CONSTRAINT gallery_collaborators_gallery_id_user_id_key UNIQUE (gallery_id, user_id);
+-- Collaborators who have proven they own their address keep their access;
+-- the others have to be invited again.
+UPDATE gallery_collaborators
+SET user_id = users.id
+FROM users
+WHERE users.email = gallery_collaborators.email AND users.email_verified;
+CREATE INDEX gallery_collaborators_user_id_idx ON gallery_collaborators (user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX gallery_collaborators_user_id_idx;
+ALTER TABLE gallery_collaborators
+    DROP CONSTRAINT gallery_collaborators_gallery_id_user_id_key,
+    DROP COLUMN user_id,
+    DROP COLUMN token_hash;
+-- +goose StatementEnd
@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Objects are queued for cleanup before they are written, in case the
+-- transaction recording them fails (see queueCleanup). Chunks of resumable
+-- uploads are removed one at a time that way.
+ALTER TABLE storage_cleanup
+    DROP CONSTRAINT storage_cleanup_kind_check,
+    ADD CONSTRAINT storage_cleanup_kind_check
+        CHECK (kind IN ('blob', 'legacy_image', 'prefix', 'chunk'));
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DELETE FROM storage_cleanup
+WHERE kind = 'chunk';
+ALTER TABLE storage_cleanup
+    DROP CONSTRAINT storage_cleanup_kind_check,
+    ADD CONSTRAINT storage_cleanup_kind_check
+        CHECK (kind IN ('blob', 'legacy_image', 'prefix'));
+-- +goose StatementEnd
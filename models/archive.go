@@ -0,0 +1,49 @@
+package models
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+)
+
+// WriteZip streams a ZIP archive of every image in the gallery to w. If size
+// is not the zero value the matching variant of each image is written instead
+// of the original. Images are copied straight from the store one at a time,
+// so memory use does not grow with the size of the gallery.
+func (service *GalleryService) WriteZip(w io.Writer, galleryID int, size ImageSize) error {
+	images, err := service.Images(galleryID)
+	if err != nil {
+		return fmt.Errorf("write zip: %w", err)
+	}
+	zw := zip.NewWriter(w)
+	for _, image := range images {
+		err = service.writeZipEntry(zw, image, size)
+		if err != nil {
+			return fmt.Errorf("write zip: %w", err)
+		}
+	}
+	err = zw.Close()
+	if err != nil {
+		return fmt.Errorf("write zip: %w", err)
+	}
+	return nil
+}
+
+func (service *GalleryService) writeZipEntry(zw *zip.Writer, image Image, size ImageSize) error {
+	rc, _, err := service.OpenImage(image, size)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	// Images are already compressed, so deflating them again only costs CPU.
+	entry, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     image.Filename,
+		Method:   zip.Store,
+		Modified: image.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, rc)
+	return err
+}
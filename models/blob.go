@@ -0,0 +1,153 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Image bytes are stored content-addressed: every distinct file is kept once
+// as a blob named after its SHA-256 hash, and images rows reference it. The
+// blobs table counts those references so a blob (and its variants) is only
+// removed from the store once nothing points at it. References are dropped
+// by a trigger when images rows are deleted.
+
+func hashContents(r io.Reader) (string, error) {
+	h := sha256.New()
+	_, err := io.Copy(h, r)
+	if err != nil {
+		return "", fmt.Errorf("hash contents: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (service *GalleryService) blobKey(hash string) string {
+	return fmt.Sprintf("blobs/%s/%s/%s", hash[:2], hash[2:4], hash)
+}
+
+// errBlobGone is returned by referenceBlob when the objects stored by
+// uploadBlob were cleaned up before the blob was referenced.
+var errBlobGone = errors.New("blob was cleaned up before it was referenced")
+
+// uploadBlob stores the blob and its variants, unless it is stored already,
+// ahead of the transaction that references it with referenceBlob. That keeps
+// the slow work out of the transaction and the locks it holds. The returned
+// cleanup ID, 0 if nothing was uploaded, is passed on to referenceBlob.
+func (service *GalleryService) uploadBlob(hash, contentType string, orientation int, contents io.ReadSeeker, size int64) (int64, error) {
+	var exists bool
+	row := service.DB.QueryRow(`
+	SELECT EXISTS (SELECT 1 FROM blobs WHERE hash = $1);`, hash)
+	err := row.Scan(&exists)
+	if err != nil {
+		return 0, fmt.Errorf("upload blob: %w", err)
+	}
+	if exists {
+		return 0, nil
+	}
+	// Unless the blob is referenced, the cleanup worker removes it.
+	cleanupID, err := service.queueCleanup("blob", hash)
+	if err != nil {
+		return 0, fmt.Errorf("upload blob: %w", err)
+	}
+	err = service.putBlob(hash, contentType, orientation, contents, size)
+	if err != nil {
+		return 0, fmt.Errorf("upload blob: %w", err)
+	}
+	return cleanupID, nil
+}
+
+// referenceBlob adds a reference to a blob stored by uploadBlob in tx. If
+// nothing referenced the blob, the cleanup worker may have removed its
+// objects since, in which case errBlobGone is returned and the caller can
+// upload it again. The blob lock keeps the worker away from then on.
+func (service *GalleryService) referenceBlob(tx *sql.Tx, cleanupID int64, hash string, size int64, contentType string) error {
+	created, err := service.acquireBlob(tx, hash, size, contentType)
+	if err != nil {
+		return err
+	}
+	if created {
+		_, err = service.store().Stat(service.blobKey(hash))
+		if errors.Is(err, ErrNotFound) {
+			return errBlobGone
+		}
+		if err != nil {
+			return fmt.Errorf("reference blob: %w", err)
+		}
+	}
+	if cleanupID != 0 {
+		err = cancelCleanup(tx, cleanupID)
+		if err != nil {
+			return fmt.Errorf("reference blob: %w", err)
+		}
+	}
+	return nil
+}
+
+// acquireBlob adds a reference to the blob with the given hash, creating the
+// row if needed. created reports whether this is the first reference, in which
+// case the caller must make sure the blob is stored before committing tx (see
+// referenceBlob). Concurrent uploads of the same blob wait on the blob lock
+// until tx finishes.
+func (service *GalleryService) acquireBlob(tx *sql.Tx, hash string, size int64, contentType string) (created bool, err error) {
+	err = lockBlob(tx, hash)
+	if err != nil {
+		return false, fmt.Errorf("acquire blob: %w", err)
+	}
+	var refCount int
+	row := tx.QueryRow(`
+	INSERT INTO blobs (hash, size, content_type, ref_count)
+	VALUES ($1, $2, $3, 1) ON CONFLICT (hash) DO
+	UPDATE
+	SET ref_count = blobs.ref_count + 1
+	RETURNING ref_count;`, hash, size, contentType)
+	err = row.Scan(&refCount)
+	if err != nil {
+		return false, fmt.Errorf("acquire blob: %w", err)
+	}
+	return refCount == 1, nil
+}
+
+// lockBlob serialises work on a blob's stored objects until tx finishes.
+// Uploads take it before adding a reference and the cleanup worker before
+// removing the objects of an unreferenced blob, so the worker can never delete
+// the objects of a blob that has just been uploaded again.
+func lockBlob(tx *sql.Tx, hash string) error {
+	_, err := tx.Exec(`
+	SELECT pg_advisory_xact_lock(hashtextextended($1, 0));`, hash)
+	if err != nil {
+		return fmt.Errorf("lock blob: %w", err)
+	}
+	return nil
+}
+
+// deleteBlob removes the objects of a blob that was queued for cleanup once
+// its last image was deleted (see cleanup.go), unless the same content has
+// been uploaded again since.
+func (service *GalleryService) deleteBlob(tx *sql.Tx, hash string) error {
+	err := lockBlob(tx, hash)
+	if err != nil {
+		return err
+	}
+	var exists bool
+	row := tx.QueryRow(`
+	SELECT EXISTS (SELECT 1 FROM blobs WHERE hash = $1);`, hash)
+	err = row.Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("delete blob: %w", err)
+	}
+	if exists {
+		return nil
+	}
+	err = service.store().Delete(service.blobKey(hash))
+	if err != nil {
+		return fmt.Errorf("delete blob: %w", err)
+	}
+	err = service.deleteVariants(hash)
+	if err != nil {
+		return fmt.Errorf("delete blob: %w", err)
+	}
+	return nil
+}
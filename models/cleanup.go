@@ -0,0 +1,184 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stored objects are never deleted in the same step as the rows that refer
+// to them. Instead, triggers on the images, galleries and uploads tables
+// queue the objects in the storage_cleanup table as part of the deleting
+// transaction (see migrations/00012_storage_cleanup.sql), and CleanupStorage
+// removes them afterwards. A failed removal is retried with backoff, so a
+// crash or a store outage can delay the cleanup but never orphan a file or
+// leave a row pointing at a missing one.
+//
+// New objects are written before the transaction that records them commits,
+// so they are queued for cleanup beforehand in a transaction of their own,
+// and the recording transaction takes them off the queue again; see
+// queueCleanup. If it fails the worker removes the objects, after checking
+// that nothing refers to them.
+
+const (
+	// cleanupBatchSize is the most queued removals one CleanupStorage call
+	// attempts.
+	cleanupBatchSize = 100
+	// maxCleanupBackoff caps the wait between retries of a failing removal.
+	maxCleanupBackoff = 6 * time.Hour
+	// pendingCleanupDelay is how long the worker leaves objects queued by
+	// queueCleanup alone, so that it does not race the transaction about to
+	// take them off the queue.
+	pendingCleanupDelay = time.Hour
+)
+
+// queueCleanup queues an object for removal before it is written to the
+// store. The transaction that records the object takes the entry off the
+// queue with cancelCleanup, so that it is only left behind if the object is
+// never recorded. The worker leaves the entry alone for pendingCleanupDelay.
+func (service *GalleryService) queueCleanup(kind, target string) (int64, error) {
+	var id int64
+	row := service.DB.QueryRow(`
+	INSERT INTO storage_cleanup (kind, target, next_attempt_at)
+	VALUES ($1, $2, $3)
+	RETURNING id;`, kind, target, time.Now().Add(pendingCleanupDelay))
+	err := row.Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("queue cleanup: %w", err)
+	}
+	return id, nil
+}
+
+// cancelCleanup takes an entry added by queueCleanup off the queue when tx
+// commits.
+func cancelCleanup(tx *sql.Tx, id int64) error {
+	_, err := tx.Exec(`
+	DELETE FROM storage_cleanup
+	WHERE id = $1;`, id)
+	if err != nil {
+		return fmt.Errorf("cancel cleanup: %w", err)
+	}
+	return nil
+}
+
+// CleanupStorage removes queued objects from the store. It is safe to run
+// from several server instances at once. Errors are reported, but the failed
+// removals stay queued and are retried by a later call.
+func (service *GalleryService) CleanupStorage() error {
+	var errs []error
+	for i := 0; i < cleanupBatchSize; i++ {
+		done, err := service.cleanupNext()
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if done {
+			break
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("cleanup storage: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// cleanupNext claims and processes one due entry. done reports that there was
+// nothing left to do.
+func (service *GalleryService) cleanupNext() (done bool, err error) {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return true, err
+	}
+	defer tx.Rollback()
+
+	// SKIP LOCKED lets concurrent workers claim different entries.
+	var id int64
+	var kind, target string
+	var attempts int
+	row := tx.QueryRow(`
+	SELECT id, kind, target, attempts
+	FROM storage_cleanup
+	WHERE next_attempt_at <= now()
+	ORDER BY id
+	LIMIT 1
+	FOR UPDATE SKIP LOCKED;`)
+	err = row.Scan(&id, &kind, &target, &attempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return true, nil
+	}
+	if err != nil {
+		return true, err
+	}
+
+	cleanupErr := service.cleanup(tx, kind, target)
+	if cleanupErr == nil {
+		_, err = tx.Exec(`
+		DELETE FROM storage_cleanup
+		WHERE id = $1;`, id)
+	} else {
+		backoff := time.Minute << min(attempts, 20)
+		if backoff > maxCleanupBackoff {
+			backoff = maxCleanupBackoff
+		}
+		_, err = tx.Exec(`
+		UPDATE storage_cleanup
+		SET attempts = attempts + 1, last_error = $2, next_attempt_at = $3
+		WHERE id = $1;`, id, cleanupErr.Error(), time.Now().Add(backoff))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return false, err
+	}
+	if cleanupErr != nil {
+		return false, fmt.Errorf("%s %s: %w", kind, target, cleanupErr)
+	}
+	return false, nil
+}
+
+func (service *GalleryService) cleanup(tx *sql.Tx, kind, target string) error {
+	switch kind {
+	case "blob":
+		return service.deleteBlob(tx, target)
+	case "legacy_image":
+		galleryID, filename, ok := strings.Cut(target, "/")
+		id, err := strconv.Atoi(galleryID)
+		if !ok || err != nil {
+			return fmt.Errorf("invalid legacy image %q", target)
+		}
+		return service.deleteLegacyImage(id, filename)
+	case "prefix":
+		return service.store().DeletePrefix(target)
+	case "chunk":
+		uploadID, offset, ok := strings.Cut(target, "/")
+		n, err := strconv.ParseInt(offset, 10, 64)
+		if !ok || err != nil {
+			return fmt.Errorf("invalid chunk %q", target)
+		}
+		return service.deleteChunk(tx, uploadID, n)
+	}
+	return fmt.Errorf("unknown cleanup kind %q", kind)
+}
+
+// deleteChunk removes a chunk whose upload was not advanced past it. Chunks
+// of deleted uploads are removed with the rest of the upload's prefix.
+func (service *GalleryService) deleteChunk(tx *sql.Tx, uploadID string, offset int64) error {
+	// The row lock waits for a chunk being written at the same offset.
+	var uploadOffset int64
+	row := tx.QueryRow(`
+	SELECT "offset"
+	FROM uploads
+	WHERE id = $1
+	FOR UPDATE;`, uploadID)
+	err := row.Scan(&uploadOffset)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && offset < uploadOffset) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return service.store().Delete(chunkKey(uploadID, offset))
+}
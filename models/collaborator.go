@@ -0,0 +1,311 @@
+package models
+
+import (
+	"Gallery/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// Role is what a user may do with a gallery they are looking at. Owners
+// can do everything; the other roles are granted to collaborators.
+type Role string
+
+const (
+	RoleNone        Role = ""
+	RoleViewer      Role = "viewer"
+	RoleContributor Role = "contributor"
+	RoleEditor      Role = "editor"
+	RoleOwner       Role = "owner"
+)
+
+// Permission is an action on a gallery that needs a minimum Role.
+type Permission int
+
+const (
+	// PermissionView allows viewing the gallery whatever its visibility.
+	PermissionView Permission = iota
+	// PermissionUpload allows adding images, and deleting the images the
+	// user uploaded.
+	PermissionUpload
+	// PermissionEdit allows changing the title, description and images, and
+	// deleting any image.
+	PermissionEdit
+	// PermissionManage allows everything else: visibility, sharing,
+	// collaborators, moving and deleting the gallery.
+	PermissionManage
+)
+
+// ParseRole validates a collaborator role submitted by a user.
+func ParseRole(s string) (Role, bool) {
+	switch role := Role(s); role {
+	case RoleViewer, RoleContributor, RoleEditor:
+		return role, true
+	}
+	return RoleNone, false
+}
+
+// Can reports whether the role grants the permission.
+func (role Role) Can(perm Permission) bool {
+	switch role {
+	case RoleOwner:
+		return true
+	case RoleEditor:
+		return perm <= PermissionEdit
+	case RoleContributor:
+		return perm <= PermissionUpload
+	case RoleViewer:
+		return perm <= PermissionView
+	}
+	return false
+}
+
+// Collaborator is someone a gallery is shared with. They are invited by
+// email, and get access once they accept the invitation, which ties it to
+// their user.
+type Collaborator struct {
+	ID        int
+	GalleryID int
+	Email     string
+	Role      Role
+	// UserID is the user who accepted the invitation, or 0 while it is
+	// pending.
+	UserID int
+	// Token is only set when an invitation is created; it is sent to the
+	// collaborator and only its hash is stored.
+	Token     string
+	CreatedAt time.Time
+}
+
+// Invitation is a pending invitation to collaborate on a gallery.
+type Invitation struct {
+	Collaborator
+	Gallery Gallery
+}
+
+// SharedGallery is a gallery someone else shared with a user.
+type SharedGallery struct {
+	Gallery
+	Role Role
+}
+
+// Role returns the role the user has in the gallery. userID is 0 for
+// anonymous users, who never have a role.
+func (service *GalleryService) Role(gallery *Gallery, userID int) (Role, error) {
+	if userID == 0 {
+		return RoleNone, nil
+	}
+	if userID == gallery.UserID {
+		return RoleOwner, nil
+	}
+	var role Role
+	row := service.DB.QueryRow(`
+	SELECT role
+	FROM gallery_collaborators
+	WHERE gallery_id = $1 AND user_id = $2;`, gallery.ID, userID)
+	err := row.Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return RoleNone, nil
+	}
+	if err != nil {
+		return RoleNone, fmt.Errorf("gallery role: %w", err)
+	}
+	return role, nil
+}
+
+// Collaborators returns the people the gallery is shared with, in the order
+// they were added.
+func (service *GalleryService) Collaborators(galleryID int) ([]Collaborator, error) {
+	rows, err := service.DB.Query(`
+	SELECT id, email, role, user_id, created_at
+	FROM gallery_collaborators
+	WHERE gallery_id = $1
+	ORDER BY id;`, galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("query collaborators: %w", err)
+	}
+	defer rows.Close()
+	var collaborators []Collaborator
+	for rows.Next() {
+		collaborator := Collaborator{
+			GalleryID: galleryID,
+		}
+		var userID sql.NullInt64
+		err = rows.Scan(&collaborator.ID, &collaborator.Email, &collaborator.Role, &userID, &collaborator.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("query collaborators: %w", err)
+		}
+		collaborator.UserID = int(userID.Int64)
+		collaborators = append(collaborators, collaborator)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query collaborators: %w", err)
+	}
+	return collaborators, nil
+}
+
+// AddCollaborator invites the email address to collaborate on the gallery, or
+// changes the role of an existing collaborator. Inviting an address that has
+// not accepted yet replaces its invitation, so the returned Collaborator's
+// Token is set whenever an invitation should be sent.
+func (service *GalleryService) AddCollaborator(gallery *Gallery, invitedBy int, email string, role Role) (*Collaborator, error) {
+	address, err := mail.ParseAddress(strings.TrimSpace(email))
+	if err != nil || address.Name != "" {
+		return nil, fmt.Errorf("add collaborator: %w", ValidationError{
+			Issue: fmt.Sprintf("%q is not a valid email address", email),
+		})
+	}
+	email = strings.ToLower(address.Address)
+	var ownerEmail string
+	row := service.DB.QueryRow(`
+	SELECT email
+	FROM users
+	WHERE id = $1;`, gallery.UserID)
+	err = row.Scan(&ownerEmail)
+	if err != nil {
+		return nil, fmt.Errorf("add collaborator: %w", err)
+	}
+	if email == ownerEmail {
+		return nil, fmt.Errorf("add collaborator: %w", ValidationError{
+			Issue: "you already own this gallery",
+		})
+	}
+	token, err := rand.String(MinBytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("add collaborator: %w", err)
+	}
+
+	collaborator := Collaborator{
+		GalleryID: gallery.ID,
+		Email:     email,
+		Role:      role,
+		Token:     token,
+	}
+	var userID sql.NullInt64
+	row = service.DB.QueryRow(`
+	INSERT INTO gallery_collaborators (gallery_id, email, role, invited_by, token_hash)
+	VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT (gallery_id, email) DO UPDATE
+	SET role = EXCLUDED.role,
+		token_hash = CASE WHEN gallery_collaborators.user_id IS NULL THEN EXCLUDED.token_hash END
+	RETURNING id, user_id, created_at;`, gallery.ID, email, role, invitedBy, hashInvitationToken(token))
+	err = row.Scan(&collaborator.ID, &userID, &collaborator.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("add collaborator: %w", err)
+	}
+	if userID.Valid {
+		collaborator.UserID = int(userID.Int64)
+		collaborator.Token = ""
+	}
+	return &collaborator, nil
+}
+
+// Invitation returns the pending invitation with the token. ErrNotFound is
+// returned if it has been accepted or withdrawn, or the gallery deleted.
+func (service *GalleryService) Invitation(token string) (*Invitation, error) {
+	invitation := Invitation{}
+	row := service.DB.QueryRow(`
+	SELECT gallery_collaborators.id, gallery_collaborators.email, gallery_collaborators.role,
+		gallery_collaborators.created_at, galleries.id, galleries.user_id, galleries.title
+	FROM gallery_collaborators JOIN galleries ON galleries.id = gallery_collaborators.gallery_id
+	WHERE gallery_collaborators.token_hash = $1 AND galleries.deleted_at IS NULL;`, hashInvitationToken(token))
+	err := row.Scan(&invitation.ID, &invitation.Email, &invitation.Role, &invitation.CreatedAt,
+		&invitation.Gallery.ID, &invitation.Gallery.UserID, &invitation.Gallery.Title)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("query invitation: %w", err)
+	}
+	invitation.GalleryID = invitation.Gallery.ID
+	return &invitation, nil
+}
+
+// AcceptInvitation gives the user the role the invitation with the token
+// offers. Whoever has the token can read the invitation email, so the user
+// can accept it whatever their own email address. ErrNotFound is returned if
+// the invitation is no longer pending, and a ValidationError if the user
+// owns or already collaborates on the gallery.
+func (service *GalleryService) AcceptInvitation(token string, userID int) (*Collaborator, error) {
+	collaborator := Collaborator{
+		UserID: userID,
+	}
+	row := service.DB.QueryRow(`
+	UPDATE gallery_collaborators
+	SET user_id = $2, token_hash = NULL
+	FROM galleries
+	WHERE gallery_collaborators.token_hash = $1 AND galleries.id = gallery_collaborators.gallery_id
+		AND galleries.deleted_at IS NULL AND galleries.user_id <> $2
+	RETURNING gallery_collaborators.id, gallery_collaborators.gallery_id, gallery_collaborators.email,
+		gallery_collaborators.role, gallery_collaborators.created_at;`, hashInvitationToken(token), userID)
+	err := row.Scan(&collaborator.ID, &collaborator.GalleryID, &collaborator.Email, &collaborator.Role, &collaborator.CreatedAt)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		invitation, err := service.Invitation(token)
+		if err != nil {
+			return nil, fmt.Errorf("accept invitation: %w", err)
+		}
+		if invitation.Gallery.UserID == userID {
+			return nil, fmt.Errorf("accept invitation: %w", ValidationError{
+				Issue: "you already own this gallery",
+			})
+		}
+		return nil, fmt.Errorf("accept invitation: %w", ErrNotFound)
+	case isUniqueViolation(err):
+		return nil, fmt.Errorf("accept invitation: %w", ValidationError{
+			Issue: "you already collaborate on this gallery",
+		})
+	case err != nil:
+		return nil, fmt.Errorf("accept invitation: %w", err)
+	}
+	return &collaborator, nil
+}
+
+func hashInvitationToken(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
+
+// RemoveCollaborator stops sharing the gallery with a collaborator.
+func (service *GalleryService) RemoveCollaborator(galleryID, collaboratorID int) error {
+	result, err := service.DB.Exec(`
+	DELETE FROM gallery_collaborators
+	WHERE id = $1 AND gallery_id = $2;`, collaboratorID, galleryID)
+	if err != nil {
+		return fmt.Errorf("remove collaborator: %w", err)
+	}
+	return requireRow(result, "remove collaborator")
+}
+
+// SharedWith returns the galleries other users have shared with the user,
+// sorted by title.
+func (service *GalleryService) SharedWith(userID int) ([]SharedGallery, error) {
+	rows, err := service.DB.Query(`
+	SELECT galleries.id, galleries.user_id, galleries.title,
+		gallery_visibility(galleries.visibility, galleries.collection_id), gallery_collaborators.role
+	FROM gallery_collaborators JOIN galleries ON galleries.id = gallery_collaborators.gallery_id
+	WHERE gallery_collaborators.user_id = $1 AND galleries.deleted_at IS NULL
+	ORDER BY galleries.title, galleries.id;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("query shared galleries: %w", err)
+	}
+	defer rows.Close()
+	var galleries []SharedGallery
+	for rows.Next() {
+		var gallery SharedGallery
+		err = rows.Scan(&gallery.ID, &gallery.UserID, &gallery.Title, &gallery.Visibility, &gallery.Role)
+		if err != nil {
+			return nil, fmt.Errorf("query shared galleries: %w", err)
+		}
+		galleries = append(galleries, gallery)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query shared galleries: %w", err)
+	}
+	return galleries, nil
+}
@@ -0,0 +1,335 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// Collections organise a user's galleries into a tree of arbitrary depth, eg
+// client -> event -> gallery. A collection, like a gallery, can set its own
+// visibility or inherit the one of its parent; galleries and collections
+// that inherit from nothing are private (see gallery_visibility in
+// migrations/00015_collections.sql).
+
+type Collection struct {
+	ID     int
+	UserID int
+	// ParentID is the collection this one is in, or 0 at the top level.
+	ParentID int
+	Title    string
+	// Visibility is the visibility that applies to the collection, either its
+	// own or the one inherited from its parent.
+	Visibility Visibility
+	// VisibilityOverride is the visibility set on the collection itself. It
+	// is empty when the collection inherits the visibility of its parent.
+	VisibilityOverride Visibility
+}
+
+// CanView reports whether a viewer may see the collection page. Unlike
+// galleries, collections have no share link, so unlisted collections are
+// only shown to their owner; their galleries can still be shared one by one.
+func (collection *Collection) CanView(userID int) bool {
+	if userID != 0 && userID == collection.UserID {
+		return true
+	}
+	return collection.Visibility == VisibilityPublic
+}
+
+type CollectionService struct {
+	DB *sql.DB
+}
+
+const collectionColumns = `id, user_id, COALESCE(parent_id, 0), title,
+	gallery_visibility(NULL, id), COALESCE(visibility, '')`
+
+func scanCollection(row scanner) (Collection, error) {
+	var collection Collection
+	err := row.Scan(&collection.ID, &collection.UserID, &collection.ParentID, &collection.Title,
+		&collection.Visibility, &collection.VisibilityOverride)
+	return collection, err
+}
+
+// Create adds a collection for the user. parentID is 0 for a top level
+// collection, otherwise it must be one of the user's collections.
+func (cs *CollectionService) Create(userID, parentID int, title string) (*Collection, error) {
+	if parentID != 0 {
+		err := cs.checkOwner(cs.DB, parentID, userID)
+		if err != nil {
+			return nil, fmt.Errorf("create collection: %w", err)
+		}
+	}
+	row := cs.DB.QueryRow(`
+	INSERT INTO collections (user_id, parent_id, title)
+	VALUES ($1, NULLIF($2, 0), $3)
+	RETURNING `+collectionColumns+`;`, userID, parentID, title)
+	collection, err := scanCollection(row)
+	if err != nil {
+		return nil, fmt.Errorf("create collection: %w", err)
+	}
+	return &collection, nil
+}
+
+func (cs *CollectionService) ByID(id int) (*Collection, error) {
+	row := cs.DB.QueryRow(`
+	SELECT `+collectionColumns+`
+	FROM collections
+	WHERE id = $1;`, id)
+	collection, err := scanCollection(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("query collection by id: %w", err)
+	}
+	return &collection, nil
+}
+
+// ByUserID returns all of the user's collections, sorted by title.
+func (cs *CollectionService) ByUserID(userID int) ([]Collection, error) {
+	collections, err := cs.query(`
+	SELECT `+collectionColumns+`
+	FROM collections
+	WHERE user_id = $1
+	ORDER BY title, id;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("query collections by user: %w", err)
+	}
+	return collections, nil
+}
+
+// Children returns the collections directly inside the collection, sorted by
+// title.
+func (cs *CollectionService) Children(collectionID int) ([]Collection, error) {
+	collections, err := cs.query(`
+	SELECT `+collectionColumns+`
+	FROM collections
+	WHERE parent_id = $1
+	ORDER BY title, id;`, collectionID)
+	if err != nil {
+		return nil, fmt.Errorf("query child collections: %w", err)
+	}
+	return collections, nil
+}
+
+// Ancestors returns the path from the top level down to the collection,
+// including the collection itself.
+func (cs *CollectionService) Ancestors(collectionID int) ([]Collection, error) {
+	collections, err := cs.query(`
+	WITH RECURSIVE chain AS (
+		SELECT id, parent_id AS next_id, 0 AS depth
+		FROM collections
+		WHERE id = $1
+		UNION ALL
+		SELECT c.id, c.parent_id, chain.depth + 1
+		FROM collections c JOIN chain ON c.id = chain.next_id
+		WHERE chain.depth < 100
+	)
+	SELECT `+collectionColumns+`
+	FROM collections JOIN chain USING (id)
+	ORDER BY chain.depth DESC;`, collectionID)
+	if err != nil {
+		return nil, fmt.Errorf("query collection ancestors: %w", err)
+	}
+	return collections, nil
+}
+
+// Update saves the collection's title and VisibilityOverride, and updates
+// Visibility to match.
+func (cs *CollectionService) Update(collection *Collection) error {
+	row := cs.DB.QueryRow(`
+	UPDATE collections
+	SET title = $2, visibility = NULLIF($3, '')
+	WHERE id = $1
+	RETURNING gallery_visibility(NULL, id);`, collection.ID, collection.Title, collection.VisibilityOverride)
+	err := row.Scan(&collection.Visibility)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("update collection: %w", err)
+	}
+	return nil
+}
+
+// Move puts the collection inside another of its owner's collections, or at
+// the top level if parentID is 0. A collection cannot be moved into itself
+// or one of its own descendants.
+func (cs *CollectionService) Move(collection *Collection, parentID int) error {
+	tx, err := cs.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("move collection: %w", err)
+	}
+	defer tx.Rollback()
+	if parentID != 0 {
+		err = cs.checkOwner(tx, parentID, collection.UserID)
+		if err != nil {
+			return fmt.Errorf("move collection: %w", err)
+		}
+		// Lock the owner's tree so that two concurrent moves cannot create a
+		// cycle between them.
+		_, err = tx.Exec(`
+		SELECT id FROM collections WHERE user_id = $1 FOR UPDATE;`, collection.UserID)
+		if err != nil {
+			return fmt.Errorf("move collection: %w", err)
+		}
+		var cycle bool
+		row := tx.QueryRow(`
+		WITH RECURSIVE chain AS (
+			SELECT id, parent_id
+			FROM collections
+			WHERE id = $2
+			UNION
+			SELECT c.id, c.parent_id
+			FROM collections c JOIN chain ON c.id = chain.parent_id
+		)
+		SELECT EXISTS (SELECT 1 FROM chain WHERE id = $1);`, collection.ID, parentID)
+		err = row.Scan(&cycle)
+		if err != nil {
+			return fmt.Errorf("move collection: %w", err)
+		}
+		if cycle {
+			return fmt.Errorf("move collection: %w", ValidationError{
+				Issue: "a collection cannot be moved into itself",
+			})
+		}
+	}
+	row := tx.QueryRow(`
+	UPDATE collections
+	SET parent_id = NULLIF($2, 0)
+	WHERE id = $1
+	RETURNING gallery_visibility(NULL, id);`, collection.ID, parentID)
+	err = row.Scan(&collection.Visibility)
+	if err != nil {
+		return fmt.Errorf("move collection: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("move collection: %w", err)
+	}
+	collection.ParentID = parentID
+	return nil
+}
+
+// Delete removes the collection. Its galleries and child collections are
+// moved up into its parent. Those that inherited their visibility from the
+// collection are given it explicitly, so deleting a collection never changes
+// who can see what was in it.
+func (cs *CollectionService) Delete(collection *Collection) error {
+	tx, err := cs.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("delete collection: %w", err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`
+	UPDATE collections
+	SET parent_id = NULLIF($2, 0), visibility = COALESCE(visibility, gallery_visibility(NULL, $1))
+	WHERE parent_id = $1;`, collection.ID, collection.ParentID)
+	if err != nil {
+		return fmt.Errorf("delete collection: %w", err)
+	}
+	_, err = tx.Exec(`
+	UPDATE galleries
+	SET collection_id = NULLIF($2, 0), visibility = COALESCE(visibility, gallery_visibility(NULL, $1))
+	WHERE collection_id = $1;`, collection.ID, collection.ParentID)
+	if err != nil {
+		return fmt.Errorf("delete collection: %w", err)
+	}
+	result, err := tx.Exec(`
+	DELETE FROM collections
+	WHERE id = $1;`, collection.ID)
+	if err != nil {
+		return fmt.Errorf("delete collection: %w", err)
+	}
+	err = requireRow(result, "delete collection")
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("delete collection: %w", err)
+	}
+	return nil
+}
+
+// checkOwner returns ErrNotFound unless the collection exists and belongs to
+// the user.
+func (cs *CollectionService) checkOwner(q queryRower, collectionID, userID int) error {
+	var id int
+	row := q.QueryRow(`
+	SELECT id
+	FROM collections
+	WHERE id = $1 AND user_id = $2;`, collectionID, userID)
+	err := row.Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (cs *CollectionService) query(query string, args ...any) ([]Collection, error) {
+	rows, err := cs.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var collections []Collection
+	for rows.Next() {
+		collection, err := scanCollection(rows)
+		if err != nil {
+			return nil, err
+		}
+		collections = append(collections, collection)
+	}
+	return collections, rows.Err()
+}
+
+// ByCollection returns the galleries directly inside the collection, sorted
+// by title.
+func (service *GalleryService) ByCollection(collectionID int) ([]Gallery, error) {
+	rows, err := service.DB.Query(`
+	SELECT id, user_id, title, gallery_visibility(visibility, collection_id), COALESCE(visibility, '')
+	FROM galleries
+	WHERE collection_id = $1 AND deleted_at IS NULL
+	ORDER BY title, id;`, collectionID)
+	if err != nil {
+		return nil, fmt.Errorf("query galleries by collection: %w", err)
+	}
+	defer rows.Close()
+	var galleries []Gallery
+	for rows.Next() {
+		gallery := Gallery{
+			CollectionID: collectionID,
+		}
+		err = rows.Scan(&gallery.ID, &gallery.UserID, &gallery.Title, &gallery.Visibility, &gallery.VisibilityOverride)
+		if err != nil {
+			return nil, fmt.Errorf("query galleries by collection: %w", err)
+		}
+		galleries = append(galleries, gallery)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query galleries by collection: %w", err)
+	}
+	return galleries, nil
+}
+
+// Move puts the gallery in one of its owner's collections, or at the top
+// level if collectionID is 0. Visibility is updated, since a gallery that
+// inherits its visibility takes on the one of its new collection.
+func (service *GalleryService) Move(gallery *Gallery, collectionID int) error {
+	row := service.DB.QueryRow(`
+	UPDATE galleries
+	SET collection_id = NULLIF($2, 0)
+	WHERE id = $1 AND ($2 = 0 OR EXISTS (
+		SELECT 1 FROM collections WHERE id = $2 AND user_id = galleries.user_id))
+	RETURNING gallery_visibility(visibility, collection_id);`, gallery.ID, collectionID)
+	err := row.Scan(&gallery.Visibility)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("move gallery: %w", ErrNotFound)
+		}
+		return fmt.Errorf("move gallery: %w", err)
+	}
+	gallery.CollectionID = collectionID
+	return nil
+}
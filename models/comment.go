@@ -0,0 +1,187 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Comments are left on a gallery or on one of its images by anyone signed in
+// who can view the gallery. Replies form threads; a deleted comment keeps its
+// place in the thread, without its text, so that its replies still make
+// sense.
+
+const MaxCommentLength = 5000
+
+type Comment struct {
+	ID        int
+	GalleryID int
+	// ImageID is the image the comment is on, or 0 for comments on the
+	// gallery itself.
+	ImageID int
+	// ParentID is the comment this one replies to, or 0.
+	ParentID int
+	UserID   int
+	// Author is the name shown for the commenter: the part of their email
+	// address before the @, so that addresses are not published.
+	Author    string
+	Body      string
+	CreatedAt time.Time
+	Deleted   bool
+	// Replies is filled in by CommentThreads.
+	Replies []*Comment
+}
+
+type CommentService struct {
+	DB *sql.DB
+}
+
+const commentColumns = `comments.id, comments.gallery_id, COALESCE(comments.image_id, 0),
+	COALESCE(comments.parent_id, 0), comments.user_id, split_part(users.email, '@', 1),
+	comments.body, comments.created_at, comments.deleted_at IS NOT NULL`
+
+func scanComment(row scanner) (Comment, error) {
+	var comment Comment
+	err := row.Scan(&comment.ID, &comment.GalleryID, &comment.ImageID, &comment.ParentID, &comment.UserID,
+		&comment.Author, &comment.Body, &comment.CreatedAt, &comment.Deleted)
+	return comment, err
+}
+
+// Create adds a comment to the gallery, or to one of its images if imageID is
+// not 0. A reply must be on the same gallery and image as the comment it
+// replies to.
+func (cs *CommentService) Create(galleryID, imageID, parentID, userID int, body string) (*Comment, error) {
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return nil, fmt.Errorf("create comment: %w", ValidationError{
+			Issue: "a comment cannot be empty",
+		})
+	}
+	if utf8.RuneCountInString(body) > MaxCommentLength {
+		return nil, fmt.Errorf("create comment: %w", ValidationError{
+			Issue: fmt.Sprintf("comments can be at most %d characters", MaxCommentLength),
+		})
+	}
+	if imageID != 0 {
+		var exists bool
+		row := cs.DB.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM images
+			WHERE id = $1 AND gallery_id = $2 AND deleted_at IS NULL);`, imageID, galleryID)
+		err := row.Scan(&exists)
+		if err != nil {
+			return nil, fmt.Errorf("create comment: %w", err)
+		}
+		if !exists {
+			return nil, fmt.Errorf("create comment: %w", ErrNotFound)
+		}
+	}
+	if parentID != 0 {
+		parent, err := cs.ByID(parentID)
+		if err != nil {
+			return nil, fmt.Errorf("create comment: %w", err)
+		}
+		if parent.GalleryID != galleryID || parent.ImageID != imageID {
+			return nil, fmt.Errorf("create comment: %w", ErrNotFound)
+		}
+		if parent.Deleted {
+			return nil, fmt.Errorf("create comment: %w", ValidationError{
+				Issue: "you cannot reply to a deleted comment",
+			})
+		}
+	}
+	row := cs.DB.QueryRow(`
+	WITH comment AS (
+		INSERT INTO comments (gallery_id, image_id, parent_id, user_id, body)
+		VALUES ($1, NULLIF($2, 0), NULLIF($3, 0), $4, $5)
+		RETURNING *
+	)
+	SELECT `+commentColumns+`
+	FROM comment comments JOIN users ON users.id = comments.user_id;`,
+		galleryID, imageID, parentID, userID, body)
+	comment, err := scanComment(row)
+	if err != nil {
+		return nil, fmt.Errorf("create comment: %w", err)
+	}
+	return &comment, nil
+}
+
+func (cs *CommentService) ByID(id int) (*Comment, error) {
+	row := cs.DB.QueryRow(`
+	SELECT `+commentColumns+`
+	FROM comments JOIN users ON users.id = comments.user_id
+	WHERE comments.id = $1;`, id)
+	comment, err := scanComment(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("query comment by id: %w", err)
+	}
+	return &comment, nil
+}
+
+// ByGallery returns all the comments on the gallery and its images, oldest
+// first. Comments on images in the trash are left out.
+func (cs *CommentService) ByGallery(galleryID int) ([]Comment, error) {
+	rows, err := cs.DB.Query(`
+	SELECT `+commentColumns+`
+	FROM comments
+		JOIN users ON users.id = comments.user_id
+		LEFT JOIN images ON images.id = comments.image_id
+	WHERE comments.gallery_id = $1 AND images.deleted_at IS NULL
+	ORDER BY comments.created_at, comments.id;`, galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("query comments by gallery: %w", err)
+	}
+	defer rows.Close()
+	var comments []Comment
+	for rows.Next() {
+		comment, err := scanComment(rows)
+		if err != nil {
+			return nil, fmt.Errorf("query comments by gallery: %w", err)
+		}
+		comments = append(comments, comment)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query comments by gallery: %w", err)
+	}
+	return comments, nil
+}
+
+// Delete removes the text of the comment. The comment itself stays as a
+// placeholder for its replies.
+func (cs *CommentService) Delete(id int) error {
+	result, err := cs.DB.Exec(`
+	UPDATE comments
+	SET body = '', deleted_at = now()
+	WHERE id = $1 AND deleted_at IS NULL;`, id)
+	if err != nil {
+		return fmt.Errorf("delete comment: %w", err)
+	}
+	return requireRow(result, "delete comment")
+}
+
+// CommentThreads arranges comments, as returned by ByGallery, into threads.
+// It returns the top level comments with their Replies filled in, in the
+// order they were given.
+func CommentThreads(comments []Comment) []*Comment {
+	byID := make(map[int]*Comment, len(comments))
+	for i := range comments {
+		byID[comments[i].ID] = &comments[i]
+	}
+	var threads []*Comment
+	for i := range comments {
+		comment := &comments[i]
+		parent, ok := byID[comment.ParentID]
+		if !ok {
+			threads = append(threads, comment)
+			continue
+		}
+		parent.Replies = append(parent.Replies, comment)
+	}
+	return threads
+}
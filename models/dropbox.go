@@ -0,0 +1,185 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	DefaultDropboxAPIURL     = "https://api.dropboxapi.com"
+	DefaultDropboxContentURL = "https://content.dropboxapi.com"
+)
+
+// Dropbox is the FileProvider of the "dropbox" kind, using the Dropbox HTTP
+// API.
+type Dropbox struct {
+	// APIURL and ContentURL are the bases of the API and content endpoints.
+	// They default to DefaultDropboxAPIURL and DefaultDropboxContentURL;
+	// tests point them at a local fake.
+	APIURL     string
+	ContentURL string
+}
+
+type dropboxListResult struct {
+	Entries []struct {
+		Tag         string `json:".tag"`
+		ID          string `json:"id"`
+		Name        string `json:"name"`
+		PathDisplay string `json:"path_display"`
+		Rev         string `json:"rev"`
+		Size        int64  `json:"size"`
+	} `json:"entries"`
+	Cursor  string `json:"cursor"`
+	HasMore bool   `json:"has_more"`
+}
+
+// errDropboxReset is returned when Dropbox no longer accepts a cursor.
+var errDropboxReset = errors.New("dropbox: cursor has to be reset")
+
+// ListChanges lists the folder's changes since cursor. Deleted entries are
+// left out.
+func (ds *Dropbox) ListChanges(client *http.Client, folder, cursor string) ([]RemoteEntry, string, error) {
+	var entries []RemoteEntry
+	var result dropboxListResult
+	var err error
+	if cursor != "" {
+		err = ds.rpc(client, "/2/files/list_folder/continue", map[string]any{"cursor": cursor}, &result)
+		if errors.Is(err, errDropboxReset) {
+			cursor = ""
+		}
+	}
+	if cursor == "" {
+		result = dropboxListResult{}
+		err = ds.rpc(client, "/2/files/list_folder", map[string]any{"path": folder}, &result)
+	}
+	for err == nil {
+		for _, entry := range result.Entries {
+			if entry.Tag != "file" && entry.Tag != "folder" {
+				continue
+			}
+			entries = append(entries, RemoteEntry{
+				ID:     entry.ID,
+				Name:   entry.Name,
+				Path:   entry.PathDisplay,
+				Rev:    entry.Rev,
+				Folder: entry.Tag == "folder",
+				Size:   entry.Size,
+			})
+		}
+		if !result.HasMore {
+			return entries, result.Cursor, nil
+		}
+		cursor = result.Cursor
+		result = dropboxListResult{}
+		err = ds.rpc(client, "/2/files/list_folder/continue", map[string]any{"cursor": cursor}, &result)
+	}
+	return nil, "", fmt.Errorf("list dropbox folder %q: %w", folder, err)
+}
+
+func (ds *Dropbox) Download(client *http.Client, entry RemoteEntry) (io.ReadCloser, error) {
+	file := entry.Path
+	arg, err := json.Marshal(map[string]any{"path": file})
+	if err != nil {
+		return nil, fmt.Errorf("download %q from dropbox: %w", file, err)
+	}
+	req, err := http.NewRequest(http.MethodPost, ds.contentURL()+"/2/files/download", nil)
+	if err != nil {
+		return nil, fmt.Errorf("download %q from dropbox: %w", file, err)
+	}
+	// Content endpoints take their arguments in a header, as the body is
+	// the file itself. Non-ASCII characters must be escaped there, which
+	// encoding/json does not do.
+	req.Header.Set("Dropbox-API-Arg", asciiJSON(arg))
+	resp, err := ds.do(client, req)
+	if err != nil {
+		return nil, fmt.Errorf("download %q from dropbox: %w", file, err)
+	}
+	return resp.Body, nil
+}
+
+// rpc calls an API endpoint, which takes and returns JSON.
+func (ds *Dropbox) rpc(client *http.Client, endpoint string, arg, result any) error {
+	body, err := json.Marshal(arg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, ds.apiURL()+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := ds.do(client, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// do sends the request and turns Dropbox's error responses into errors.
+// Missing paths are reported as ErrNotFound, rejected tokens as ErrReconnect
+// and expired cursors as errDropboxReset.
+func (ds *Dropbox) do(client *http.Client, req *http.Request) (*http.Response, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	var dbxErr struct {
+		Summary string `json:"error_summary"`
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if json.Unmarshal(body, &dbxErr) != nil || dbxErr.Summary == "" {
+		dbxErr.Summary = strings.TrimSpace(string(body))
+	}
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		return nil, fmt.Errorf("dropbox: %w: %s", ErrReconnect, dbxErr.Summary)
+	case resp.StatusCode == http.StatusConflict && strings.Contains(dbxErr.Summary, "not_found"):
+		return nil, fmt.Errorf("dropbox: %w: %s", ErrNotFound, dbxErr.Summary)
+	case resp.StatusCode == http.StatusConflict && strings.HasPrefix(dbxErr.Summary, "reset"):
+		return nil, errDropboxReset
+	}
+	return nil, fmt.Errorf("dropbox: %v: %s", resp.Status, dbxErr.Summary)
+}
+
+func (ds *Dropbox) apiURL() string {
+	if ds.APIURL == "" {
+		return DefaultDropboxAPIURL
+	}
+	return strings.TrimSuffix(ds.APIURL, "/")
+}
+
+func (ds *Dropbox) contentURL() string {
+	if ds.ContentURL == "" {
+		return DefaultDropboxContentURL
+	}
+	return strings.TrimSuffix(ds.ContentURL, "/")
+}
+
+// asciiJSON escapes the non-ASCII characters of a JSON document as \uXXXX.
+func asciiJSON(b []byte) string {
+	var sb strings.Builder
+	for _, r := range string(b) {
+		if r < 0x80 {
+			sb.WriteRune(r)
+			continue
+		}
+		if r > 0xFFFF {
+			r1, r2 := utf16.EncodeRune(r)
+			fmt.Fprintf(&sb, `\u%04x\u%04x`, r1, r2)
+			continue
+		}
+		fmt.Fprintf(&sb, `\u%04x`, r)
+	}
+	return sb.String()
+}
@@ -0,0 +1,280 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDropbox serves a folder whose listing comes in two pages, followed by
+// the cursor "page2" and ending with the cursor "done". The cursor "expired"
+// is answered with a reset.
+type fakeDropbox struct {
+	files map[string][]byte
+
+	mu sync.Mutex
+	// calls are the endpoints called, in order.
+	calls []string
+	// apiArgs are the Dropbox-API-Arg headers downloads were sent with.
+	apiArgs []string
+}
+
+func newFakeDropbox(t *testing.T) (*fakeDropbox, *Dropbox) {
+	fake := &fakeDropbox{files: make(map[string][]byte)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, &Dropbox{APIURL: server.URL, ContentURL: server.URL + "/"}
+}
+
+type fakeDropboxEntry struct {
+	Tag         string `json:".tag"`
+	ID          string `json:"id,omitempty"`
+	Name        string `json:"name"`
+	PathDisplay string `json:"path_display"`
+	Rev         string `json:"rev,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+}
+
+func (f *fakeDropbox) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.calls = append(f.calls, r.URL.Path)
+	f.mu.Unlock()
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error_summary": "invalid_access_token/"}`)
+		return
+	}
+	switch r.URL.Path {
+	case "/2/files/list_folder":
+		f.listPage(w, "")
+	case "/2/files/list_folder/continue":
+		var arg struct {
+			Cursor string `json:"cursor"`
+		}
+		json.NewDecoder(r.Body).Decode(&arg)
+		switch arg.Cursor {
+		case "page2":
+			f.listPage(w, "page2")
+		case "done":
+			f.listPage(w, "done")
+		default:
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, `{"error_summary": "reset/..."}`)
+		}
+	case "/2/files/download":
+		arg := r.Header.Get("Dropbox-API-Arg")
+		f.mu.Lock()
+		f.apiArgs = append(f.apiArgs, arg)
+		f.mu.Unlock()
+		var file struct {
+			Path string `json:"path"`
+		}
+		err := json.Unmarshal([]byte(arg), &file)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		contents, ok := f.files[file.Path]
+		if !ok {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, `{"error_summary": "path/not_found/..."}`)
+			return
+		}
+		w.Write(contents)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// listPage lists the files in two pages. After the last page, listing from
+// "done" returns only a deleted entry.
+func (f *fakeDropbox) listPage(w http.ResponseWriter, cursor string) {
+	var result struct {
+		Entries []fakeDropboxEntry `json:"entries"`
+		Cursor  string             `json:"cursor"`
+		HasMore bool               `json:"has_more"`
+	}
+	switch cursor {
+	case "":
+		result.Entries = []fakeDropboxEntry{
+			{Tag: "folder", ID: "id:sub", Name: "Sub", PathDisplay: "/Photos/Sub"},
+			{Tag: "file", ID: "id:1", Name: "Été 🌅.jpg", PathDisplay: "/Photos/Été 🌅.jpg", Rev: "r1", Size: int64(len(f.files["/Photos/Été 🌅.jpg"]))},
+		}
+		result.Cursor = "page2"
+		result.HasMore = true
+	case "page2":
+		result.Entries = []fakeDropboxEntry{
+			{Tag: "deleted", Name: "old.jpg", PathDisplay: "/Photos/old.jpg"},
+			{Tag: "file", ID: "id:2", Name: "notes.txt", PathDisplay: "/Photos/notes.txt", Rev: "r2", Size: 5},
+		}
+		result.Cursor = "done"
+	case "done":
+		result.Entries = []fakeDropboxEntry{
+			{Tag: "deleted", Name: "notes.txt", PathDisplay: "/Photos/notes.txt"},
+		}
+		result.Cursor = "done"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// bearer is a client that sends the token the fake accepts.
+func bearer(token string) *http.Client {
+	return &http.Client{Transport: bearerTransport(token)}
+}
+
+type bearerTransport string
+
+func (token bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+string(token))
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func entryPaths(entries []RemoteEntry) string {
+	var paths []string
+	for _, entry := range entries {
+		paths = append(paths, entry.Path)
+	}
+	return strings.Join(paths, ", ")
+}
+
+func TestDropboxListChanges(t *testing.T) {
+	const allPaths = "/Photos/Sub, /Photos/Été 🌅.jpg, /Photos/notes.txt"
+	tests := []struct {
+		name      string
+		cursor    string
+		wantPaths string
+		wantCalls string
+	}{
+		{
+			name:      "full listing follows has_more",
+			cursor:    "",
+			wantPaths: allPaths,
+			wantCalls: "/2/files/list_folder /2/files/list_folder/continue",
+		},
+		{
+			name:      "changes skip deleted entries",
+			cursor:    "done",
+			wantPaths: "",
+			wantCalls: "/2/files/list_folder/continue",
+		},
+		{
+			name:      "reset lists everything again",
+			cursor:    "expired",
+			wantPaths: allPaths,
+			wantCalls: "/2/files/list_folder/continue /2/files/list_folder /2/files/list_folder/continue",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fake, dropbox := newFakeDropbox(t)
+			entries, cursor, err := dropbox.ListChanges(bearer("token"), "/Photos", tc.cursor)
+			if err != nil {
+				t.Fatalf("ListChanges: %v", err)
+			}
+			if got := entryPaths(entries); got != tc.wantPaths {
+				t.Errorf("entries = %v, want %v", got, tc.wantPaths)
+			}
+			if cursor != "done" {
+				t.Errorf("cursor = %q, want %q", cursor, "done")
+			}
+			if got := strings.Join(fake.calls, " "); got != tc.wantCalls {
+				t.Errorf("calls = %v, want %v", got, tc.wantCalls)
+			}
+		})
+	}
+
+	t.Run("rejected token", func(t *testing.T) {
+		_, dropbox := newFakeDropbox(t)
+		_, _, err := dropbox.ListChanges(bearer("revoked"), "/Photos", "")
+		if !errors.Is(err, ErrReconnect) {
+			t.Errorf("ListChanges error = %v, want ErrReconnect", err)
+		}
+	})
+}
+
+func TestDropboxDownload(t *testing.T) {
+	fake, dropbox := newFakeDropbox(t)
+	fake.files["/Photos/Été 🌅.jpg"] = []byte("contents")
+
+	rc, err := dropbox.Download(bearer("token"), RemoteEntry{Path: "/Photos/Été 🌅.jpg"})
+	if err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "contents" {
+		t.Errorf("Download = %q, want %q", data, "contents")
+	}
+	// Headers are sent as ASCII, so the path has to be escaped, with the
+	// emoji as a surrogate pair.
+	want := `{"path":"/Photos/\u00c9t\u00e9 \ud83c\udf05.jpg"}`
+	if len(fake.apiArgs) != 1 || fake.apiArgs[0] != want {
+		t.Errorf("Dropbox-API-Arg = %q, want %q", fake.apiArgs, want)
+	}
+
+	_, err = dropbox.Download(bearer("token"), RemoteEntry{Path: "/Photos/missing.jpg"})
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Download error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestImportFolder(t *testing.T) {
+	db := testDB(t)
+	fake, dropbox := newFakeDropbox(t)
+	var encoded bytes.Buffer
+	err := jpeg.Encode(&encoded, testImage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.files["/Photos/Été 🌅.jpg"] = encoded.Bytes()
+
+	users := UserService{DB: db}
+	user, err := users.Create(fmt.Sprintf("import-folder-%d@example.com", time.Now().UnixNano()), "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := GalleryService{DB: db, Store: &DiskStore{Dir: t.TempDir()}}
+	gallery, err := service.Create("Dropbox", user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := service.ImportFolder(dropbox, bearer("token"), gallery.ID, user.ID, "/Photos")
+	if err != nil {
+		t.Fatalf("ImportFolder: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("ImportFolder results = %+v, want the image and notes.txt", results)
+	}
+	if results[0].Err != nil || results[0].Image == nil || results[0].Image.Filename != "Été 🌅.jpg" {
+		t.Errorf("image result = %+v", results[0])
+	}
+	if results[1].Name != "notes.txt" || results[1].Err == nil {
+		t.Errorf("notes.txt result = %+v, want an error", results[1])
+	}
+	if len(fake.apiArgs) != 1 {
+		t.Errorf("downloads = %q, want only the image", fake.apiArgs)
+	}
+
+	images, err := service.Images(gallery.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images[0].Filename != "Été 🌅.jpg" || images[0].UploadedBy != user.ID {
+		t.Errorf("Images = %+v, want the imported image", images)
+	}
+}
@@ -2,6 +2,7 @@ package models
 
 import (
 	"fmt"
+	"html"
 
 	"github.com/go-mail/mail/v2"
 )
@@ -106,3 +107,22 @@ func (es *EmailService) ForgotPassword(to, resetURL string) error {
 	}
 	return nil
 }
+
+// InviteCollaborator tells someone that a gallery has been shared with them.
+// They get access by following acceptURL, which only works once.
+func (es *EmailService) InviteCollaborator(to, inviter, galleryTitle string, role Role, acceptURL string) error {
+	intro := fmt.Sprintf("%s has shared the gallery \"%s\" with you as a %s.", inviter, galleryTitle, role)
+	accept := "Open this link to accept, signing in or signing up first if you need to: "
+	email := Email{
+		Subject:   fmt.Sprintf("%s shared \"%s\" with you", inviter, galleryTitle),
+		To:        to,
+		Plaintext: intro + "\n\n" + accept + acceptURL,
+		HTML: "<p>" + html.EscapeString(intro) + "</p><p>" + html.EscapeString(accept) +
+			`<a href="` + html.EscapeString(acceptURL) + `">` + html.EscapeString(acceptURL) + "</a></p>",
+	}
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("invite collaborator email: %w", err)
+	}
+	return nil
+}
@@ -11,6 +11,15 @@ import (
 var (
 	ErrNotFound   = errors.New("models: resource could not be found")
 	ErrEmailTaken = errors.New("models: email address is already in use")
+	// ErrUploadOffset is returned when a chunk does not start where the
+	// resumable upload left off.
+	ErrUploadOffset = errors.New("models: upload offset does not match")
+	// ErrReconnect is returned when the token of an account connected with
+	// OAuth has expired or been revoked, and the user has to connect it again.
+	ErrReconnect = errors.New("models: account has to be connected again")
+	// ErrIdentityTaken is returned when an account at a provider users sign
+	// in with is already linked to someone else.
+	ErrIdentityTaken = errors.New("models: identity is linked to another user")
 )
 
 type FileError struct {
@@ -21,6 +30,16 @@ func (fe FileError) Error() string {
 	return fmt.Sprintf("invalid file: %v", fe.Issue)
 }
 
+// ValidationError is returned when user input is rejected. Issue is suitable
+// for showing to the user.
+type ValidationError struct {
+	Issue string
+}
+
+func (ve ValidationError) Error() string {
+	return fmt.Sprintf("invalid input: %v", ve.Issue)
+}
+
 // 由于seek在读取前几位后(魔数)重置文件，以验证图像类型是否有效，这限制的图像类型
 // 为了支持在DropBox中对应的所有图像类型，应当改进这一点
 // 一种解决
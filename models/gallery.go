@@ -1,37 +1,133 @@
 package models
 
 import (
+	"Gallery/rand"
 	"bytes"
+	"crypto/subtle"
 	"database/sql"
 	"errors"
 	"fmt"
 	"io"
-	"io/fs"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/jackc/pgtype"
 )
 
 type Image struct {
-	GalleryID int
-	Path      string
-	Filename  string
+	ID          int
+	GalleryID   int
+	Filename    string
+	ContentType string
+	Size        int64
+	// UploadedBy is the ID of the user that uploaded the image, or 0 if that
+	// user no longer exists.
+	UploadedBy int
+	Position   int
+	CreatedAt  time.Time
+	Metadata   ImageMetadata
+	// BlobHash is the SHA-256 of the stored bytes. It is empty for images
+	// uploaded before content-addressed storage was introduced.
+	BlobHash string
+	// DeletedAt is set while the image is in the trash.
+	DeletedAt time.Time
+	Caption   string
+	AltText   string
+	Tags      []string
 }
 
 type Gallery struct {
 	ID     int
 	UserID int
 	Title  string
+	// Description is shown above the gallery's images.
+	Description string
+	// KeepMetadata disables stripping of GPS and other identifying metadata
+	// from images uploaded to the gallery.
+	KeepMetadata bool
+	// Visibility is the visibility that applies to the gallery, either its
+	// own or the one inherited from its collection.
+	Visibility Visibility
+	// VisibilityOverride is the visibility set on the gallery itself. It is
+	// empty when the gallery inherits the visibility of its collection.
+	VisibilityOverride Visibility
+	// CollectionID is the collection the gallery is in, or 0.
+	CollectionID int
+	// ShareToken is the secret used in the share URL of unlisted galleries.
+	ShareToken string
+	// CommentsDisabled stops new comments on the gallery and its images.
+	// Existing comments are still shown.
+	CommentsDisabled bool
+	// Proofing lets viewers pick favourites and submit them as a selection.
+	Proofing bool
+	// CoverImageID is the image chosen to represent the gallery, or 0.
+	CoverImageID int
+	// Cover is the filename of the image shown for the gallery in lists:
+	// the cover image, or the first image if no cover is set. It is only
+	// filled in by ByUserIDPage, and empty for galleries without images.
+	Cover     string
+	CreatedAt time.Time
+	// DeletedAt is set while the gallery is in the trash.
+	DeletedAt time.Time
+}
+
+// Visibility controls who can view a gallery and its images.
+type Visibility string
+
+const (
+	// VisibilityPrivate galleries can only be viewed by their owner.
+	VisibilityPrivate Visibility = "private"
+	// VisibilityUnlisted galleries can be viewed by anyone with the share URL.
+	VisibilityUnlisted Visibility = "unlisted"
+	// VisibilityPublic galleries can be viewed by anyone.
+	VisibilityPublic Visibility = "public"
+
+	// ShareTokenBytes is the number of random bytes in a share token.
+	ShareTokenBytes = 32
+)
+
+// ParseVisibility validates a visibility submitted by a user.
+func ParseVisibility(s string) (Visibility, bool) {
+	switch v := Visibility(s); v {
+	case VisibilityPrivate, VisibilityUnlisted, VisibilityPublic:
+		return v, true
+	}
+	return "", false
+}
+
+// CanView reports whether a viewer may see the gallery. userID is 0 for
+// anonymous viewers and shareToken is the token presented in the URL, if any.
+func (gallery *Gallery) CanView(userID int, shareToken string) bool {
+	switch {
+	case userID != 0 && userID == gallery.UserID:
+		return true
+	case gallery.Visibility == VisibilityPublic:
+		return true
+	case gallery.Visibility == VisibilityUnlisted:
+		return gallery.ShareToken != "" &&
+			subtle.ConstantTimeCompare([]byte(gallery.ShareToken), []byte(shareToken)) == 1
+	}
+	return false
 }
 
 type GalleryService struct {
 	DB *sql.DB
 
-	// ImagesDir is used to tell the GalleryService where to store and locate images.
-	// If not set, the GalleryService will default to using the "images" directory
+	// Store holds the image bytes. If not set, the GalleryService will default
+	// to a DiskStore rooted at ImagesDir.
+	Store ImageStore
+
+	// ImagesDir is used to tell the GalleryService where to store and locate images
+	// when no Store is set. If not set, the GalleryService will default to using
+	// the "images" directory
 	ImagesDir string
+
+	// Quotas is used to enforce per-user limits. If not set, nothing is limited.
+	Quotas *QuotaService
 }
 
 func (service *GalleryService) Create(title string, userID int) (*Gallery, error) {
@@ -39,10 +135,30 @@ func (service *GalleryService) Create(title string, userID int) (*Gallery, error
 		Title:  title,
 		UserID: userID,
 	}
-	row := service.DB.QueryRow(`
-	INSERT INTO galleries (title, user_id)
-	VALUES ($1, $2) RETURNING id;`, gallery.Title, gallery.UserID)
-	err := row.Scan(&gallery.ID) // Scan用于赋值
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("create gallery: %w", err)
+	}
+	defer tx.Rollback()
+	if service.Quotas != nil {
+		err = service.Quotas.checkGallery(tx, userID)
+		if err != nil {
+			return nil, fmt.Errorf("create gallery: %w", err)
+		}
+	}
+	gallery.ShareToken, err = rand.String(ShareTokenBytes)
+	if err != nil {
+		return nil, fmt.Errorf("create gallery: %w", err)
+	}
+	row := tx.QueryRow(`
+	INSERT INTO galleries (title, user_id, share_token)
+	VALUES ($1, $2, $3) RETURNING id, gallery_visibility(visibility, collection_id);`,
+		gallery.Title, gallery.UserID, gallery.ShareToken)
+	err = row.Scan(&gallery.ID, &gallery.Visibility) // Scan用于赋值
+	if err != nil {
+		return nil, fmt.Errorf("create gallery: %w", err)
+	}
+	err = tx.Commit()
 	if err != nil {
 		return nil, fmt.Errorf("create gallery: %w", err)
 	}
@@ -53,25 +169,33 @@ func (service *GalleryService) ByID(id int) (*Gallery, error) {
 	gallery := Gallery{
 		ID: id,
 	}
+	var shareToken sql.NullString
 	row := service.DB.QueryRow(`
-	SELECT title, user_id
+	SELECT title, description, user_id, keep_metadata, share_token,
+		gallery_visibility(visibility, collection_id), COALESCE(visibility, ''), COALESCE(collection_id, 0),
+		comments_disabled, proofing, COALESCE(cover_image_id, 0)
 	FROM galleries
-	WHERE id = $1;`, gallery.ID)
-	err := row.Scan(&gallery.Title, &gallery.UserID)
+	WHERE id = $1 AND deleted_at IS NULL;`, gallery.ID)
+	err := row.Scan(&gallery.Title, &gallery.Description, &gallery.UserID, &gallery.KeepMetadata, &shareToken,
+		&gallery.Visibility, &gallery.VisibilityOverride, &gallery.CollectionID, &gallery.CommentsDisabled,
+		&gallery.Proofing, &gallery.CoverImageID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, ErrNotFound
 		}
 		return nil, fmt.Errorf("query gallery by id: %w", err)
 	}
+	gallery.ShareToken = shareToken.String
 	return &gallery, nil
 }
 
 func (service *GalleryService) ByUserID(userID int) ([]Gallery, error) {
 	rows, err := service.DB.Query(`
-	SELECT id, title
+	SELECT id, title, gallery_visibility(visibility, collection_id), COALESCE(visibility, ''),
+		COALESCE(collection_id, 0)
 	FROM galleries
-	WHERE user_id = $1;`, userID)
+	WHERE user_id = $1 AND deleted_at IS NULL
+	ORDER BY title, id;`, userID)
 	if err != nil {
 		return nil, fmt.Errorf("query galleries by user: %w", err)
 	}
@@ -80,7 +204,8 @@ func (service *GalleryService) ByUserID(userID int) ([]Gallery, error) {
 		gallery := Gallery{
 			UserID: userID,
 		}
-		err := rows.Scan(&gallery.ID, &gallery.Title)
+		err := rows.Scan(&gallery.ID, &gallery.Title, &gallery.Visibility, &gallery.VisibilityOverride,
+			&gallery.CollectionID)
 		if err != nil {
 			return nil, fmt.Errorf("query galleries by user: %w", err)
 		}
@@ -92,72 +217,180 @@ func (service *GalleryService) ByUserID(userID int) ([]Gallery, error) {
 	return galleries, nil
 }
 
+// Update saves the gallery's settings, including its VisibilityOverride, and
+// updates Visibility to match.
 func (service *GalleryService) Update(gallery *Gallery) error {
-	_, err := service.DB.Exec(`
+	if gallery.ShareToken == "" {
+		token, err := rand.String(ShareTokenBytes)
+		if err != nil {
+			return fmt.Errorf("update gallery: %w", err)
+		}
+		gallery.ShareToken = token
+	}
+	row := service.DB.QueryRow(`
 	UPDATE galleries
-	SET title = $2
-	WHERE id = $1;`, gallery.ID, gallery.Title)
+	SET title = $2, description = $3, keep_metadata = $4, visibility = NULLIF($5, ''), share_token = $6,
+		comments_disabled = $7, proofing = $8
+	WHERE id = $1
+	RETURNING gallery_visibility(visibility, collection_id);`,
+		gallery.ID, gallery.Title, gallery.Description, gallery.KeepMetadata, gallery.VisibilityOverride,
+		gallery.ShareToken, gallery.CommentsDisabled, gallery.Proofing)
+	err := row.Scan(&gallery.Visibility)
 	if err != nil {
 		return fmt.Errorf("update gallery: %w", err)
 	}
 	return nil
 }
 
-func (service *GalleryService) Delete(id int) error {
+// ResetShareToken replaces the share token, invalidating the old share URL.
+func (service *GalleryService) ResetShareToken(gallery *Gallery) error {
+	token, err := rand.String(ShareTokenBytes)
+	if err != nil {
+		return fmt.Errorf("reset share token: %w", err)
+	}
+	_, err = service.DB.Exec(`
+	UPDATE galleries
+	SET share_token = $2
+	WHERE id = $1;`, gallery.ID, token)
+	if err != nil {
+		return fmt.Errorf("reset share token: %w", err)
+	}
+	gallery.ShareToken = token
+	return nil
+}
+
+// purgeGallery permanently removes the gallery. Its images and uploads are
+// removed by the database cascade, and the triggers on those tables queue
+// their stored objects for CleanupStorage.
+func (service *GalleryService) purgeGallery(id int) error {
 	_, err := service.DB.Exec(`
 	DELETE FROM galleries
 	WHERE id = $1;`, id)
 	if err != nil {
-		return fmt.Errorf("delete gallery by id: %w", err)
-	}
-	err = os.RemoveAll(service.galleryDIR(id))
-	if err != nil {
-		return fmt.Errorf("delete gallery images: %w", err)
+		return fmt.Errorf("purge gallery: %w", err)
 	}
 	return nil
 }
 
-func (service GalleryService) galleryDIR(id int) string {
+func (service *GalleryService) store() ImageStore {
+	if service.Store != nil {
+		return service.Store
+	}
 	imagesDir := service.ImagesDir
 	if imagesDir == "" {
 		imagesDir = "images"
 	}
-	return filepath.Join(imagesDir, fmt.Sprintf("gallery-%d", id))
+	return &DiskStore{Dir: imagesDir}
+}
+
+func (service *GalleryService) galleryPrefix(id int) string {
+	return fmt.Sprintf("gallery-%d/", id)
+}
+
+func (service *GalleryService) imageKey(galleryID int, filename string) string {
+	return service.galleryPrefix(galleryID) + filename
+}
+
+// imageColumns is the column list read by scanImage.
+const imageColumns = `id, gallery_id, filename, content_type, size, COALESCE(uploaded_by, 0), position, created_at,
+	taken_at, camera_make, camera_model, lens, exposure_time, f_number, iso, focal_length, orientation,
+	COALESCE(blob_hash, ''), deleted_at, caption, alt_text, tags`
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanImage(row scanner) (Image, error) {
+	var image Image
+	var takenAt, deletedAt sql.NullTime
+	var tags pgtype.TextArray
+	err := row.Scan(&image.ID, &image.GalleryID, &image.Filename, &image.ContentType, &image.Size,
+		&image.UploadedBy, &image.Position, &image.CreatedAt,
+		&takenAt, &image.Metadata.CameraMake, &image.Metadata.CameraModel, &image.Metadata.Lens,
+		&image.Metadata.ExposureTime, &image.Metadata.FNumber, &image.Metadata.ISO,
+		&image.Metadata.FocalLength, &image.Metadata.Orientation, &image.BlobHash, &deletedAt,
+		&image.Caption, &image.AltText, &tags)
+	if err != nil {
+		return image, err
+	}
+	image.Metadata.TakenAt = takenAt.Time
+	image.DeletedAt = deletedAt.Time
+	err = tags.AssignTo(&image.Tags)
+	return image, err
 }
 
 func (service *GalleryService) Images(galleryID int) ([]Image, error) {
-	globPattern := filepath.Join(service.galleryDIR(galleryID), "*") // 创建某个路径，用于包含全部图片
-	allFiles, err := filepath.Glob(globPattern)                      // 依据globPattern读取所有图片的路径
+	images, err := service.queryImages(`
+	SELECT `+imageColumns+`
+	FROM images
+	WHERE gallery_id = $1 AND deleted_at IS NULL
+	ORDER BY position, id;`, galleryID)
 	if err != nil {
-		return nil, fmt.Errorf("retrieving gallery images: %w", err)
+		return nil, fmt.Errorf("query gallery images: %w", err)
 	}
+	return images, nil
+}
+
+// queryImages runs a query selecting imageColumns and scans every row.
+func (service *GalleryService) queryImages(query string, args ...any) ([]Image, error) {
+	rows, err := service.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 	var images []Image
-	for _, file := range allFiles {
-		if hasExtension(file, service.extensions()) {
-			images = append(images, Image{
-				GalleryID: galleryID,
-				Path:      file,
-				Filename:  filepath.Base(file),
-			})
+	for rows.Next() {
+		image, err := scanImage(rows)
+		if err != nil {
+			return nil, err
 		}
+		images = append(images, image)
 	}
-	return images, nil
+	return images, rows.Err()
 }
 
 func (service *GalleryService) Image(galleryID int, filename string) (Image, error) {
-	imagePath := filepath.Join(service.galleryDIR(galleryID), filename)
-	_, err := os.Stat(imagePath)
+	row := service.DB.QueryRow(`
+	SELECT `+imageColumns+`
+	FROM images
+	WHERE gallery_id = $1 AND filename = $2 AND deleted_at IS NULL;`, galleryID, filename)
+	image, err := scanImage(row)
 	if err != nil {
-		if errors.Is(err, fs.ErrNotExist) {
+		if errors.Is(err, sql.ErrNoRows) {
 			return Image{}, ErrNotFound
 		}
-		return Image{}, fmt.Errorf("querying for image %w", err)
+		return Image{}, fmt.Errorf("querying for image: %w", err)
 	}
-	return Image{
-		Filename:  filename,
-		GalleryID: galleryID,
-		Path:      imagePath,
-	}, nil
+	return image, nil
+}
+
+// OpenImage returns a reader for the stored bytes of image. If size is not the
+// zero value, the matching variant is returned instead, falling back to the
+// original when the image is too small to have one. Seeking fetches the rest of
+// the object from the new position. The caller must close it.
+func (service *GalleryService) OpenImage(image Image, size ImageSize) (io.ReadSeekCloser, ObjectInfo, error) {
+	if size.Width > 0 {
+		key := service.variantKey(image.BlobHash, size.Width)
+		if image.BlobHash == "" {
+			key = service.legacyVariantKey(image.GalleryID, size.Width, image.Filename)
+		}
+		rc, info, err := openObject(service.store(), key)
+		if err == nil {
+			return rc, info, nil
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return nil, ObjectInfo{}, fmt.Errorf("open image: %w", err)
+		}
+	}
+	key := service.blobKey(image.BlobHash)
+	if image.BlobHash == "" {
+		key = service.imageKey(image.GalleryID, image.Filename)
+	}
+	rc, info, err := openObject(service.store(), key)
+	if err != nil {
+		return nil, ObjectInfo{}, fmt.Errorf("open image: %w", err)
+	}
+	return rc, info, nil
 }
 
 func hasExtension(file string, extensions []string) bool {
@@ -171,6 +404,12 @@ func hasExtension(file string, extensions []string) bool {
 	return false
 }
 
+// IsImageFilename reports whether filename has the extension of an image
+// that can be uploaded.
+func (service *GalleryService) IsImageFilename(filename string) bool {
+	return hasExtension(filename, service.extensions())
+}
+
 func (service *GalleryService) extensions() []string {
 	return []string{".png", ".jpg", ".jpeg", ".gif"}
 }
@@ -179,40 +418,75 @@ func (service *GalleryService) imageContentTypes() []string {
 	return []string{"image/png", "image/jpeg", "image/gif"}
 }
 
-func (service *GalleryService) DeleteImage(galleryID int, filename string) error {
-	image, err := service.Image(galleryID, filename)
+// purgeImage permanently removes the images row. A trigger releases its blob
+// and queues any objects that are no longer needed for CleanupStorage.
+func (service *GalleryService) purgeImage(imageID int) error {
+	result, err := service.DB.Exec(`
+	DELETE FROM images
+	WHERE id = $1;`, imageID)
 	if err != nil {
-		return fmt.Errorf("deleting image: %w", err)
+		return fmt.Errorf("purge image: %w", err)
 	}
-	err = os.Remove(image.Path)
+	return requireRow(result, "purge image")
+}
+
+func (service *GalleryService) deleteLegacyImage(galleryID int, filename string) error {
+	err := service.store().Delete(service.imageKey(galleryID, filename))
 	if err != nil {
-		return fmt.Errorf("deleting image: %w", err)
+		return err
+	}
+	for _, size := range ImageSizes {
+		err = service.store().Delete(service.legacyVariantKey(galleryID, size.Width, filename))
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func (service *GalleryService) CreateImage(galleryID int, filename string, contents io.Reader) error {
+// CreateImage validates the upload, writes the contents to the image store
+// and records it in the images table. The row is only committed once the
+// store has accepted the upload, so a failure part way through never leaves a
+// row without a file, and a file without a row is cleaned up (see cleanup.go).
+//
+// The bytes are stored once per distinct SHA-256 hash (see blob.go), so the
+// same photo uploaded twice only takes up space once. Uploading a filename
+// that already exists in the gallery stores the image under a unique name
+// such as "photo-1.jpg" instead of replacing the existing one.
+//
+// EXIF, IPTC and XMP metadata is read into Image.Metadata. Unless the gallery
+// has KeepMetadata set, GPS data, serial numbers and other identifying tags are
+// stripped from the stored file.
+func (service *GalleryService) CreateImage(galleryID, uploaderID int, filename string, contents io.Reader) (*Image, error) {
 	// 1. Capture the bytes read during the check
 	readBytes, err := checkContentType(contents, service.imageContentTypes())
 	if err != nil {
-		return fmt.Errorf("creating image %v: %w", filename, err)
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
 	}
 	err = checkExtension(filename, service.extensions())
 	if err != nil {
-		return fmt.Errorf("creating image %v: %w", filename, err)
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
 	}
 
-	galleryDir := service.galleryDIR(galleryID)
-	err = os.MkdirAll(galleryDir, 0755)
-	if err != nil {
-		return fmt.Errorf("creating gallery-%d images directory: %w", galleryID, err)
+	image := Image{
+		GalleryID:   galleryID,
+		Filename:    filename,
+		ContentType: http.DetectContentType(readBytes),
+		UploadedBy:  uploaderID,
 	}
-	imagePath := filepath.Join(galleryDir, filename)
-	dst, err := os.Create(imagePath)
+
+	var keepMetadata bool
+	row := service.DB.QueryRow(`
+	SELECT keep_metadata
+	FROM galleries
+	WHERE id = $1;`, galleryID)
+	err = row.Scan(&keepMetadata)
 	if err != nil {
-		return fmt.Errorf("creating image file: %w", err)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("creating image %v: %w", filename, ErrNotFound)
+		}
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
 	}
-	defer dst.Close()
 
 	// 2. Merge the read bytes and the leftover bytes into a single io.Reader using io.MultiReader
 	completeFile := io.MultiReader( // 将多个s合并为1个，容易读取字节并将整个文件合并
@@ -220,23 +494,241 @@ func (service *GalleryService) CreateImage(galleryID int, filename string, conte
 		contents,
 	)
 
-	//3. Copy that file into the destination
-	_, err = io.Copy(dst, completeFile)
+	//3. Spool the upload to a temporary file so it can be inspected more than
+	// once and its size is known before it is handed to the store. No more
+	// than the largest allowed file is spooled.
+	maxSize, err := service.maxFileSize(galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	tmp, err := spoolTemp(io.LimitReader(completeFile, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	defer removeTemp(tmp)
+	info, err := tmp.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	if info.Size() > maxSize {
+		return nil, fmt.Errorf("creating image %v: %w", filename, fileTooLarge(maxSize))
+	}
+	image.Metadata = readMetadata(tmp, image.ContentType)
+	if !keepMetadata {
+		_, err = tmp.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, fmt.Errorf("creating image %v: %w", filename, err)
+		}
+		stripped, err := os.CreateTemp("", "gallery-upload-*")
+		if err != nil {
+			return nil, fmt.Errorf("creating image %v: %w", filename, err)
+		}
+		defer removeTemp(stripped)
+		err = stripMetadata(stripped, tmp, image.ContentType)
+		if err != nil {
+			return nil, fmt.Errorf("creating image %v: %w", filename, FileError{Issue: err.Error()})
+		}
+		tmp = stripped
+	}
+	image.Size, err = tmp.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+
+	hash, err := hashContents(tmp)
 	if err != nil {
-		return fmt.Errorf("copying contents to image: %w", err)
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	image.BlobHash = hash
+
+	// Turn away uploads over quota before the work of storing them. The
+	// quota is checked again when the row is inserted.
+	if service.Quotas != nil {
+		err = service.Quotas.precheckImage(galleryID, image.Size)
+		if err != nil {
+			return nil, fmt.Errorf("creating image %v: %w", filename, err)
+		}
+	}
+	// The blob is stored before the transaction that inserts the row, so that
+	// generating variants and writing to the store hold no locks. It is
+	// stored again if it was cleaned up in between.
+	for attempt := 1; ; attempt++ {
+		cleanupID, err := service.uploadBlob(hash, image.ContentType, image.Metadata.Orientation, tmp, image.Size)
+		if err != nil {
+			return nil, fmt.Errorf("creating image %v: %w", filename, err)
+		}
+		err = service.insertNewImage(&image, cleanupID)
+		if errors.Is(err, errBlobGone) && attempt < 2 {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("creating image %v: %w", filename, err)
+		}
+		return &image, nil
+	}
+}
+
+// insertNewImage records an image whose blob has been stored by uploadBlob,
+// once the owner's quota allows it.
+func (service *GalleryService) insertNewImage(image *Image, cleanupID int64) error {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if service.Quotas != nil {
+		err = service.Quotas.checkImage(tx, image.GalleryID, image.Size)
+		if err != nil {
+			return err
+		}
+	}
+	err = service.referenceBlob(tx, cleanupID, image.BlobHash, image.Size, image.ContentType)
+	if err != nil {
+		return err
+	}
+	err = service.insertImage(tx, image)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertImage inserts the images row, picking a unique filename within the
+// gallery by appending "-1", "-2", ... to the base name on collisions.
+func (service *GalleryService) insertImage(tx *sql.Tx, image *Image) error {
+	ext := filepath.Ext(image.Filename)
+	base := strings.TrimSuffix(image.Filename, ext)
+	meta := image.Metadata
+	for i := 0; i < 1000; i++ {
+		filename := image.Filename
+		if i > 0 {
+			filename = fmt.Sprintf("%s-%d%s", base, i, ext)
+		}
+		row := tx.QueryRow(`
+		INSERT INTO images (gallery_id, filename, content_type, size, uploaded_by, position, blob_hash,
+			taken_at, camera_make, camera_model, lens, exposure_time, f_number, iso, focal_length, orientation)
+		VALUES ($1, $2, $3, $4, NULLIF($5, 0),
+			(SELECT COALESCE(MAX(position), 0) + 1 FROM images WHERE gallery_id = $1), $6,
+			$7, $8, $9, $10, $11, $12, $13, $14, $15)
+		ON CONFLICT (gallery_id, filename) DO NOTHING
+		RETURNING id, position, created_at;`,
+			image.GalleryID, filename, image.ContentType, image.Size, image.UploadedBy, image.BlobHash,
+			nullTime(meta.TakenAt), meta.CameraMake, meta.CameraModel, meta.Lens, meta.ExposureTime,
+			meta.FNumber, meta.ISO, meta.FocalLength, meta.Orientation)
+		err := row.Scan(&image.ID, &image.Position, &image.CreatedAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue // The name is taken; try the next one.
+		}
+		if err != nil {
+			return fmt.Errorf("insert image: %w", err)
+		}
+		image.Filename = filename
+		return nil
+	}
+	return fmt.Errorf("insert image: no free filename for %v", image.Filename)
+}
+
+// putBlob stores a new blob and its variants. Variants are generated first so
+// a file that cannot be decoded is rejected before anything is stored.
+func (service *GalleryService) putBlob(hash, contentType string, orientation int, contents io.ReadSeeker, size int64) error {
+	_, err := contents.Seek(0, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("put blob: %w", err)
+	}
+	err = service.createVariants(hash, contentType, orientation, contents)
+	if err != nil {
+		return fmt.Errorf("put blob: %w", err)
+	}
+	_, err = contents.Seek(0, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("put blob: %w", err)
+	}
+	err = service.store().Put(service.blobKey(hash), contents, size, contentType)
+	if err != nil {
+		service.deleteVariants(hash)
+		return fmt.Errorf("put blob: %w", err)
 	}
 	return nil
 }
 
-func (service *GalleryService) CreateImageViaURL(galleryID int, url string) error {
+// spoolTemp copies r into a new temporary file, leaving the file positioned
+// at the start. Use removeTemp to clean it up.
+func spoolTemp(r io.Reader) (*os.File, error) {
+	tmp, err := os.CreateTemp("", "gallery-upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("spool: %w", err)
+	}
+	_, err = io.Copy(tmp, r)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		removeTemp(tmp)
+		return nil, fmt.Errorf("spool: %w", err)
+	}
+	return tmp, nil
+}
+
+func removeTemp(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+func (service *GalleryService) CreateImageViaURL(galleryID, uploaderID int, url string) (*Image, error) {
 	filename := path.Base(url)
+	maxSize, err := service.maxFileSize(galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("downloading image: %w", err)
+	}
 	resp, err := http.Get(url)
 	if err != nil {
-		return fmt.Errorf("downloading image: %w", err)
+		return nil, fmt.Errorf("downloading image: %w", err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("downloading image: invalid status code %d", resp.StatusCode)
+		return nil, fmt.Errorf("downloading image: invalid status code %d", resp.StatusCode)
+	}
+	// CreateImage stops reading once the limit is passed, but there is no
+	// need to start if the server says the file is too large.
+	if resp.ContentLength > maxSize {
+		return nil, fmt.Errorf("downloading image %v: %w", filename, fileTooLarge(maxSize))
+	}
+	return service.CreateImage(galleryID, uploaderID, filename, resp.Body)
+}
+
+// maxFileSize returns the size of the largest image that can be added to the
+// gallery: its owner's MaxFileSize quota, and never more than MaxUploadSize.
+func (service *GalleryService) maxFileSize(galleryID int) (int64, error) {
+	maxSize := int64(MaxUploadSize)
+	if service.Quotas == nil {
+		return maxSize, nil
+	}
+	var ownerID int
+	row := service.DB.QueryRow(`
+	SELECT user_id
+	FROM galleries
+	WHERE id = $1;`, galleryID)
+	err := row.Scan(&ownerID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrNotFound
+		}
+		return 0, fmt.Errorf("max file size: %w", err)
+	}
+	quota, err := service.Quotas.forUser(service.DB, ownerID)
+	if err != nil {
+		return 0, fmt.Errorf("max file size: %w", err)
+	}
+	if quota.MaxFileSize > 0 && quota.MaxFileSize < maxSize {
+		maxSize = quota.MaxFileSize
 	}
-	return service.CreateImage(galleryID, filename, resp.Body)
+	return maxSize, nil
 }
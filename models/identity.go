@@ -0,0 +1,202 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+)
+
+// Identity is a user's account at a provider they sign in with.
+type Identity struct {
+	ID       int
+	UserID   int
+	Provider string
+	// Subject is the provider's ID for the account.
+	Subject string
+	// Email is the account's email address when it was last used.
+	Email     string
+	CreatedAt time.Time
+}
+
+type IdentityService struct {
+	DB *sql.DB
+}
+
+// SignIn returns the user the provider account signs in. An account used for
+// the first time creates a user without a password, or is linked to the user
+// with its email address if both the provider and we have verified it. Anyone
+// could have signed up with an address we have not verified, so a
+// ValidationError is returned instead; the owner can sign in with their
+// password and link the account.
+func (is *IdentityService) SignIn(provider string, claims *IDClaims) (*User, error) {
+	tx, err := is.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("sign in with %v: %w", provider, err)
+	}
+	defer tx.Rollback()
+
+	user := User{}
+	row := tx.QueryRow(`
+	UPDATE user_identities
+	SET email = $3
+	FROM users
+	WHERE user_identities.provider = $1 AND user_identities.subject = $2
+		AND users.id = user_identities.user_id
+	RETURNING users.id, users.email, users.password_hash;`, provider, claims.Subject, claims.Email)
+	err = row.Scan(&user.ID, &user.Email, &user.PasswordHash)
+	if err == nil {
+		err = tx.Commit()
+		if err != nil {
+			return nil, fmt.Errorf("sign in with %v: %w", provider, err)
+		}
+		return &user, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("sign in with %v: %w", provider, err)
+	}
+
+	// Anyone can claim any email address at some providers, so an account is
+	// only ever matched to a user by an address the provider has checked.
+	if claims.Email == "" || !claims.EmailVerified {
+		return nil, fmt.Errorf("sign in with %v: %w", provider, ValidationError{
+			Issue: "your account there has no verified email address",
+		})
+	}
+	row = tx.QueryRow(`
+	INSERT INTO users (email, password_hash, email_verified)
+	VALUES ($1, '', true)
+	ON CONFLICT (email) DO UPDATE
+	SET email = EXCLUDED.email
+	WHERE users.email_verified
+	RETURNING id, email, password_hash;`, claims.Email)
+	err = row.Scan(&user.ID, &user.Email, &user.PasswordHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("sign in with %v: %w", provider, ValidationError{
+			Issue: "an account with your email address already exists. Sign in with your password, then link your account from the account page",
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sign in with %v: %w", provider, err)
+	}
+	_, err = tx.Exec(`
+	INSERT INTO user_identities (user_id, provider, subject, email)
+	VALUES ($1, $2, $3, $4);`, user.ID, provider, claims.Subject, claims.Email)
+	if err != nil {
+		if isUniqueViolation(err) {
+			// The user already has another account at the provider.
+			return nil, fmt.Errorf("sign in with %v: %w", provider, ErrIdentityTaken)
+		}
+		return nil, fmt.Errorf("sign in with %v: %w", provider, err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("sign in with %v: %w", provider, err)
+	}
+	return &user, nil
+}
+
+// Link lets the user sign in with the provider account. ErrIdentityTaken is
+// returned if the account is linked to another user, or the user already has
+// another account at the provider.
+func (is *IdentityService) Link(userID int, provider string, claims *IDClaims) (*Identity, error) {
+	identity := Identity{
+		UserID:   userID,
+		Provider: provider,
+		Subject:  claims.Subject,
+		Email:    claims.Email,
+	}
+	// Linking the same account again only updates its email address.
+	row := is.DB.QueryRow(`
+	INSERT INTO user_identities (user_id, provider, subject, email)
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (provider, subject) DO UPDATE
+	SET email = EXCLUDED.email
+	WHERE user_identities.user_id = EXCLUDED.user_id
+	RETURNING id, created_at;`, userID, provider, claims.Subject, claims.Email)
+	err := row.Scan(&identity.ID, &identity.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) || isUniqueViolation(err) {
+			return nil, ErrIdentityTaken
+		}
+		return nil, fmt.Errorf("link identity: %w", err)
+	}
+	return &identity, nil
+}
+
+// ByUserID returns the provider accounts linked to the user.
+func (is *IdentityService) ByUserID(userID int) ([]Identity, error) {
+	rows, err := is.DB.Query(`
+	SELECT id, provider, subject, email, created_at
+	FROM user_identities
+	WHERE user_id = $1
+	ORDER BY provider;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("query identities: %w", err)
+	}
+	defer rows.Close()
+	var identities []Identity
+	for rows.Next() {
+		identity := Identity{
+			UserID: userID,
+		}
+		err = rows.Scan(&identity.ID, &identity.Provider, &identity.Subject, &identity.Email, &identity.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("query identities: %w", err)
+		}
+		identities = append(identities, identity)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query identities: %w", err)
+	}
+	return identities, nil
+}
+
+// Unlink stops the user signing in with their account at the provider. A
+// ValidationError is returned if it is their only way to sign in.
+func (is *IdentityService) Unlink(userID int, provider string) error {
+	result, err := is.DB.Exec(`
+	DELETE FROM user_identities
+	WHERE user_id = $1 AND provider = $2
+		AND EXISTS (
+			SELECT 1
+			FROM users
+			WHERE users.id = $1 AND (users.password_hash <> '' OR EXISTS (
+				SELECT 1
+				FROM user_identities others
+				WHERE others.user_id = $1 AND others.provider <> $2)));`, userID, provider)
+	if err != nil {
+		return fmt.Errorf("unlink identity: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("unlink identity: %w", err)
+	}
+	if n > 0 {
+		return nil
+	}
+	var linked bool
+	row := is.DB.QueryRow(`
+	SELECT EXISTS (
+		SELECT 1
+		FROM user_identities
+		WHERE user_id = $1 AND provider = $2);`, userID, provider)
+	err = row.Scan(&linked)
+	if err != nil {
+		return fmt.Errorf("unlink identity: %w", err)
+	}
+	if !linked {
+		return ErrNotFound
+	}
+	return fmt.Errorf("unlink identity: %w", ValidationError{
+		Issue: "set a password or link another account first, so that you can still sign in",
+	})
+}
+
+func isUniqueViolation(err error) bool {
+	var pgError *pgconn.PgError
+	return errors.As(err, &pgError) && pgError.Code == pgerrcode.UniqueViolation
+}
@@ -0,0 +1,111 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jackc/pgtype"
+)
+
+// Images can be given a caption, alt text for screen readers and free-form
+// tags that viewers can filter a gallery by.
+
+const (
+	MaxCaptionLength = 2000
+	MaxAltTextLength = 500
+	MaxTags          = 30
+	MaxTagLength     = 50
+)
+
+// ParseTags splits a comma separated list of tags. Tags are trimmed and
+// lowercased so that "Beach" and "beach " are the same tag, and duplicates
+// are dropped.
+func ParseTags(s string) ([]string, error) {
+	tags := []string{}
+	seen := make(map[string]bool)
+	for _, tag := range strings.Split(s, ",") {
+		tag = strings.ToLower(strings.Join(strings.Fields(tag), " "))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if utf8.RuneCountInString(tag) > MaxTagLength {
+			return nil, ValidationError{
+				Issue: fmt.Sprintf("tags can be at most %d characters", MaxTagLength),
+			}
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	if len(tags) > MaxTags {
+		return nil, ValidationError{
+			Issue: fmt.Sprintf("an image can have at most %d tags", MaxTags),
+		}
+	}
+	return tags, nil
+}
+
+// UpdateImageDetails saves the caption, alt text and tags of the image.
+func (service *GalleryService) UpdateImageDetails(image *Image) error {
+	image.Caption = strings.TrimSpace(image.Caption)
+	image.AltText = strings.TrimSpace(image.AltText)
+	if utf8.RuneCountInString(image.Caption) > MaxCaptionLength {
+		return fmt.Errorf("update image details: %w", ValidationError{
+			Issue: fmt.Sprintf("captions can be at most %d characters", MaxCaptionLength),
+		})
+	}
+	if utf8.RuneCountInString(image.AltText) > MaxAltTextLength {
+		return fmt.Errorf("update image details: %w", ValidationError{
+			Issue: fmt.Sprintf("alt text can be at most %d characters", MaxAltTextLength),
+		})
+	}
+	if image.Tags == nil {
+		image.Tags = []string{}
+	}
+	var tags pgtype.TextArray
+	err := tags.Set(image.Tags)
+	if err != nil {
+		return fmt.Errorf("update image details: %w", err)
+	}
+	result, err := service.DB.Exec(`
+	UPDATE images
+	SET caption = $2, alt_text = $3, tags = $4
+	WHERE id = $1 AND deleted_at IS NULL;`, image.ID, image.Caption, image.AltText, &tags)
+	if err != nil {
+		return fmt.Errorf("update image details: %w", err)
+	}
+	return requireRow(result, "update image details")
+}
+
+// Tags returns every tag used in the gallery along with the number of images
+// that have it, sorted by name.
+func (service *GalleryService) Tags(galleryID int) ([]TagCount, error) {
+	rows, err := service.DB.Query(`
+	SELECT tag, COUNT(*)
+	FROM images, unnest(tags) AS tag
+	WHERE gallery_id = $1 AND deleted_at IS NULL
+	GROUP BY tag
+	ORDER BY tag;`, galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("query gallery tags: %w", err)
+	}
+	defer rows.Close()
+	var tags []TagCount
+	for rows.Next() {
+		var tag TagCount
+		err = rows.Scan(&tag.Tag, &tag.Images)
+		if err != nil {
+			return nil, fmt.Errorf("query gallery tags: %w", err)
+		}
+		tags = append(tags, tag)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query gallery tags: %w", err)
+	}
+	return tags, nil
+}
+
+type TagCount struct {
+	Tag    string
+	Images int
+}
@@ -0,0 +1,298 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ObjectInfo describes a single object held by an ImageStore.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	LastModified time.Time
+}
+
+// ImageStore is the storage backend used by the GalleryService for image
+// bytes. Keys are slash separated paths such as "gallery-1/photo.jpg".
+// Implementations return ErrNotFound when a key does not exist. Delete and
+// DeletePrefix must not fail when there is nothing to delete.
+type ImageStore interface {
+	Put(key string, contents io.Reader, size int64, contentType string) error
+	Get(key string) (io.ReadCloser, ObjectInfo, error)
+	// GetRange is like Get, but reads from offset to the end of the object.
+	GetRange(key string, offset int64) (io.ReadCloser, error)
+	Stat(key string) (ObjectInfo, error)
+	Delete(key string) error
+	List(prefix string) ([]ObjectInfo, error)
+	DeletePrefix(prefix string) error
+}
+
+// DiskStore is an ImageStore that keeps objects as files below Dir. This is
+// only suitable when a single server instance is running.
+type DiskStore struct {
+	Dir string
+}
+
+func (ds *DiskStore) path(key string) (string, error) {
+	cleaned := path.Clean("/" + key)
+	if key == "" || cleaned != "/"+key {
+		return "", fmt.Errorf("disk store: invalid key %q", key)
+	}
+	return filepath.Join(ds.Dir, filepath.FromSlash(key)), nil
+}
+
+func (ds *DiskStore) Put(key string, contents io.Reader, size int64, contentType string) error {
+	dstPath, err := ds.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(dstPath), 0755)
+	if err != nil {
+		return fmt.Errorf("disk store put: %w", err)
+	}
+	// Write to a temporary file in the same directory and rename it into place
+	// so readers never see a partially written object.
+	dst, err := os.CreateTemp(filepath.Dir(dstPath), ".put-*")
+	if err != nil {
+		return fmt.Errorf("disk store put: %w", err)
+	}
+	defer os.Remove(dst.Name())
+	_, err = io.Copy(dst, contents)
+	if err != nil {
+		dst.Close()
+		return fmt.Errorf("disk store put: %w", err)
+	}
+	err = dst.Close()
+	if err != nil {
+		return fmt.Errorf("disk store put: %w", err)
+	}
+	err = os.Rename(dst.Name(), dstPath)
+	if err != nil {
+		return fmt.Errorf("disk store put: %w", err)
+	}
+	return nil
+}
+
+func (ds *DiskStore) Get(key string) (io.ReadCloser, ObjectInfo, error) {
+	p, err := ds.path(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ObjectInfo{}, ErrNotFound
+		}
+		return nil, ObjectInfo{}, fmt.Errorf("disk store get: %w", err)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, ObjectInfo{}, fmt.Errorf("disk store get: %w", err)
+	}
+	return f, ds.info(key, stat), nil
+}
+
+func (ds *DiskStore) GetRange(key string, offset int64) (io.ReadCloser, error) {
+	rc, _, err := ds.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	_, err = rc.(*os.File).Seek(offset, io.SeekStart)
+	if err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("disk store get range: %w", err)
+	}
+	return rc, nil
+}
+
+func (ds *DiskStore) Stat(key string) (ObjectInfo, error) {
+	p, err := ds.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	stat, err := os.Stat(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return ObjectInfo{}, ErrNotFound
+		}
+		return ObjectInfo{}, fmt.Errorf("disk store stat: %w", err)
+	}
+	return ds.info(key, stat), nil
+}
+
+func (ds *DiskStore) Delete(key string) error {
+	p, err := ds.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("disk store delete: %w", err)
+	}
+	return nil
+}
+
+func (ds *DiskStore) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := ds.walk(prefix, func(key string, d fs.DirEntry) error {
+		stat, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, ds.info(key, stat))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("disk store list: %w", err)
+	}
+	return objects, nil
+}
+
+func (ds *DiskStore) DeletePrefix(prefix string) error {
+	// A prefix naming a whole directory can be removed in one go, which also
+	// cleans up the (now empty) directory itself.
+	if strings.HasSuffix(prefix, "/") {
+		p, err := ds.path(strings.TrimSuffix(prefix, "/"))
+		if err != nil {
+			return err
+		}
+		err = os.RemoveAll(p)
+		if err != nil {
+			return fmt.Errorf("disk store delete prefix: %w", err)
+		}
+		return nil
+	}
+	err := ds.walk(prefix, func(key string, d fs.DirEntry) error {
+		return ds.Delete(key)
+	})
+	if err != nil {
+		return fmt.Errorf("disk store delete prefix: %w", err)
+	}
+	return nil
+}
+
+// walk calls fn for every regular file whose key starts with prefix. Only the
+// deepest directory named by the prefix is walked.
+func (ds *DiskStore) walk(prefix string, fn func(key string, d fs.DirEntry) error) error {
+	root := ds.Dir
+	if dir := path.Dir(prefix); dir != "." && dir != "/" {
+		p, err := ds.path(dir)
+		if err != nil {
+			return err
+		}
+		root = p
+	}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() || strings.HasPrefix(d.Name(), ".put-") {
+			return nil
+		}
+		rel, err := filepath.Rel(ds.Dir, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		return fn(key, d)
+	})
+	return err
+}
+
+func (ds *DiskStore) info(key string, stat fs.FileInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:          key,
+		Size:         stat.Size(),
+		ContentType:  mime.TypeByExtension(path.Ext(key)),
+		LastModified: stat.ModTime(),
+	}
+}
+
+// objectReader reads an object from an ImageStore and can seek within it. It
+// starts with the body of a Get, and only requests the rest of the object from
+// a new offset when a read follows a seek elsewhere, so serving the whole
+// object still takes a single request.
+type objectReader struct {
+	store ImageStore
+	key   string
+	size  int64
+
+	body    io.ReadCloser
+	bodyPos int64
+	pos     int64
+}
+
+// openObject opens the object for reading and seeking.
+func openObject(store ImageStore, key string) (*objectReader, ObjectInfo, error) {
+	body, info, err := store.Get(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return &objectReader{
+		store: store,
+		key:   key,
+		size:  info.Size,
+		body:  body,
+	}, info, nil
+}
+
+func (r *objectReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if r.body != nil && r.bodyPos != r.pos {
+		r.body.Close()
+		r.body = nil
+	}
+	if r.body == nil {
+		body, err := r.store.GetRange(r.key, r.pos)
+		if err != nil {
+			return 0, err
+		}
+		r.body, r.bodyPos = body, r.pos
+	}
+	n, err := r.body.Read(p)
+	r.bodyPos += int64(n)
+	r.pos += int64(n)
+	return n, err
+}
+
+func (r *objectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, fmt.Errorf("object reader: invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("object reader: negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *objectReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	return r.body.Close()
+}
@@ -0,0 +1,216 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Images uploaded before the images table existed are only files at
+// gallery-N/filename, and those uploaded before blobs existed have a row with
+// no blob_hash. Both are moved into blobs at startup so that every image can
+// be listed, copied and served the same way.
+
+// ImportLegacyImages stores every legacy image as a blob, creating its images
+// row if it has none, and removes the legacy file once the row points at the
+// blob. Later runs find nothing left to import. Files that cannot be imported
+// are left where they are and reported in the error.
+func (service *GalleryService) ImportLegacyImages() error {
+	var errs []error
+	rows, err := service.DB.Query(`
+	SELECT id, gallery_id, filename
+	FROM images
+	WHERE blob_hash IS NULL;`)
+	if err != nil {
+		return fmt.Errorf("import legacy images: %w", err)
+	}
+	var unhashed []Image
+	for rows.Next() {
+		var image Image
+		err = rows.Scan(&image.ID, &image.GalleryID, &image.Filename)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("import legacy images: %w", err)
+		}
+		unhashed = append(unhashed, image)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("import legacy images: %w", err)
+	}
+	for _, image := range unhashed {
+		err = service.importLegacyImage(image.GalleryID, image.Filename, func(tx *sql.Tx, imported *Image) error {
+			result, err := tx.Exec(`
+			UPDATE images
+			SET blob_hash = $2
+			WHERE id = $1 AND blob_hash IS NULL;`, image.ID, imported.BlobHash)
+			if err != nil {
+				return err
+			}
+			return requireRow(result, "set blob hash")
+		})
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	galleries, err := service.DB.Query(`
+	SELECT id, user_id
+	FROM galleries;`)
+	if err != nil {
+		return fmt.Errorf("import legacy images: %w", err)
+	}
+	owners := make(map[int]int)
+	for galleries.Next() {
+		var id, userID int
+		err = galleries.Scan(&id, &userID)
+		if err != nil {
+			galleries.Close()
+			return fmt.Errorf("import legacy images: %w", err)
+		}
+		owners[id] = userID
+	}
+	galleries.Close()
+	if err := galleries.Err(); err != nil {
+		return fmt.Errorf("import legacy images: %w", err)
+	}
+	for galleryID, ownerID := range owners {
+		filenames, err := service.unlistedLegacyImages(galleryID)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, filename := range filenames {
+			err = service.importLegacyImage(galleryID, filename, func(tx *sql.Tx, imported *Image) error {
+				imported.UploadedBy = ownerID
+				return service.insertImage(tx, imported)
+			})
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// unlistedLegacyImages returns the images stored directly below the gallery's
+// prefix that have no images row. Variants live further down and are skipped.
+func (service *GalleryService) unlistedLegacyImages(galleryID int) ([]string, error) {
+	prefix := service.galleryPrefix(galleryID)
+	objects, err := service.store().List(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("list legacy images: %w", err)
+	}
+	var filenames []string
+	for _, object := range objects {
+		filename := strings.TrimPrefix(object.Key, prefix)
+		if strings.Contains(filename, "/") || !service.IsImageFilename(filename) {
+			continue
+		}
+		var exists bool
+		row := service.DB.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1
+			FROM images
+			WHERE gallery_id = $1 AND filename = $2);`, galleryID, filename)
+		err = row.Scan(&exists)
+		if err != nil {
+			return nil, fmt.Errorf("list legacy images: %w", err)
+		}
+		if !exists {
+			filenames = append(filenames, filename)
+		}
+	}
+	return filenames, nil
+}
+
+// importLegacyImage stores the file at gallery-N/filename as a blob and calls
+// attach to point an images row at it in the transaction that references it. The file is
+// kept as it was uploaded, metadata included, since it has been served that
+// way all along.
+func (service *GalleryService) importLegacyImage(galleryID int, filename string, attach func(tx *sql.Tx, image *Image) error) error {
+	rc, _, err := service.store().Get(service.imageKey(galleryID, filename))
+	if err != nil {
+		return fmt.Errorf("import legacy image gallery-%d/%v: %w", galleryID, filename, err)
+	}
+	tmp, err := spoolTemp(rc)
+	rc.Close()
+	if err != nil {
+		return fmt.Errorf("import legacy image gallery-%d/%v: %w", galleryID, filename, err)
+	}
+	defer removeTemp(tmp)
+
+	image := Image{
+		GalleryID: galleryID,
+		Filename:  path.Base(filename),
+	}
+	head := make([]byte, 512)
+	n, err := io.ReadFull(tmp, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("import legacy image gallery-%d/%v: %w", galleryID, filename, err)
+	}
+	image.ContentType = http.DetectContentType(head[:n])
+	image.Size, err = tmp.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("import legacy image gallery-%d/%v: %w", galleryID, filename, err)
+	}
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("import legacy image gallery-%d/%v: %w", galleryID, filename, err)
+	}
+	image.Metadata = readMetadata(tmp, image.ContentType)
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("import legacy image gallery-%d/%v: %w", galleryID, filename, err)
+	}
+	image.BlobHash, err = hashContents(tmp)
+	if err != nil {
+		return fmt.Errorf("import legacy image gallery-%d/%v: %w", galleryID, filename, err)
+	}
+
+	for attempt := 1; ; attempt++ {
+		cleanupID, err := service.uploadBlob(image.BlobHash, image.ContentType, image.Metadata.Orientation, tmp, image.Size)
+		if err != nil {
+			return fmt.Errorf("import legacy image gallery-%d/%v: %w", galleryID, filename, err)
+		}
+		err = service.attachLegacyImage(&image, cleanupID, attach)
+		if errors.Is(err, errBlobGone) && attempt < 2 {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("import legacy image gallery-%d/%v: %w", galleryID, filename, err)
+		}
+		break
+	}
+
+	// The row no longer refers to the legacy file, so a failure here only
+	// leaves it behind until the gallery is deleted.
+	err = service.deleteLegacyImage(galleryID, filename)
+	if err != nil {
+		return fmt.Errorf("import legacy image gallery-%d/%v: %w", galleryID, filename, err)
+	}
+	return nil
+}
+
+// attachLegacyImage references the blob stored by uploadBlob and points a row
+// at it with attach.
+func (service *GalleryService) attachLegacyImage(image *Image, cleanupID int64, attach func(tx *sql.Tx, image *Image) error) error {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = service.referenceBlob(tx, cleanupID, image.BlobHash, image.Size, image.ContentType)
+	if err != nil {
+		return err
+	}
+	err = attach(tx, image)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,1029 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ImageMetadata holds the camera details extracted from an upload's EXIF,
+// IPTC and XMP data. EXIF wins when the same value appears in several places.
+type ImageMetadata struct {
+	// TakenAt is the capture time, or the zero time if it is unknown.
+	TakenAt     time.Time
+	CameraMake  string
+	CameraModel string
+	Lens        string
+	// ExposureTime is formatted the way photographers write it, eg "1/250".
+	ExposureTime string
+	FNumber      float64
+	ISO          int
+	FocalLength  float64
+	// Orientation is the EXIF orientation (1-8). 1 means no transform is needed.
+	Orientation int
+}
+
+// Camera returns a short human readable summary of the camera settings.
+func (meta ImageMetadata) Camera() string {
+	var parts []string
+	camera := meta.CameraModel
+	if meta.CameraMake != "" && !strings.HasPrefix(camera, meta.CameraMake) {
+		camera = strings.TrimSpace(meta.CameraMake + " " + camera)
+	}
+	if camera != "" {
+		parts = append(parts, camera)
+	}
+	if meta.Lens != "" {
+		parts = append(parts, meta.Lens)
+	}
+	if meta.ExposureTime != "" {
+		parts = append(parts, meta.ExposureTime+"s")
+	}
+	if meta.FNumber > 0 {
+		parts = append(parts, "f/"+strconv.FormatFloat(meta.FNumber, 'f', -1, 64))
+	}
+	if meta.ISO > 0 {
+		parts = append(parts, fmt.Sprintf("ISO %d", meta.ISO))
+	}
+	return strings.Join(parts, " · ")
+}
+
+// EXIF tag numbers used below.
+const (
+	tagMake             = 0x010F
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagDateTime         = 0x0132
+	tagExifIFD          = 0x8769
+	tagExposureTime     = 0x829A
+	tagFNumber          = 0x829D
+	tagISO              = 0x8827
+	tagDateTimeOriginal = 0x9003
+	tagOffsetTimeOrig   = 0x9011
+	tagFocalLength      = 0x920A
+	tagLensModel        = 0xA434
+)
+
+// Only these tags survive when metadata is stripped. Everything else,
+// including the GPS IFD, MakerNote, serial numbers, owner/artist names,
+// comments and the embedded thumbnail, is dropped.
+var (
+	keepIFD0Tags = map[uint16]bool{
+		tagMake: true, tagModel: true, tagOrientation: true,
+		0x011A: true, 0x011B: true, 0x0128: true, // X/YResolution, ResolutionUnit
+		tagDateTime: true, 0x0213: true, // YCbCrPositioning
+	}
+	keepExifTags = map[uint16]bool{
+		tagExposureTime: true, tagFNumber: true, 0x8822: true, tagISO: true, // 0x8822 ExposureProgram
+		0x9000: true, tagDateTimeOriginal: true, 0x9004: true, // ExifVersion, DateTimeDigitized
+		0x9010: true, tagOffsetTimeOrig: true, 0x9012: true, // OffsetTime*
+		0x9201: true, 0x9202: true, 0x9204: true, 0x9207: true, 0x9209: true, // Shutter, Aperture, Bias, Metering, Flash
+		tagFocalLength: true, 0xA001: true, 0xA002: true, 0xA003: true, // ColorSpace, PixelX/YDimension
+		0xA405: true, 0xA433: true, tagLensModel: true, // FocalLengthIn35mm, LensMake
+	}
+)
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	xmpHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	psHeader   = []byte("Photoshop 3.0\x00")
+	pngHeader  = []byte("\x89PNG\r\n\x1a\n")
+)
+
+// readMetadata extracts ImageMetadata from a JPEG or PNG. Malformed metadata
+// is ignored rather than treated as an error; the image itself is validated
+// separately when its variants are generated.
+func readMetadata(r io.Reader, contentType string) ImageMetadata {
+	var meta ImageMetadata
+	var exif, iptc, xmp []byte
+	switch contentType {
+	case "image/jpeg":
+		_ = walkJPEG(r, func(marker byte, payload []byte) bool {
+			switch {
+			case marker == 0xE1 && bytes.HasPrefix(payload, exifHeader) && exif == nil:
+				exif = payload[len(exifHeader):]
+			case marker == 0xE1 && bytes.HasPrefix(payload, xmpHeader) && xmp == nil:
+				xmp = payload[len(xmpHeader):]
+			case marker == 0xED && bytes.HasPrefix(payload, psHeader) && iptc == nil:
+				iptc = payload[len(psHeader):]
+			}
+			return true
+		})
+	case "image/png":
+		_ = walkPNG(r, func(typ string, data []byte) bool {
+			switch {
+			case typ == "eXIf":
+				exif = data
+			case typ == "iTXt" && bytes.HasPrefix(data, []byte("XML:com.adobe.xmp\x00")):
+				// keyword\0, compression flag, method, language\0, translated keyword\0, text
+				rest := data[len("XML:com.adobe.xmp\x00"):]
+				if len(rest) < 2 || rest[0] != 0 {
+					return true // Compressed XMP is not supported.
+				}
+				fields := bytes.SplitN(rest[2:], []byte{0}, 3)
+				if len(fields) == 3 {
+					xmp = fields[2]
+				}
+			}
+			return true
+		})
+	}
+	if exif != nil {
+		if t, err := parseTIFF(exif); err == nil {
+			t.metadata(&meta)
+		}
+	}
+	if iptc != nil {
+		parseIPTC(iptc, &meta)
+	}
+	if xmp != nil {
+		parseXMP(xmp, &meta)
+	}
+	if meta.Orientation < 1 || meta.Orientation > 8 {
+		meta.Orientation = 1
+	}
+	return meta
+}
+
+// stripMetadata copies a JPEG, PNG or GIF from src to dst, removing EXIF,
+// IPTC, XMP and comment data. A minimal EXIF block with the whitelisted tags
+// (camera, exposure, capture time, orientation) is written back so images
+// still display the right way up. Other formats are copied unchanged.
+func stripMetadata(dst io.Writer, src io.Reader, contentType string) error {
+	switch contentType {
+	case "image/jpeg":
+		return stripJPEG(dst, src)
+	case "image/png":
+		return stripPNG(dst, src)
+	case "image/gif":
+		return stripGIF(dst, src)
+	default:
+		_, err := io.Copy(dst, src)
+		return err
+	}
+}
+
+// walkJPEG calls fn for every marker segment before the start of scan. fn
+// returns false to stop early.
+func walkJPEG(r io.Reader, fn func(marker byte, payload []byte) bool) error {
+	br := bufio.NewReader(r)
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return errors.New("not a jpeg")
+	}
+	for {
+		marker, payload, err := readJPEGSegment(br)
+		if err != nil {
+			return err
+		}
+		if marker == 0xDA || !fn(marker, payload) {
+			return nil
+		}
+	}
+}
+
+func readJPEGSegment(br *bufio.Reader) (byte, []byte, error) {
+	b, err := br.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	if b != 0xFF {
+		return 0, nil, errors.New("jpeg: expected marker")
+	}
+	marker := byte(0xFF)
+	for marker == 0xFF { // Markers may be preceded by any number of fill bytes.
+		marker, err = br.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	payload, err := readJPEGPayload(br)
+	if err != nil {
+		return 0, nil, err
+	}
+	return marker, payload, nil
+}
+
+// readJPEGPayload reads the length and payload of the segment whose marker
+// has just been read.
+func readJPEGPayload(br *bufio.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(br, length[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(length[:]))
+	if n < 2 {
+		return nil, errors.New("jpeg: invalid segment length")
+	}
+	payload := make([]byte, n-2)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// copyJPEGScan copies the entropy coded data following a start of scan to dst
+// and returns the marker that ends it. Stuffed zero bytes and restart markers
+// are part of the data.
+func copyJPEGScan(dst io.Writer, br *bufio.Reader) (byte, error) {
+	for {
+		data, err := br.ReadSlice(0xFF)
+		if err == bufio.ErrBufferFull {
+			if _, err := dst.Write(data); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if _, err := dst.Write(data[:len(data)-1]); err != nil {
+			return 0, err
+		}
+		marker, err := br.ReadByte()
+		for err == nil && marker == 0xFF {
+			marker, err = br.ReadByte()
+		}
+		if err != nil {
+			return 0, err
+		}
+		if marker == 0x00 || (marker >= 0xD0 && marker <= 0xD7) {
+			if _, err := dst.Write([]byte{0xFF, marker}); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		return marker, nil
+	}
+}
+
+// keepJPEGSegment reports whether a segment other than EXIF is needed to
+// display the image. Of the application segments only the JFIF header, ICC
+// profiles and Adobe's colour transform are; the rest hold metadata, vendor
+// data and, in APP2 MPF, the index of further images appended to the file.
+func keepJPEGSegment(marker byte, payload []byte) bool {
+	switch {
+	case marker == 0xE0:
+		return bytes.HasPrefix(payload, []byte("JFIF\x00"))
+	case marker == 0xE2:
+		return bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00"))
+	case marker == 0xEE:
+		return bytes.HasPrefix(payload, []byte("Adobe"))
+	case marker >= 0xE0 && marker <= 0xEF, marker == 0xFE:
+		return false
+	}
+	return true
+}
+
+func writeJPEGSegment(w io.Writer, marker byte, payload []byte) error {
+	if len(payload)+2 > math.MaxUint16 {
+		return errors.New("jpeg: segment too large")
+	}
+	header := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(header[2:], uint16(len(payload)+2))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// stripJPEG writes the image up to its end of image marker. Whatever follows,
+// such as the further images of an MPO or a motion photo's video, is dropped
+// along with the metadata they carry.
+func stripJPEG(dst io.Writer, src io.Reader) error {
+	br := bufio.NewReader(src)
+	bw := bufio.NewWriter(dst)
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return errors.New("strip jpeg: not a jpeg")
+	}
+	if _, err := bw.Write(soi[:]); err != nil {
+		return fmt.Errorf("strip jpeg: %w", err)
+	}
+	wroteExif := false
+	marker, payload, err := readJPEGSegment(br)
+	for {
+		if err != nil {
+			return fmt.Errorf("strip jpeg: %w", err)
+		}
+		keep := true
+		switch {
+		case marker == 0xE1 && bytes.HasPrefix(payload, exifHeader):
+			// Only the first valid EXIF block is kept, with its whitelisted
+			// tags.
+			keep = false
+			if t, err := parseTIFF(payload[len(exifHeader):]); err == nil && !wroteExif {
+				keep, wroteExif = true, true
+				payload = append(append([]byte{}, exifHeader...), t.whitelisted()...)
+			}
+		default:
+			keep = keepJPEGSegment(marker, payload)
+		}
+		if keep {
+			err = writeJPEGSegment(bw, marker, payload)
+			if err != nil {
+				return fmt.Errorf("strip jpeg: %w", err)
+			}
+		}
+		if marker != 0xDA {
+			marker, payload, err = readJPEGSegment(br)
+			continue
+		}
+		// The entropy coded data follows the start of scan header, up to
+		// the next scan's tables or the end of the image.
+		marker, err = copyJPEGScan(bw, br)
+		if err != nil {
+			return fmt.Errorf("strip jpeg: %w", err)
+		}
+		if marker == 0xD9 {
+			_, err = bw.Write([]byte{0xFF, 0xD9})
+			if err == nil {
+				err = bw.Flush()
+			}
+			if err != nil {
+				return fmt.Errorf("strip jpeg: %w", err)
+			}
+			return nil
+		}
+		payload, err = readJPEGPayload(br)
+	}
+}
+
+// walkPNG calls fn for every chunk before the image data. fn returns false to
+// stop early.
+func walkPNG(r io.Reader, fn func(typ string, data []byte) bool) error {
+	br := bufio.NewReader(r)
+	sig := make([]byte, len(pngHeader))
+	if _, err := io.ReadFull(br, sig); err != nil || !bytes.Equal(sig, pngHeader) {
+		return errors.New("not a png")
+	}
+	for {
+		typ, data, err := readPNGChunk(br)
+		if err != nil {
+			return err
+		}
+		if typ == "IDAT" || typ == "IEND" || !fn(typ, data) {
+			return nil
+		}
+	}
+}
+
+// maxPNGChunk bounds the metadata chunks read into memory.
+const maxPNGChunk = 64 << 20
+
+func readPNGChunk(br *bufio.Reader) (string, []byte, error) {
+	typ, n, err := readPNGChunkHeader(br)
+	if err != nil {
+		return "", nil, err
+	}
+	if n > maxPNGChunk {
+		return "", nil, errors.New("png: chunk too large")
+	}
+	data := make([]byte, n+4) // Includes the CRC.
+	if _, err := io.ReadFull(br, data); err != nil {
+		return "", nil, err
+	}
+	return typ, data[:n], nil
+}
+
+func readPNGChunkHeader(br *bufio.Reader) (string, uint32, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return "", 0, err
+	}
+	return string(header[4:]), binary.BigEndian.Uint32(header[:4]), nil
+}
+
+func writePNGChunk(w io.Writer, typ string, data []byte) error {
+	buf := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(data)))
+	copy(buf[4:], typ)
+	buf = append(buf, data...)
+	buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf[4:]))
+	_, err := w.Write(buf)
+	return err
+}
+
+// keepPNGChunks are the ancillary chunks that survive stripping: they only
+// affect how the image is displayed. Text, timestamps and private chunks are
+// dropped wherever they appear, including after the image data.
+var keepPNGChunks = map[string]bool{
+	"tRNS": true, "cHRM": true, "gAMA": true, "iCCP": true, "sBIT": true,
+	"sRGB": true, "cICP": true, "mDCv": true, "cLLi": true, "bKGD": true,
+	"hIST": true, "pHYs": true, "sPLT": true,
+	"acTL": true, "fcTL": true, "fdAT": true, // APNG animation
+}
+
+func stripPNG(dst io.Writer, src io.Reader) error {
+	br := bufio.NewReader(src)
+	sig := make([]byte, len(pngHeader))
+	if _, err := io.ReadFull(br, sig); err != nil || !bytes.Equal(sig, pngHeader) {
+		return errors.New("strip png: not a png")
+	}
+	if _, err := dst.Write(sig); err != nil {
+		return fmt.Errorf("strip png: %w", err)
+	}
+	for {
+		typ, n, err := readPNGChunkHeader(br)
+		if err != nil {
+			return fmt.Errorf("strip png: %w", err)
+		}
+		if typ == "IDAT" || typ == "fdAT" {
+			// Image data can be far larger than any metadata, so it is copied
+			// through without being read into memory.
+			header := binary.BigEndian.AppendUint32(nil, n)
+			if _, err := dst.Write(append(header, typ...)); err != nil {
+				return fmt.Errorf("strip png: %w", err)
+			}
+			if _, err := io.CopyN(dst, br, int64(n)+4); err != nil {
+				return fmt.Errorf("strip png: %w", err)
+			}
+			continue
+		}
+		if n > maxPNGChunk {
+			return errors.New("strip png: chunk too large")
+		}
+		data := make([]byte, n+4)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return fmt.Errorf("strip png: %w", err)
+		}
+		data = data[:n]
+		// Chunks starting with a capital letter are critical: decoders cannot
+		// skip them, so neither can we.
+		critical := typ[0] >= 'A' && typ[0] <= 'Z'
+		switch {
+		case typ == "eXIf":
+			t, err := parseTIFF(data)
+			if err != nil {
+				continue
+			}
+			data = t.whitelisted()
+		case !critical && !keepPNGChunks[typ]:
+			continue
+		}
+		err = writePNGChunk(dst, typ, data)
+		if err != nil {
+			return fmt.Errorf("strip png: %w", err)
+		}
+		if typ == "IEND" {
+			return nil
+		}
+	}
+}
+
+var gifHeaders = [][]byte{[]byte("GIF87a"), []byte("GIF89a")}
+
+// gifLoopExtension is the application extension that makes animations loop.
+var gifLoopExtension = []byte("NETSCAPE2.0")
+
+// stripGIF copies a GIF, dropping comment extensions and application
+// extensions, which carry XMP and ICC data among others. Only the loop count of
+// an animation is kept.
+func stripGIF(dst io.Writer, src io.Reader) error {
+	br := bufio.NewReader(src)
+	header := make([]byte, 13) // Signature and logical screen descriptor.
+	if _, err := io.ReadFull(br, header); err != nil ||
+		!(bytes.Equal(header[:6], gifHeaders[0]) || bytes.Equal(header[:6], gifHeaders[1])) {
+		return errors.New("strip gif: not a gif")
+	}
+	if _, err := dst.Write(header); err != nil {
+		return fmt.Errorf("strip gif: %w", err)
+	}
+	if header[10]&0x80 != 0 {
+		if _, err := io.CopyN(dst, br, 3<<(header[10]&0x07+1)); err != nil {
+			return fmt.Errorf("strip gif: global color table: %w", err)
+		}
+	}
+	for {
+		introducer, err := br.ReadByte()
+		if err != nil {
+			return fmt.Errorf("strip gif: %w", err)
+		}
+		switch introducer {
+		case 0x3B: // Trailer
+			_, err = dst.Write([]byte{introducer})
+			if err != nil {
+				return fmt.Errorf("strip gif: %w", err)
+			}
+			return nil
+		case 0x2C: // Image descriptor
+			descriptor := make([]byte, 10) // Includes the LZW code size.
+			descriptor[0] = introducer
+			if _, err := io.ReadFull(br, descriptor[1:]); err != nil {
+				return fmt.Errorf("strip gif: image descriptor: %w", err)
+			}
+			colorTable := int64(0)
+			if descriptor[9]&0x80 != 0 {
+				colorTable = 3 << (descriptor[9]&0x07 + 1)
+			}
+			if _, err := dst.Write(descriptor); err != nil {
+				return fmt.Errorf("strip gif: %w", err)
+			}
+			if _, err := io.CopyN(dst, br, colorTable+1); err != nil {
+				return fmt.Errorf("strip gif: image: %w", err)
+			}
+			if err := copyGIFSubBlocks(dst, br); err != nil {
+				return fmt.Errorf("strip gif: image: %w", err)
+			}
+		case 0x21: // Extension
+			label, err := br.ReadByte()
+			if err != nil {
+				return fmt.Errorf("strip gif: %w", err)
+			}
+			switch label {
+			case 0xFE: // Comment
+				err = copyGIFSubBlocks(io.Discard, br)
+			case 0xFF: // Application
+				err = stripGIFApplication(dst, br)
+			default: // Graphic control and plain text
+				_, err = dst.Write([]byte{introducer, label})
+				if err == nil {
+					err = copyGIFSubBlocks(dst, br)
+				}
+			}
+			if err != nil {
+				return fmt.Errorf("strip gif: extension: %w", err)
+			}
+		default:
+			return fmt.Errorf("strip gif: unknown block %#x", introducer)
+		}
+	}
+}
+
+// copyGIFSubBlocks copies data sub-blocks up to and including the empty block
+// that ends them.
+func copyGIFSubBlocks(dst io.Writer, br *bufio.Reader) error {
+	for {
+		size, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		if _, err := dst.Write([]byte{size}); err != nil {
+			return err
+		}
+		if size == 0 {
+			return nil
+		}
+		if _, err := io.CopyN(dst, br, int64(size)); err != nil {
+			return err
+		}
+	}
+}
+
+// readGIFSubBlock returns the data of the next sub-block, or nil for the empty
+// block that ends them.
+func readGIFSubBlock(br *bufio.Reader) ([]byte, error) {
+	size, err := br.ReadByte()
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(br, data)
+	return data, err
+}
+
+// stripGIFApplication drops an application extension, writing back just the
+// loop count if it is the looping extension.
+func stripGIFApplication(dst io.Writer, br *bufio.Reader) error {
+	identifier, err := readGIFSubBlock(br)
+	if err != nil || identifier == nil {
+		return err
+	}
+	var loop []byte
+	if bytes.Equal(identifier, gifLoopExtension) {
+		loop, err = readGIFSubBlock(br)
+		if err != nil || loop == nil {
+			return err
+		}
+	}
+	err = copyGIFSubBlocks(io.Discard, br)
+	if err != nil {
+		return err
+	}
+	// The loop sub-block is 1 followed by the count.
+	if len(loop) != 3 || loop[0] != 1 {
+		return nil
+	}
+	block := append([]byte{0x21, 0xFF, byte(len(gifLoopExtension))}, gifLoopExtension...)
+	block = append(block, 3, 1, loop[1], loop[2], 0)
+	_, err = dst.Write(block)
+	return err
+}
+
+type tiffEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	data  []byte
+}
+
+type byteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+type tiff struct {
+	order byteOrder
+	ifd0  []tiffEntry
+	exif  []tiffEntry
+}
+
+var tiffTypeSizes = map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+func parseTIFF(b []byte) (*tiff, error) {
+	if len(b) < 8 {
+		return nil, errors.New("tiff: too short")
+	}
+	t := tiff{}
+	switch string(b[:4]) {
+	case "II*\x00":
+		t.order = binary.LittleEndian
+	case "MM\x00*":
+		t.order = binary.BigEndian
+	default:
+		return nil, errors.New("tiff: bad header")
+	}
+	var err error
+	t.ifd0, err = t.readIFD(b, t.order.Uint32(b[4:8]))
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range t.ifd0 {
+		if e.tag == tagExifIFD && len(e.data) == 4 {
+			t.exif, err = t.readIFD(b, t.order.Uint32(e.data))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &t, nil
+}
+
+func (t *tiff) readIFD(b []byte, offset uint32) ([]tiffEntry, error) {
+	if uint64(offset)+2 > uint64(len(b)) {
+		return nil, errors.New("tiff: ifd out of range")
+	}
+	n := uint32(t.order.Uint16(b[offset:]))
+	if uint64(offset)+2+uint64(n)*12 > uint64(len(b)) {
+		return nil, errors.New("tiff: ifd out of range")
+	}
+	entries := make([]tiffEntry, 0, n)
+	for i := uint32(0); i < n; i++ {
+		raw := b[offset+2+i*12:]
+		e := tiffEntry{
+			tag:   t.order.Uint16(raw[0:2]),
+			typ:   t.order.Uint16(raw[2:4]),
+			count: t.order.Uint32(raw[4:8]),
+		}
+		size, ok := tiffTypeSizes[e.typ]
+		if !ok {
+			continue
+		}
+		total := uint64(size) * uint64(e.count)
+		if total <= 4 {
+			e.data = raw[8 : 8+total]
+		} else {
+			valueOffset := uint64(t.order.Uint32(raw[8:12]))
+			if valueOffset+total > uint64(len(b)) {
+				continue
+			}
+			e.data = b[valueOffset : valueOffset+total]
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func (t *tiff) find(entries []tiffEntry, tag uint16) (tiffEntry, bool) {
+	for _, e := range entries {
+		if e.tag == tag {
+			return e, true
+		}
+	}
+	return tiffEntry{}, false
+}
+
+func (t *tiff) str(entries []tiffEntry, tag uint16) string {
+	e, ok := t.find(entries, tag)
+	if !ok || e.typ != 2 {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(e.data), "\x00"))
+}
+
+func (t *tiff) uint(entries []tiffEntry, tag uint16) int {
+	e, ok := t.find(entries, tag)
+	if !ok || len(e.data) == 0 {
+		return 0
+	}
+	switch e.typ {
+	case 3:
+		return int(t.order.Uint16(e.data))
+	case 4:
+		return int(t.order.Uint32(e.data))
+	}
+	return 0
+}
+
+func (t *tiff) rational(entries []tiffEntry, tag uint16) (num, den uint32) {
+	e, ok := t.find(entries, tag)
+	if !ok || (e.typ != 5 && e.typ != 10) || len(e.data) < 8 {
+		return 0, 0
+	}
+	return t.order.Uint32(e.data[:4]), t.order.Uint32(e.data[4:8])
+}
+
+func (t *tiff) metadata(meta *ImageMetadata) {
+	meta.CameraMake = t.str(t.ifd0, tagMake)
+	meta.CameraModel = t.str(t.ifd0, tagModel)
+	meta.Orientation = t.uint(t.ifd0, tagOrientation)
+	meta.Lens = t.str(t.exif, tagLensModel)
+	meta.ISO = t.uint(t.exif, tagISO)
+	if num, den := t.rational(t.exif, tagExposureTime); num > 0 && den > 0 {
+		if num < den {
+			meta.ExposureTime = fmt.Sprintf("1/%d", int(math.Round(float64(den)/float64(num))))
+		} else {
+			meta.ExposureTime = strconv.FormatFloat(float64(num)/float64(den), 'f', -1, 64)
+		}
+	}
+	if num, den := t.rational(t.exif, tagFNumber); den > 0 {
+		meta.FNumber = math.Round(float64(num)/float64(den)*10) / 10
+	}
+	if num, den := t.rational(t.exif, tagFocalLength); den > 0 {
+		meta.FocalLength = math.Round(float64(num)/float64(den)*10) / 10
+	}
+	taken := t.str(t.exif, tagDateTimeOriginal)
+	if taken == "" {
+		taken = t.str(t.ifd0, tagDateTime)
+	}
+	if taken != "" {
+		layout, value := "2006:01:02 15:04:05", taken
+		if offset := t.str(t.exif, tagOffsetTimeOrig); offset != "" {
+			layout, value = layout+"-07:00", taken+offset
+		}
+		if ts, err := time.Parse(layout, value); err == nil {
+			meta.TakenAt = ts
+		}
+	}
+}
+
+// whitelisted re-encodes the TIFF structure keeping only the allowed tags.
+// Values are copied as raw bytes, so the original byte order is kept.
+func (t *tiff) whitelisted() []byte {
+	var ifd0, exif []tiffEntry
+	for _, e := range t.ifd0 {
+		if keepIFD0Tags[e.tag] {
+			ifd0 = append(ifd0, e)
+		}
+	}
+	for _, e := range t.exif {
+		if keepExifTags[e.tag] {
+			exif = append(exif, e)
+		}
+	}
+	if len(exif) > 0 {
+		// Placeholder; the offset is filled in once the layout is known.
+		ifd0 = append(ifd0, tiffEntry{tag: tagExifIFD, typ: 4, count: 1, data: make([]byte, 4)})
+	}
+	sort.Slice(ifd0, func(i, j int) bool { return ifd0[i].tag < ifd0[j].tag })
+	sort.Slice(exif, func(i, j int) bool { return exif[i].tag < exif[j].tag })
+
+	ifdSize := func(entries []tiffEntry) uint32 { return 2 + 12*uint32(len(entries)) + 4 }
+	ifd0Offset := uint32(8)
+	exifOffset := ifd0Offset + ifdSize(ifd0)
+	dataOffset := exifOffset
+	if len(exif) > 0 {
+		dataOffset += ifdSize(exif)
+	}
+
+	header := make([]byte, 8)
+	if t.order == binary.LittleEndian {
+		copy(header, "II*\x00")
+	} else {
+		copy(header, "MM\x00*")
+	}
+	t.order.PutUint32(header[4:], ifd0Offset)
+
+	var data []byte
+	writeIFD := func(entries []tiffEntry) []byte {
+		out := t.order.AppendUint16(nil, uint16(len(entries)))
+		for _, e := range entries {
+			if e.tag == tagExifIFD {
+				t.order.PutUint32(e.data, exifOffset)
+			}
+			out = t.order.AppendUint16(out, e.tag)
+			out = t.order.AppendUint16(out, e.typ)
+			out = t.order.AppendUint32(out, e.count)
+			if len(e.data) <= 4 {
+				value := make([]byte, 4)
+				copy(value, e.data)
+				out = append(out, value...)
+				continue
+			}
+			out = t.order.AppendUint32(out, dataOffset+uint32(len(data)))
+			data = append(data, e.data...)
+			if len(data)%2 == 1 { // Values must start on a word boundary.
+				data = append(data, 0)
+			}
+		}
+		return t.order.AppendUint32(out, 0) // No next IFD, so no thumbnail.
+	}
+	out := append(header, writeIFD(ifd0)...)
+	if len(exif) > 0 {
+		out = append(out, writeIFD(exif)...)
+	}
+	return append(out, data...)
+}
+
+// parseIPTC reads the IPTC-NAA record from a Photoshop image resource block
+// and fills in the capture time if it is still unknown.
+func parseIPTC(b []byte, meta *ImageMetadata) {
+	for len(b) >= 12 && bytes.HasPrefix(b, []byte("8BIM")) {
+		id := binary.BigEndian.Uint16(b[4:6])
+		nameLen := int(b[6])
+		pos := 6 + 1 + nameLen
+		if pos%2 == 1 {
+			pos++
+		}
+		if pos+4 > len(b) {
+			return
+		}
+		size := int(binary.BigEndian.Uint32(b[pos:]))
+		pos += 4
+		if size < 0 || pos+size > len(b) {
+			return
+		}
+		if id == 0x0404 {
+			parseIPTCRecords(b[pos:pos+size], meta)
+			return
+		}
+		pos += size
+		if pos%2 == 1 {
+			pos++
+		}
+		if pos > len(b) {
+			return
+		}
+		b = b[pos:]
+	}
+}
+
+func parseIPTCRecords(b []byte, meta *ImageMetadata) {
+	var date, clock string
+	for len(b) >= 5 && b[0] == 0x1C {
+		record, dataset := b[1], b[2]
+		size := int(binary.BigEndian.Uint16(b[3:5]))
+		if size&0x8000 != 0 || 5+size > len(b) {
+			return // Extended datasets are not used for the fields we read.
+		}
+		value := string(b[5 : 5+size])
+		if record == 2 && dataset == 55 {
+			date = value
+		}
+		if record == 2 && dataset == 60 {
+			clock = value
+		}
+		b = b[5+size:]
+	}
+	if !meta.TakenAt.IsZero() || date == "" {
+		return
+	}
+	for _, layout := range []string{"20060102150405-0700", "20060102150405", "20060102"} {
+		if ts, err := time.Parse(layout, date+clock); err == nil {
+			meta.TakenAt = ts
+			return
+		}
+	}
+}
+
+var (
+	xmpFields = func() map[string]*regexp.Regexp {
+		fields := make(map[string]*regexp.Regexp)
+		for _, name := range []string{"exif:DateTimeOriginal", "xmp:CreateDate", "photoshop:DateCreated",
+			"tiff:Make", "tiff:Model", "aux:Lens", "exifEX:LensModel", "exif:ExposureTime",
+			"exif:FNumber", "exif:ISOSpeedRatings", "exif:FocalLength", "tiff:Orientation"} {
+			quoted := regexp.QuoteMeta(name)
+			fields[name] = regexp.MustCompile(quoted + `="([^"]*)"|<` + quoted + `>(?s:(.*?))</` + quoted + `>`)
+		}
+		return fields
+	}()
+	xmlTag = regexp.MustCompile(`<[^>]*>`)
+)
+
+// xmpValue returns a property written either as an attribute or as an element.
+func xmpValue(xmp []byte, name string) string {
+	m := xmpFields[name].FindSubmatch(xmp)
+	if m == nil {
+		return ""
+	}
+	// Values such as ISO are wrapped in rdf:Seq/rdf:li elements.
+	value := xmlTag.ReplaceAllString(string(m[1])+string(m[2]), " ")
+	return strings.TrimSpace(value)
+}
+
+// parseXMP fills in any fields still missing after EXIF and IPTC.
+func parseXMP(xmp []byte, meta *ImageMetadata) {
+	fill := func(dst *string, names ...string) {
+		for _, name := range names {
+			if *dst != "" {
+				return
+			}
+			*dst = xmpValue(xmp, name)
+		}
+	}
+	fill(&meta.CameraMake, "tiff:Make")
+	fill(&meta.CameraModel, "tiff:Model")
+	fill(&meta.Lens, "exifEX:LensModel", "aux:Lens")
+	fill(&meta.ExposureTime, "exif:ExposureTime")
+	rational := func(s string) float64 {
+		num, den, found := strings.Cut(s, "/")
+		n, err := strconv.ParseFloat(num, 64)
+		if err != nil {
+			return 0
+		}
+		if !found {
+			return n
+		}
+		d, err := strconv.ParseFloat(den, 64)
+		if err != nil || d == 0 {
+			return 0
+		}
+		return math.Round(n/d*10) / 10
+	}
+	if meta.FNumber == 0 {
+		meta.FNumber = rational(xmpValue(xmp, "exif:FNumber"))
+	}
+	if meta.FocalLength == 0 {
+		meta.FocalLength = rational(xmpValue(xmp, "exif:FocalLength"))
+	}
+	if meta.ISO == 0 {
+		meta.ISO, _ = strconv.Atoi(strings.Fields(xmpValue(xmp, "exif:ISOSpeedRatings") + " 0")[0])
+	}
+	if meta.Orientation == 0 {
+		meta.Orientation, _ = strconv.Atoi(xmpValue(xmp, "tiff:Orientation"))
+	}
+	if meta.TakenAt.IsZero() {
+		for _, name := range []string{"exif:DateTimeOriginal", "photoshop:DateCreated", "xmp:CreateDate"} {
+			value := xmpValue(xmp, name)
+			for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02"} {
+				if ts, err := time.Parse(layout, value); err == nil {
+					meta.TakenAt = ts
+					return
+				}
+			}
+		}
+	}
+}
+
+// orient applies an EXIF orientation so the returned image is the right way
+// up. Variants are re-encoded without metadata, so this must be baked in.
+func orient(src image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+	sb := src.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, sb.Dx(), sb.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, sb.Min, draw.Src)
+	w, h := sb.Dx(), sb.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			copy(dst.Pix[dy*dst.Stride+dx*4:dy*dst.Stride+dx*4+4], rgba.Pix[y*rgba.Stride+x*4:])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,314 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// identifying is data planted in the fixtures that must not survive stripping.
+var identifying = []string{
+	"Jane Roe",      // Artist, XMP creator, IPTC byline, PNG author
+	"SN-0042",       // Serial numbers and comments
+	"GPS-SECRET",    // Inside the GPS IFD
+	"51.5007",       // XMP location
+	"xap/1.0",       // XMP packets
+	"Photoshop 3.0", // IPTC resources
+	"XMP DataXMP",   // GIF XMP application extension
+	"private-chunk-data",
+}
+
+type testTag struct {
+	tag, typ uint16
+	data     []byte
+	// ifd, if set, makes the tag point to that IFD.
+	ifd int
+}
+
+func asciiTag(tag uint16, value string) testTag {
+	return testTag{tag: tag, typ: 2, data: append([]byte(value), 0)}
+}
+
+func shortTag(tag uint16, value uint16) testTag {
+	return testTag{tag: tag, typ: 3, data: binary.LittleEndian.AppendUint16(nil, value)}
+}
+
+// encodeTestTIFF lays out the IFDs one after another, followed by the values
+// too large to fit in their entries.
+func encodeTestTIFF(ifds ...[]testTag) []byte {
+	offsets := make([]uint32, len(ifds))
+	pos := uint32(8)
+	for i, ifd := range ifds {
+		offsets[i] = pos
+		pos += 2 + 12*uint32(len(ifd)) + 4
+	}
+	order := binary.LittleEndian
+	out := append([]byte("II*\x00"), 8, 0, 0, 0)
+	var values []byte
+	for _, ifd := range ifds {
+		out = order.AppendUint16(out, uint16(len(ifd)))
+		for _, tag := range ifd {
+			typ, data := tag.typ, tag.data
+			if tag.ifd > 0 {
+				typ, data = 4, order.AppendUint32(nil, offsets[tag.ifd])
+			}
+			out = order.AppendUint16(out, tag.tag)
+			out = order.AppendUint16(out, typ)
+			out = order.AppendUint32(out, uint32(len(data))/tiffTypeSizes[typ])
+			if len(data) <= 4 {
+				out = append(out, append(data, make([]byte, 4-len(data))...)...)
+				continue
+			}
+			out = order.AppendUint32(out, pos+uint32(len(values)))
+			values = append(values, data...)
+		}
+		out = order.AppendUint32(out, 0)
+	}
+	return append(out, values...)
+}
+
+func testEXIF() []byte {
+	return encodeTestTIFF(
+		[]testTag{
+			asciiTag(tagMake, "Canon"),
+			asciiTag(tagModel, "Canon EOS R5"),
+			shortTag(tagOrientation, 6),
+			asciiTag(0x013B, "Jane Roe"),     // Artist
+			asciiTag(0x8298, "(c) Jane Roe"), // Copyright
+			{tag: tagExifIFD, ifd: 1},
+			{tag: 0x8825, ifd: 2}, // GPS IFD
+		},
+		[]testTag{
+			shortTag(tagISO, 200),
+			asciiTag(0xA431, "SN-0042"), // BodySerialNumber
+			asciiTag(0x9286, "SN-0042"), // UserComment
+		},
+		[]testTag{
+			asciiTag(0x0001, "N"),
+			{tag: 0x001B, typ: 7, data: []byte("GPS-SECRET")}, // GPSProcessingMethod
+		},
+	)
+}
+
+const testXMP = `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF><rdf:Description
+ tiff:Make="Canon" exif:GPSLatitude="51.5007N">
+ <dc:creator><rdf:Seq><rdf:li>Jane Roe</rdf:li></rdf:Seq></dc:creator>
+</rdf:Description></rdf:RDF></x:xmpmeta>`
+
+func testImage() image.Image {
+	img := image.NewPaletted(image.Rect(0, 0, 16, 16), palette.Plan9)
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 16), uint8(y * 16), 128, 255})
+		}
+	}
+	return img
+}
+
+func assertStripped(t *testing.T, out []byte) {
+	t.Helper()
+	for _, s := range identifying {
+		if bytes.Contains(out, []byte(s)) {
+			t.Errorf("stripped image still contains %q", s)
+		}
+	}
+}
+
+func TestStripJPEG(t *testing.T) {
+	var encoded bytes.Buffer
+	err := jpeg.Encode(&encoded, testImage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iptc := []byte{0x1C, 2, 80, 0, 8} // By-line
+	iptc = append(iptc, "Jane Roe"...)
+	resource := append([]byte("8BIM\x04\x04\x00\x00"), binary.BigEndian.AppendUint32(nil, uint32(len(iptc)))...)
+	resource = append(resource, iptc...)
+
+	var src bytes.Buffer
+	src.Write(encoded.Bytes()[:2])
+	writeJPEGSegment(&src, 0xE1, append(append([]byte{}, exifHeader...), testEXIF()...))
+	writeJPEGSegment(&src, 0xE1, append(append([]byte{}, xmpHeader...), testXMP...))
+	writeJPEGSegment(&src, 0xED, append(append([]byte{}, psHeader...), resource...))
+	writeJPEGSegment(&src, 0xFE, []byte("Shot by Jane Roe, SN-0042"))
+	src.Write(encoded.Bytes()[2:])
+
+	var out bytes.Buffer
+	err = stripMetadata(&out, bytes.NewReader(src.Bytes()), "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStripped(t, out.Bytes())
+	_, err = jpeg.Decode(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("decoding stripped image: %v", err)
+	}
+	meta := readMetadata(bytes.NewReader(out.Bytes()), "image/jpeg")
+	if meta.CameraMake != "Canon" || meta.Orientation != 6 || meta.ISO != 200 {
+		t.Errorf("whitelisted metadata was not kept: %+v", meta)
+	}
+}
+
+// An MPO or motion photo is a JPEG followed by further images or video after
+// its end of image marker, each with metadata of its own.
+func TestStripJPEGTrailer(t *testing.T) {
+	var encoded bytes.Buffer
+	err := jpeg.Encode(&encoded, testImage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var trailer bytes.Buffer
+	trailer.Write([]byte{0xFF, 0xD8})
+	writeJPEGSegment(&trailer, 0xE1, append(append([]byte{}, exifHeader...), testEXIF()...))
+	trailer.Write(encoded.Bytes()[2:])
+
+	var src bytes.Buffer
+	src.Write(encoded.Bytes()[:2])
+	writeJPEGSegment(&src, 0xE2, []byte("MPF\x00II*\x00SN-0042"))
+	writeJPEGSegment(&src, 0xE3, []byte("vendor data SN-0042"))
+	src.Write(encoded.Bytes()[2:])
+	src.Write(trailer.Bytes())
+
+	var out bytes.Buffer
+	err = stripMetadata(&out, bytes.NewReader(src.Bytes()), "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStripped(t, out.Bytes())
+	if bytes.Contains(out.Bytes(), []byte("MPF")) {
+		t.Error("stripped image still has an MPF segment")
+	}
+	if !bytes.Equal(out.Bytes()[out.Len()-2:], []byte{0xFF, 0xD9}) || out.Len() > encoded.Len() {
+		t.Errorf("stripped image does not end at its end of image marker")
+	}
+	_, err = jpeg.Decode(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("decoding stripped image: %v", err)
+	}
+}
+
+func TestStripPNG(t *testing.T) {
+	var encoded bytes.Buffer
+	err := png.Encode(&encoded, testImage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(bytes.NewReader(encoded.Bytes()[len(pngHeader):]))
+	chunks := make(map[string][]byte)
+	var order []string
+	for {
+		typ, data, err := readPNGChunk(br)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks[typ] = append(chunks[typ], data...)
+		if len(order) == 0 || order[len(order)-1] != typ {
+			order = append(order, typ)
+		}
+		if typ == "IEND" {
+			break
+		}
+	}
+
+	var src bytes.Buffer
+	src.Write(pngHeader)
+	text := func(typ, data string) {
+		writePNGChunk(&src, typ, []byte(data))
+	}
+	for _, typ := range order {
+		if typ == "IEND" {
+			// Metadata after the image data, which decoders still read.
+			text("tEXt", "Comment\x00SN-0042")
+			text("zTXt", "Author\x00\x00not really compressed Jane Roe")
+			text("iTXt", "XML:com.adobe.xmp\x00\x00\x00\x00\x00"+testXMP)
+			text("eXIf", string(testEXIF()))
+			text("tIME", "\x07\xea\x01\x02\x03\x04\x05")
+		}
+		writePNGChunk(&src, typ, chunks[typ])
+		if typ == "IHDR" {
+			text("tEXt", "Author\x00Jane Roe")
+			text("iTXt", "XML:com.adobe.xmp\x00\x00\x00\x00\x00"+testXMP)
+			text("eXIf", string(testEXIF()))
+			text("prVt", "private-chunk-data")
+		}
+	}
+
+	var out bytes.Buffer
+	err = stripMetadata(&out, bytes.NewReader(src.Bytes()), "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStripped(t, out.Bytes())
+	for _, typ := range []string{"tEXt", "zTXt", "iTXt", "tIME", "prVt"} {
+		if bytes.Contains(out.Bytes(), []byte(typ)) {
+			t.Errorf("stripped image still has a %v chunk", typ)
+		}
+	}
+	_, err = png.Decode(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("decoding stripped image: %v", err)
+	}
+	meta := readMetadata(bytes.NewReader(out.Bytes()), "image/png")
+	if meta.CameraMake != "Canon" || meta.Orientation != 6 {
+		t.Errorf("whitelisted metadata was not kept: %+v", meta)
+	}
+}
+
+// gifSubBlocks splits data into sub-blocks, ending with the empty block.
+func gifSubBlocks(data []byte) []byte {
+	var out []byte
+	for len(data) > 0 {
+		n := min(len(data), 255)
+		out = append(append(out, byte(n)), data[:n]...)
+		data = data[n:]
+	}
+	return append(out, 0)
+}
+
+func TestStripGIF(t *testing.T) {
+	frames := &gif.GIF{LoopCount: 3}
+	for i := 0; i < 2; i++ {
+		frames.Image = append(frames.Image, testImage().(*image.Paletted))
+		frames.Delay = append(frames.Delay, 10)
+	}
+	var encoded bytes.Buffer
+	err := gif.EncodeAll(&encoded, frames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := encoded.Bytes()
+	headerLen := 13
+	if b[10]&0x80 != 0 {
+		headerLen += 3 << (b[10]&0x07 + 1)
+	}
+
+	var src bytes.Buffer
+	src.Write(b[:headerLen])
+	src.Write(append([]byte{0x21, 0xFE}, gifSubBlocks([]byte("Shot by Jane Roe, SN-0042"))...))
+	xmp := append([]byte{0x21, 0xFF, 11}, "XMP DataXMP"...)
+	src.Write(append(xmp, gifSubBlocks([]byte(testXMP))...))
+	src.Write(b[headerLen : len(b)-1])
+	src.Write(append([]byte{0x21, 0xFE}, gifSubBlocks([]byte("SN-0042"))...))
+	src.WriteByte(0x3B)
+
+	var out bytes.Buffer
+	err = stripMetadata(&out, bytes.NewReader(src.Bytes()), "image/gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStripped(t, out.Bytes())
+	decoded, err := gif.DecodeAll(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("decoding stripped image: %v", err)
+	}
+	if len(decoded.Image) != 2 || decoded.LoopCount != 3 {
+		t.Errorf("got %d frames looping %d times, want 2 frames looping 3 times", len(decoded.Image), decoded.LoopCount)
+	}
+}
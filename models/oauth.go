@@ -0,0 +1,188 @@
+package models
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"golang.org/x/oauth2"
+)
+
+// OAuthTokenKeyBytes is the size of OAuthService.Key, which selects AES-256.
+const OAuthTokenKeyBytes = 32
+
+// OAuthService stores the tokens of the accounts users connected with OAuth,
+// such as their Dropbox. Tokens grant access to the user's files elsewhere, so
+// they are encrypted at rest: a leaked database dump is not enough to use
+// them.
+type OAuthService struct {
+	DB *sql.DB
+	// Key encrypts the stored tokens. It must be OAuthTokenKeyBytes long and
+	// must not change, or the stored tokens can no longer be read.
+	Key []byte
+}
+
+// Save stores the user's token for the provider, replacing any previous one.
+func (oas *OAuthService) Save(userID int, provider string, token *oauth2.Token) error {
+	plaintext, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("save oauth token: %w", err)
+	}
+	ciphertext, err := oas.seal(plaintext, userID, provider)
+	if err != nil {
+		return fmt.Errorf("save oauth token: %w", err)
+	}
+	_, err = oas.DB.Exec(`
+	INSERT INTO oauth_tokens (user_id, provider, token)
+	VALUES ($1, $2, $3)
+	ON CONFLICT (user_id, provider) DO UPDATE
+	SET token = EXCLUDED.token, updated_at = now();`, userID, provider, ciphertext)
+	if err != nil {
+		return fmt.Errorf("save oauth token: %w", err)
+	}
+	return nil
+}
+
+// Token returns the user's token for the provider, or ErrNotFound if they
+// have not connected it.
+func (oas *OAuthService) Token(userID int, provider string) (*oauth2.Token, error) {
+	var ciphertext []byte
+	row := oas.DB.QueryRow(`
+	SELECT token
+	FROM oauth_tokens
+	WHERE user_id = $1 AND provider = $2;`, userID, provider)
+	err := row.Scan(&ciphertext)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("query oauth token: %w", err)
+	}
+	plaintext, err := oas.open(ciphertext, userID, provider)
+	if err != nil {
+		return nil, fmt.Errorf("query oauth token: %w", err)
+	}
+	var token oauth2.Token
+	err = json.Unmarshal(plaintext, &token)
+	if err != nil {
+		return nil, fmt.Errorf("query oauth token: %w", err)
+	}
+	return &token, nil
+}
+
+// Delete disconnects the provider from the user's account.
+func (oas *OAuthService) Delete(userID int, provider string) error {
+	_, err := oas.DB.Exec(`
+	DELETE FROM oauth_tokens
+	WHERE user_id = $1 AND provider = $2;`, userID, provider)
+	if err != nil {
+		return fmt.Errorf("delete oauth token: %w", err)
+	}
+	return nil
+}
+
+// Client returns an HTTP client authorized with the user's token for the
+// provider. The token is refreshed when it expires, and the refreshed token
+// is saved. ErrNotFound is returned if the user has not connected the
+// provider, and ErrReconnect if their token has expired for good.
+func (oas *OAuthService) Client(ctx context.Context, config *oauth2.Config, userID int, provider string) (*http.Client, error) {
+	token, err := oas.Token(userID, provider)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid() && token.RefreshToken == "" {
+		return nil, fmt.Errorf("oauth client: %w", ErrReconnect)
+	}
+	source := &savingTokenSource{
+		service:  oas,
+		userID:   userID,
+		provider: provider,
+		source:   config.TokenSource(ctx, token),
+		saved:    token.AccessToken,
+	}
+	return oauth2.NewClient(ctx, source), nil
+}
+
+// savingTokenSource saves every new token handed out by source, so that
+// refreshed tokens, and rotated refresh tokens, outlive the client.
+type savingTokenSource struct {
+	service  *OAuthService
+	userID   int
+	provider string
+	source   oauth2.TokenSource
+
+	mu    sync.Mutex
+	saved string
+}
+
+func (s *savingTokenSource) Token() (*oauth2.Token, error) {
+	token, err := s.source.Token()
+	if err != nil {
+		var retrieveErr *oauth2.RetrieveError
+		if errors.As(err, &retrieveErr) {
+			// The refresh token was rejected, usually because the user
+			// revoked our access.
+			return nil, fmt.Errorf("refresh oauth token: %w: %v", ErrReconnect, err)
+		}
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if token.AccessToken != s.saved {
+		err = s.service.Save(s.userID, s.provider, token)
+		if err != nil {
+			return nil, err
+		}
+		s.saved = token.AccessToken
+	}
+	return token, nil
+}
+
+func (oas *OAuthService) aead() (cipher.AEAD, error) {
+	if len(oas.Key) != OAuthTokenKeyBytes {
+		return nil, fmt.Errorf("oauth token key must be %d bytes, not %d", OAuthTokenKeyBytes, len(oas.Key))
+	}
+	block, err := aes.NewCipher(oas.Key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts a token. The row it belongs to is authenticated along with
+// it, so a token copied into another user's row cannot be decrypted.
+func (oas *OAuthService) seal(plaintext []byte, userID int, provider string) ([]byte, error) {
+	aead, err := oas.aead()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, tokenAD(userID, provider)), nil
+}
+
+func (oas *OAuthService) open(ciphertext []byte, userID int, provider string) ([]byte, error) {
+	aead, err := oas.aead()
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("oauth token is too short")
+	}
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, tokenAD(userID, provider))
+}
+
+func tokenAD(userID int, provider string) []byte {
+	return []byte(fmt.Sprintf("%d:%s", userID, provider))
+}
@@ -0,0 +1,108 @@
+package models
+
+import (
+	"Gallery/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// OAuthStateDuration is how long a user has to authorize us at a provider.
+const OAuthStateDuration = 10 * time.Minute
+
+// OAuthState is an authorization in progress. State is sent to the provider,
+// which sends it back with the code, and Verifier is the PKCE code verifier
+// the code is exchanged with. An OpenID Connect provider puts Nonce in the ID
+// token it issues.
+type OAuthState struct {
+	// UserID is the user who started the authorization, or 0 if they are
+	// signing in.
+	UserID   int
+	Provider string
+	// State is only set when the OAuthState is created; only its hash is
+	// stored.
+	State    string
+	Verifier string
+	Nonce    string
+	// ReturnTo is the path to send the user to once the authorization is
+	// done.
+	ReturnTo string
+}
+
+// CreateState starts an authorization of the provider for the user, or for
+// someone signing in if userID is 0.
+func (oas *OAuthService) CreateState(userID int, provider, returnTo string) (*OAuthState, error) {
+	state, err := rand.String(MinBytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create oauth state: %w", err)
+	}
+	nonce, err := rand.String(MinBytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create oauth state: %w", err)
+	}
+	oauthState := OAuthState{
+		UserID:   userID,
+		Provider: provider,
+		State:    state,
+		Verifier: oauth2.GenerateVerifier(),
+		Nonce:    nonce,
+		ReturnTo: returnTo,
+	}
+	var nullUserID sql.NullInt64
+	if userID != 0 {
+		nullUserID = sql.NullInt64{Int64: int64(userID), Valid: true}
+	}
+	_, err = oas.DB.Exec(`
+	INSERT INTO oauth_states (state_hash, user_id, provider, verifier, nonce, return_to, expires_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7);`, hashOAuthState(state), nullUserID, provider, oauthState.Verifier,
+		nonce, returnTo, time.Now().Add(OAuthStateDuration))
+	if err != nil {
+		return nil, fmt.Errorf("create oauth state: %w", err)
+	}
+	return &oauthState, nil
+}
+
+// ConsumeState ends the authorization the provider sent state back for, so
+// that it cannot be completed twice. ErrNotFound is returned if the state is
+// unknown, expired, or was issued for another provider. The caller must check
+// that the authorization was started by the current user.
+func (oas *OAuthService) ConsumeState(state, provider string) (*OAuthState, error) {
+	oauthState := OAuthState{
+		Provider: provider,
+	}
+	var userID sql.NullInt64
+	row := oas.DB.QueryRow(`
+	DELETE FROM oauth_states
+	WHERE state_hash = $1 AND provider = $2 AND expires_at > now()
+	RETURNING user_id, verifier, nonce, return_to;`, hashOAuthState(state), provider)
+	err := row.Scan(&userID, &oauthState.Verifier, &oauthState.Nonce, &oauthState.ReturnTo)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("consume oauth state: %w", err)
+	}
+	oauthState.UserID = int(userID.Int64)
+	return &oauthState, nil
+}
+
+// DeleteExpiredStates removes the authorizations that were abandoned.
+func (oas *OAuthService) DeleteExpiredStates() error {
+	_, err := oas.DB.Exec(`
+	DELETE FROM oauth_states
+	WHERE expires_at <= now();`)
+	if err != nil {
+		return fmt.Errorf("delete expired oauth states: %w", err)
+	}
+	return nil
+}
+
+func hashOAuthState(state string) string {
+	stateHash := sha256.Sum256([]byte(state))
+	return base64.URLEncoding.EncodeToString(stateHash[:])
+}
@@ -0,0 +1,288 @@
+package models
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Users can sign in with OpenID Connect providers. The provider vouches for
+// who they are in an ID token: a JWT signed with RS256 by one of the keys it
+// publishes at its JWKS URL.
+
+const (
+	// oidcClockSkew is how far the provider's clock may be ahead of ours.
+	oidcClockSkew = time.Minute
+	// jwksRefreshInterval is the least time between fetches of the
+	// provider's keys, so that tokens with unknown key IDs cannot make us
+	// hammer it.
+	jwksRefreshInterval = time.Minute
+)
+
+var oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// IDClaims is who an ID token says the user is. Subject identifies them at the
+// provider for good, while their Email can change.
+type IDClaims struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// OIDCVerifier checks the ID tokens issued by a provider to our client.
+type OIDCVerifier struct {
+	Issuer   string
+	ClientID string
+	JWKSURL  string
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+// Verify checks the ID token's signature and claims, including that it was
+// issued for the authorization that sent nonce, and returns its claims.
+func (v *OIDCVerifier) Verify(ctx context.Context, rawToken, nonce string) (*IDClaims, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("verify id token: malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err := decodeJWTPart(parts[0], &header)
+	if err != nil {
+		return nil, fmt.Errorf("verify id token: header: %w", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("verify id token: unsupported algorithm %q", header.Alg)
+	}
+	key, err := v.key(ctx, header.Kid)
+	if err != nil {
+		return nil, fmt.Errorf("verify id token: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("verify id token: signature: %w", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature)
+	if err != nil {
+		return nil, fmt.Errorf("verify id token: %w", err)
+	}
+
+	var claims struct {
+		Issuer          string      `json:"iss"`
+		Subject         string      `json:"sub"`
+		Audience        jwtAudience `json:"aud"`
+		AuthorizedParty string      `json:"azp"`
+		Expiry          float64     `json:"exp"`
+		IssuedAt        float64     `json:"iat"`
+		Nonce           string      `json:"nonce"`
+		Email           string      `json:"email"`
+		EmailVerified   jwtBool     `json:"email_verified"`
+		Name            string      `json:"name"`
+	}
+	err = decodeJWTPart(parts[1], &claims)
+	if err != nil {
+		return nil, fmt.Errorf("verify id token: claims: %w", err)
+	}
+	now := time.Now()
+	switch {
+	case claims.Issuer != v.Issuer:
+		return nil, fmt.Errorf("verify id token: issued by %q", claims.Issuer)
+	case !slices.Contains(claims.Audience, v.ClientID):
+		return nil, fmt.Errorf("verify id token: not issued for this client")
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != v.ClientID:
+		return nil, fmt.Errorf("verify id token: authorized party is %q", claims.AuthorizedParty)
+	case now.After(time.Unix(int64(claims.Expiry), 0).Add(oidcClockSkew)):
+		return nil, fmt.Errorf("verify id token: expired")
+	case now.Add(oidcClockSkew).Before(time.Unix(int64(claims.IssuedAt), 0)):
+		return nil, fmt.Errorf("verify id token: issued in the future")
+	case claims.Nonce != nonce:
+		return nil, fmt.Errorf("verify id token: nonce does not match")
+	case claims.Subject == "":
+		return nil, fmt.Errorf("verify id token: no subject")
+	}
+	return &IDClaims{
+		Subject:       claims.Subject,
+		Email:         strings.ToLower(claims.Email),
+		EmailVerified: bool(claims.EmailVerified),
+		Name:          claims.Name,
+	}, nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// jwtAudience is the aud claim, which is either a single client ID or a list.
+type jwtAudience []string
+
+func (aud *jwtAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if json.Unmarshal(data, &single) == nil {
+		*aud = jwtAudience{single}
+		return nil
+	}
+	var list []string
+	err := json.Unmarshal(data, &list)
+	*aud = list
+	return err
+}
+
+// jwtBool is a boolean claim, which some providers send as a string.
+type jwtBool bool
+
+func (b *jwtBool) UnmarshalJSON(data []byte) error {
+	var value any
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	}
+	switch value := value.(type) {
+	case bool:
+		*b = jwtBool(value)
+	case string:
+		*b = jwtBool(value == "true")
+	}
+	return nil
+}
+
+// key returns the provider's signing key with the key ID. The keys are
+// fetched again when an unknown one is asked for, as providers rotate them.
+func (v *OIDCVerifier) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	key, ok := v.lookupKey(kid)
+	if ok {
+		return key, nil
+	}
+	if v.keys != nil && time.Since(v.fetchedAt) < jwksRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	keys, err := fetchJWKS(ctx, v.JWKSURL)
+	if err != nil {
+		return nil, err
+	}
+	v.keys = keys
+	v.fetchedAt = time.Now()
+	key, ok = v.lookupKey(kid)
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// lookupKey finds a key among those fetched. A token without a key ID can only
+// be signed by the provider's one key.
+func (v *OIDCVerifier) lookupKey(kid string) (*rsa.PublicKey, bool) {
+	if kid == "" && len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key, true
+		}
+	}
+	key, ok := v.keys[kid]
+	return key, ok
+}
+
+func fetchJWKS(ctx context.Context, jwksURL string) (map[string]*rsa.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, jwksURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("fetch jwks: %w", err)
+	}
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch jwks: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch jwks: %v", resp.Status)
+	}
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&jwks)
+	if err != nil {
+		return nil, fmt.Errorf("fetch jwks: %w", err)
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range jwks.Keys {
+		// Other kinds of keys cannot verify RS256 signatures.
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, fmt.Errorf("fetch jwks: key %q: %w", jwk.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, fmt.Errorf("fetch jwks: key %q: %w", jwk.Kid, err)
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("fetch jwks: key %q: exponent too large", jwk.Kid)
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(exponent.Int64()),
+		}
+	}
+	return keys, nil
+}
+
+// discoverOIDC fills in the endpoints missing from cfg from the issuer's
+// discovery document.
+func discoverOIDC(cfg *ProviderConfig) error {
+	discoveryURL := strings.TrimSuffix(cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	resp, err := oidcHTTPClient.Get(discoveryURL)
+	if err != nil {
+		return fmt.Errorf("discover oidc: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("discover oidc: %v", resp.Status)
+	}
+	var doc struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&doc)
+	if err != nil {
+		return fmt.Errorf("discover oidc: %w", err)
+	}
+	// The ID tokens are checked against the configured issuer, so it has to
+	// be exactly what the provider calls itself.
+	if doc.Issuer != cfg.Issuer {
+		return fmt.Errorf("discover oidc: issuer is %q, not %q", doc.Issuer, cfg.Issuer)
+	}
+	setDefault(&cfg.AuthURL, doc.AuthorizationEndpoint)
+	setDefault(&cfg.TokenURL, doc.TokenEndpoint)
+	setDefault(&cfg.JWKSURL, doc.JWKSURI)
+	return nil
+}
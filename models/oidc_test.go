@@ -0,0 +1,310 @@
+package models
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuer   = "https://issuer.example.com"
+	testClientID = "gallery"
+)
+
+// fakeJWKS publishes the public halves of keys and counts how often they are
+// fetched.
+type fakeJWKS struct {
+	mu      sync.Mutex
+	keys    map[string]*rsa.PrivateKey
+	fetches int
+}
+
+func (f *fakeJWKS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fetches++
+	type jwk struct {
+		Kty string `json:"kty"`
+		Use string `json:"use"`
+		Kid string `json:"kid"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	}
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	for kid, key := range f.keys {
+		jwks.Keys = append(jwks.Keys, jwk{
+			Kty: "RSA",
+			Use: "sig",
+			Kid: kid,
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jwks)
+}
+
+func (f *fakeJWKS) setKey(kid string, key *rsa.PrivateKey) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.keys[kid] = key
+}
+
+func (f *fakeJWKS) fetchCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.fetches
+}
+
+func newTestVerifier(t *testing.T, keys map[string]*rsa.PrivateKey) (*OIDCVerifier, *fakeJWKS) {
+	fake := &fakeJWKS{keys: keys}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return &OIDCVerifier{Issuer: testIssuer, ClientID: testClientID, JWKSURL: server.URL}, fake
+}
+
+func generateTestKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// signTestToken encodes the header and claims as a JWT signed with RS256 by
+// key, whatever alg the header names.
+func signTestToken(t *testing.T, key *rsa.PrivateKey, header, claims map[string]any) string {
+	var parts []string
+	for _, part := range []map[string]any{header, claims} {
+		data, err := json.Marshal(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, base64.RawURLEncoding.EncodeToString(data))
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestOIDCVerify(t *testing.T) {
+	key := generateTestKey(t)
+	otherKey := generateTestKey(t)
+	now := time.Now()
+	tests := []struct {
+		name string
+		// edit changes the valid header and claims the token is made of.
+		edit    func(header, claims map[string]any)
+		signer  *rsa.PrivateKey
+		nonce   string
+		wantErr string
+	}{
+		{
+			name: "valid",
+		},
+		{
+			name: "several audiences with our client as authorized party",
+			edit: func(header, claims map[string]any) {
+				claims["aud"] = []string{testClientID, "other"}
+				claims["azp"] = testClientID
+			},
+		},
+		{
+			name: "expired within the allowed clock skew",
+			edit: func(header, claims map[string]any) {
+				claims["exp"] = now.Add(-oidcClockSkew / 2).Unix()
+			},
+		},
+		{
+			name: "no key id with a single key",
+			edit: func(header, claims map[string]any) {
+				delete(header, "kid")
+			},
+		},
+		{
+			name:    "bad signature",
+			signer:  otherKey,
+			wantErr: "verification error",
+		},
+		{
+			name: "wrong issuer",
+			edit: func(header, claims map[string]any) {
+				claims["iss"] = "https://evil.example.com"
+			},
+			wantErr: "issued by",
+		},
+		{
+			name: "wrong audience",
+			edit: func(header, claims map[string]any) {
+				claims["aud"] = "other"
+			},
+			wantErr: "not issued for this client",
+		},
+		{
+			name: "several audiences with another authorized party",
+			edit: func(header, claims map[string]any) {
+				claims["aud"] = []string{testClientID, "other"}
+				claims["azp"] = "other"
+			},
+			wantErr: "authorized party",
+		},
+		{
+			name: "expired",
+			edit: func(header, claims map[string]any) {
+				claims["exp"] = now.Add(-2 * oidcClockSkew).Unix()
+			},
+			wantErr: "expired",
+		},
+		{
+			name: "issued in the future",
+			edit: func(header, claims map[string]any) {
+				claims["iat"] = now.Add(2 * oidcClockSkew).Unix()
+			},
+			wantErr: "issued in the future",
+		},
+		{
+			name:    "nonce mismatch",
+			nonce:   "other-nonce",
+			wantErr: "nonce does not match",
+		},
+		{
+			name: "no subject",
+			edit: func(header, claims map[string]any) {
+				delete(claims, "sub")
+			},
+			wantErr: "no subject",
+		},
+		{
+			name: "unknown key id",
+			edit: func(header, claims map[string]any) {
+				header["kid"] = "rotated"
+			},
+			wantErr: "unknown signing key",
+		},
+		{
+			name: "HS256",
+			edit: func(header, claims map[string]any) {
+				header["alg"] = "HS256"
+			},
+			wantErr: "unsupported algorithm",
+		},
+		{
+			name: "none",
+			edit: func(header, claims map[string]any) {
+				header["alg"] = "none"
+			},
+			wantErr: "unsupported algorithm",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			verifier, _ := newTestVerifier(t, map[string]*rsa.PrivateKey{"k1": key})
+			header := map[string]any{"alg": "RS256", "kid": "k1"}
+			claims := map[string]any{
+				"iss":            testIssuer,
+				"sub":            "user-1",
+				"aud":            testClientID,
+				"exp":            now.Add(time.Hour).Unix(),
+				"iat":            now.Unix(),
+				"nonce":          "nonce",
+				"email":          "Jane@Example.com",
+				"email_verified": "true",
+				"name":           "Jane Roe",
+			}
+			if tc.edit != nil {
+				tc.edit(header, claims)
+			}
+			signer := key
+			if tc.signer != nil {
+				signer = tc.signer
+			}
+			nonce := "nonce"
+			if tc.nonce != "" {
+				nonce = tc.nonce
+			}
+			got, err := verifier.Verify(context.Background(), signTestToken(t, signer, header, claims), nonce)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("Verify error = %v, want one containing %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			want := IDClaims{Subject: "user-1", Email: "jane@example.com", EmailVerified: true, Name: "Jane Roe"}
+			if *got != want {
+				t.Errorf("Verify = %+v, want %+v", *got, want)
+			}
+		})
+	}
+}
+
+func TestOIDCVerifyRefetchesKeys(t *testing.T) {
+	key := generateTestKey(t)
+	rotated := generateTestKey(t)
+	verifier, fake := newTestVerifier(t, map[string]*rsa.PrivateKey{"k1": key})
+	token := func(kid string, key *rsa.PrivateKey) string {
+		now := time.Now()
+		return signTestToken(t, key, map[string]any{"alg": "RS256", "kid": kid}, map[string]any{
+			"iss":   testIssuer,
+			"sub":   "user-1",
+			"aud":   testClientID,
+			"exp":   now.Add(time.Hour).Unix(),
+			"iat":   now.Unix(),
+			"nonce": "nonce",
+		})
+	}
+
+	_, err := verifier.Verify(context.Background(), token("k1", key), "nonce")
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	_, err = verifier.Verify(context.Background(), token("k1", key), "nonce")
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if got := fake.fetchCount(); got != 1 {
+		t.Errorf("fetches = %d, want 1", got)
+	}
+
+	// The provider rotates its keys, but the keys were fetched too recently
+	// to be fetched again, however many unknown key IDs come in.
+	fake.setKey("k2", rotated)
+	for range 3 {
+		_, err = verifier.Verify(context.Background(), token("k2", rotated), "nonce")
+		if err == nil || !strings.Contains(err.Error(), "unknown signing key") {
+			t.Fatalf("Verify error = %v, want an unknown signing key", err)
+		}
+	}
+	if got := fake.fetchCount(); got != 1 {
+		t.Errorf("fetches = %d, want 1", got)
+	}
+
+	verifier.mu.Lock()
+	verifier.fetchedAt = time.Now().Add(-jwksRefreshInterval)
+	verifier.mu.Unlock()
+	_, err = verifier.Verify(context.Background(), token("k2", rotated), "nonce")
+	if err != nil {
+		t.Fatalf("Verify after the refresh interval: %v", err)
+	}
+	if got := fake.fetchCount(); got != 2 {
+		t.Errorf("fetches = %d, want 2", got)
+	}
+}
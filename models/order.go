@@ -0,0 +1,64 @@
+package models
+
+import (
+	"fmt"
+
+	"github.com/jackc/pgtype"
+)
+
+// ReorderImages saves a new custom order for the gallery's images. imageIDs
+// lists the images in their new order. Images missing from the list, eg ones
+// uploaded while the order was being edited, keep their relative order after
+// the listed ones; IDs of images from other galleries are ignored.
+func (service *GalleryService) ReorderImages(galleryID int, imageIDs []int) error {
+	var ids pgtype.Int4Array
+	err := ids.Set(imageIDs)
+	if err != nil {
+		return fmt.Errorf("reorder images: %w", err)
+	}
+	// Only images outside the trash are reordered, and they take over the
+	// positions they held between them. Trashed images keep theirs, so a
+	// restored image returns to its old slot in the order.
+	_, err = service.DB.Exec(`
+	WITH live AS (
+		SELECT id, position
+		FROM images
+		WHERE gallery_id = $1 AND deleted_at IS NULL
+	), ordered AS (
+		SELECT id, row_number() OVER (
+			ORDER BY array_position($2::int[], id) NULLS LAST, position, id) AS rank
+		FROM live
+	), slots AS (
+		SELECT position, row_number() OVER (ORDER BY position, id) AS rank
+		FROM live
+	)
+	UPDATE images
+	SET position = slots.position
+	FROM ordered
+	JOIN slots ON slots.rank = ordered.rank
+	WHERE images.id = ordered.id AND images.position <> slots.position;`, galleryID, &ids)
+	if err != nil {
+		return fmt.Errorf("reorder images: %w", err)
+	}
+	return nil
+}
+
+// SetCover makes the image the cover of the gallery, or clears the cover if
+// imageID is 0.
+func (service *GalleryService) SetCover(gallery *Gallery, imageID int) error {
+	result, err := service.DB.Exec(`
+	UPDATE galleries
+	SET cover_image_id = NULLIF($2, 0)
+	WHERE id = $1 AND ($2 = 0 OR EXISTS (
+		SELECT 1 FROM images WHERE id = $2 AND gallery_id = $1 AND deleted_at IS NULL));`,
+		gallery.ID, imageID)
+	if err != nil {
+		return fmt.Errorf("set cover: %w", err)
+	}
+	err = requireRow(result, "set cover")
+	if err != nil {
+		return err
+	}
+	gallery.CoverImageID = imageID
+	return nil
+}
@@ -0,0 +1,255 @@
+package models
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Long listings are paginated by keyset: a page starts right after (or ends
+// right before) the last row of the page the viewer came from, identified by
+// its sort value and ID. Unlike OFFSET, this stays fast deep into a listing
+// and does not skip or repeat rows when rows are added or removed meanwhile.
+
+// DefaultPageSize is used when ListOptions.Limit is not set.
+const DefaultPageSize = 50
+
+// ListOptions selects a page of a listing.
+type ListOptions struct {
+	// Sort is the name of the sort order. The listing's default is used if it
+	// is empty or unknown.
+	Sort string
+	// Cursor is Page.Next or Page.Prev of the page the viewer came from, or
+	// empty for the first page.
+	Cursor string
+	Limit  int
+}
+
+// Page links a page of a listing to its neighbours. Next and Prev are the
+// cursors of the following and previous pages, empty when there is none.
+type Page struct {
+	Sort string
+	Next string
+	Prev string
+}
+
+// sortKey is a sort order of a listing. Ties are broken by id, in the same
+// direction.
+type sortKey struct {
+	// expr is the SQL expression sorted by; cast is its SQL type, that the
+	// cursor value is cast back to.
+	expr string
+	cast string
+	desc bool
+}
+
+type cursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    int    `json:"id"`
+	// Before is set on cursors that page backwards.
+	Before bool `json:"b,omitempty"`
+}
+
+func (c cursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor parses a cursor made for the sort order. Cursors that cannot be
+// parsed, or belong to another sort order, are treated as absent so that a
+// stale link shows the first page rather than an error.
+func decodeCursor(s, sort string) *cursor {
+	if s == "" {
+		return nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil
+	}
+	var c cursor
+	err = json.Unmarshal(b, &c)
+	if err != nil || c.Sort != sort {
+		return nil
+	}
+	return &c
+}
+
+// keyset returns the condition and ORDER BY clause selecting the rows after,
+// or before, the cursor. The cursor's values are appended to args as the
+// next placeholders.
+func (key sortKey) keyset(c *cursor, args []any) (cond, order string, newArgs []any) {
+	// Rows are read in the sort order, or in reverse when paging backwards;
+	// paginate puts them back in order.
+	reverse := key.desc != (c != nil && c.Before)
+	dir, cmp := "ASC", ">"
+	if reverse {
+		dir, cmp = "DESC", "<"
+	}
+	order = fmt.Sprintf("%s %s, id %s", key.expr, dir, dir)
+	if c == nil {
+		return "TRUE", order, args
+	}
+	n := len(args)
+	cond = fmt.Sprintf("(%s, id) %s ($%d::%s, $%d)", key.expr, cmp, n+1, key.cast, n+2)
+	return cond, order, append(args, c.Value, c.ID)
+}
+
+// paginate trims rows, fetched with one extra row and in the order given by
+// keyset, to a page and works out the cursors of its neighbours. key returns
+// the sort value and ID of a row.
+func paginate[T any](rows []T, sort string, c *cursor, limit int, key func(T) (string, int)) ([]T, Page) {
+	page := Page{Sort: sort}
+	more := len(rows) > limit
+	if more {
+		rows = rows[:limit]
+	}
+	backwards := c != nil && c.Before
+	if backwards {
+		for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+			rows[i], rows[j] = rows[j], rows[i]
+		}
+	}
+	if len(rows) == 0 {
+		return rows, page
+	}
+	// Going forwards, there is a previous page whenever we came from a
+	// cursor, and a next page if the extra row was found; backwards it is
+	// the other way around.
+	hasPrev, hasNext := c != nil, more
+	if backwards {
+		hasPrev, hasNext = more, true
+	}
+	if hasNext {
+		value, id := key(rows[len(rows)-1])
+		page.Next = cursor{Sort: sort, Value: value, ID: id}.encode()
+	}
+	if hasPrev {
+		value, id := key(rows[0])
+		page.Prev = cursor{Sort: sort, Value: value, ID: id, Before: true}.encode()
+	}
+	return rows, page
+}
+
+func pageLimit(limit int) int {
+	if limit <= 0 {
+		return DefaultPageSize
+	}
+	return limit
+}
+
+// cursorTime formats a timestamp as a cursor value. Postgres stores
+// microseconds, which RFC 3339 with nanoseconds keeps exactly.
+func cursorTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// GallerySorts are the sort orders of ByUserIDPage. The first is the default.
+var GallerySorts = []string{"title", "newest", "oldest"}
+
+var gallerySortKeys = map[string]sortKey{
+	"title":  {expr: "COALESCE(title, '')", cast: "text"},
+	"newest": {expr: "created_at", cast: "timestamptz", desc: true},
+	"oldest": {expr: "created_at", cast: "timestamptz"},
+}
+
+// ImageSorts are the sort orders of ImagesPage. The first is the default:
+// the custom order set by the gallery's owner.
+var ImageSorts = []string{"custom", "filename", "taken", "newest"}
+
+var imageSortKeys = map[string]sortKey{
+	"custom":   {expr: "position", cast: "int"},
+	"filename": {expr: "filename", cast: "text"},
+	// Images without a capture date go last.
+	"taken":  {expr: "COALESCE(taken_at, 'infinity')", cast: "timestamptz"},
+	"newest": {expr: "created_at", cast: "timestamptz", desc: true},
+}
+
+// pickSort returns sort if it is one of sorts, and the default otherwise.
+func pickSort(sort string, sorts []string) string {
+	for _, s := range sorts {
+		if s == sort {
+			return sort
+		}
+	}
+	return sorts[0]
+}
+
+// ByUserIDPage returns a page of the user's galleries.
+func (service *GalleryService) ByUserIDPage(userID int, opts ListOptions) ([]Gallery, Page, error) {
+	sort := pickSort(opts.Sort, GallerySorts)
+	limit := pageLimit(opts.Limit)
+	c := decodeCursor(opts.Cursor, sort)
+	cond, order, args := gallerySortKeys[sort].keyset(c, []any{userID, limit + 1})
+	rows, err := service.DB.Query(`
+	SELECT id, title, gallery_visibility(visibility, collection_id), COALESCE(visibility, ''),
+		COALESCE(collection_id, 0), created_at, COALESCE(cover_image_id, 0), COALESCE((
+			SELECT filename FROM images
+			WHERE gallery_id = galleries.id AND deleted_at IS NULL
+			ORDER BY id = galleries.cover_image_id DESC NULLS LAST, position, id
+			LIMIT 1), '')
+	FROM galleries
+	WHERE user_id = $1 AND deleted_at IS NULL AND `+cond+`
+	ORDER BY `+order+`
+	LIMIT $2;`, args...)
+	if err != nil {
+		return nil, Page{}, fmt.Errorf("query galleries page: %w", err)
+	}
+	defer rows.Close()
+	var galleries []Gallery
+	for rows.Next() {
+		gallery := Gallery{
+			UserID: userID,
+		}
+		err := rows.Scan(&gallery.ID, &gallery.Title, &gallery.Visibility, &gallery.VisibilityOverride,
+			&gallery.CollectionID, &gallery.CreatedAt, &gallery.CoverImageID, &gallery.Cover)
+		if err != nil {
+			return nil, Page{}, fmt.Errorf("query galleries page: %w", err)
+		}
+		galleries = append(galleries, gallery)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, Page{}, fmt.Errorf("query galleries page: %w", err)
+	}
+	galleries, page := paginate(galleries, sort, c, limit, func(gallery Gallery) (string, int) {
+		if sort == "title" {
+			return gallery.Title, gallery.ID
+		}
+		return cursorTime(gallery.CreatedAt), gallery.ID
+	})
+	return galleries, page, nil
+}
+
+// ImagesPage returns a page of the gallery's images. If tag is not empty,
+// only the images with that tag are listed.
+func (service *GalleryService) ImagesPage(galleryID int, tag string, opts ListOptions) ([]Image, Page, error) {
+	sort := pickSort(opts.Sort, ImageSorts)
+	limit := pageLimit(opts.Limit)
+	c := decodeCursor(opts.Cursor, sort)
+	cond, order, args := imageSortKeys[sort].keyset(c, []any{galleryID, limit + 1, tag})
+	images, err := service.queryImages(`
+	SELECT `+imageColumns+`
+	FROM images
+	WHERE gallery_id = $1 AND deleted_at IS NULL AND ($3 = '' OR tags @> ARRAY[$3::text]) AND `+cond+`
+	ORDER BY `+order+`
+	LIMIT $2;`, args...)
+	if err != nil {
+		return nil, Page{}, fmt.Errorf("query images page: %w", err)
+	}
+	images, page := paginate(images, sort, c, limit, func(image Image) (string, int) {
+		switch sort {
+		case "filename":
+			return image.Filename, image.ID
+		case "taken":
+			if image.Metadata.TakenAt.IsZero() {
+				return "infinity", image.ID
+			}
+			return cursorTime(image.Metadata.TakenAt), image.ID
+		case "newest":
+			return cursorTime(image.CreatedAt), image.ID
+		}
+		return fmt.Sprint(image.Position), image.ID
+	})
+	return images, page, nil
+}
@@ -108,6 +108,14 @@ func (service *PasswordResetService) Consume(token string) (*User, error) {
 	if err != nil {
 		return nil, fmt.Errorf("consume: %w", err)
 	}
+	// The token was sent to the user's email address, so they own it.
+	_, err = service.DB.Exec(`
+	UPDATE users
+	SET email_verified = true
+	WHERE id = $1;`, user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("consume: %w", err)
+	}
 	return &user, nil
 }
 
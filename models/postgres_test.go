@@ -0,0 +1,30 @@
+package models
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	"Gallery/migrations"
+)
+
+// testDB connects to the database named by TEST_DATABASE_URL and migrates
+// it. Tests that need Postgres are skipped when it is not set. They share the
+// database, so each one creates its own users and galleries.
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	err = MigrateFS(db, migrations.FS, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
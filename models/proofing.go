@@ -0,0 +1,360 @@
+package models
+
+import (
+	"Gallery/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// In a proofing gallery, viewers mark the images they would like as
+// favourites and then submit them as their selection. The gallery's owner can
+// export submitted selections or copy them into a new gallery to deliver the
+// finals.
+
+const (
+	MaxSelectionNameLength = 100
+	MaxSelectionNoteLength = 2000
+)
+
+type Selection struct {
+	ID        int
+	GalleryID int
+	// UserID is the signed in user that made the selection, or 0.
+	UserID int
+	// Name and Note are given by the viewer when they submit the selection.
+	Name string
+	Note string
+	// Images is the number of images in the selection.
+	Images int
+	// SubmittedAt is zero while the viewer is still choosing. A submitted
+	// selection can no longer be changed.
+	SubmittedAt time.Time
+}
+
+func (selection *Selection) Submitted() bool {
+	return !selection.SubmittedAt.IsZero()
+}
+
+type SelectionService struct {
+	DB             *sql.DB
+	GalleryService *GalleryService
+}
+
+const selectionColumns = `proof_selections.id, proof_selections.gallery_id,
+	COALESCE(proof_selections.user_id, 0), proof_selections.name, proof_selections.note,
+	(SELECT COUNT(*) FROM proof_selection_images psi JOIN images ON images.id = psi.image_id
+		WHERE psi.selection_id = proof_selections.id AND images.deleted_at IS NULL),
+	proof_selections.submitted_at`
+
+func scanSelection(row scanner) (Selection, error) {
+	var selection Selection
+	var submittedAt sql.NullTime
+	err := row.Scan(&selection.ID, &selection.GalleryID, &selection.UserID, &selection.Name, &selection.Note,
+		&selection.Images, &submittedAt)
+	selection.SubmittedAt = submittedAt.Time
+	return selection, err
+}
+
+func (ss *SelectionService) hash(viewerToken string) string {
+	tokenHash := sha256.Sum256([]byte(viewerToken))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
+
+// ByViewer returns the viewer's selection in the gallery, or ErrNotFound if
+// they have not picked any favourites yet.
+func (ss *SelectionService) ByViewer(galleryID int, viewerToken string) (*Selection, error) {
+	row := ss.DB.QueryRow(`
+	SELECT `+selectionColumns+`
+	FROM proof_selections
+	WHERE gallery_id = $1 AND viewer_token_hash = $2;`, galleryID, ss.hash(viewerToken))
+	selection, err := scanSelection(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("query selection by viewer: %w", err)
+	}
+	return &selection, nil
+}
+
+func (ss *SelectionService) ByID(id int) (*Selection, error) {
+	row := ss.DB.QueryRow(`
+	SELECT `+selectionColumns+`
+	FROM proof_selections
+	WHERE id = $1;`, id)
+	selection, err := scanSelection(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("query selection by id: %w", err)
+	}
+	return &selection, nil
+}
+
+// ImageIDs returns the IDs of the images in the selection.
+func (ss *SelectionService) ImageIDs(selectionID int) ([]int, error) {
+	rows, err := ss.DB.Query(`
+	SELECT image_id
+	FROM proof_selection_images
+	WHERE selection_id = $1;`, selectionID)
+	if err != nil {
+		return nil, fmt.Errorf("query selection image ids: %w", err)
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, fmt.Errorf("query selection image ids: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query selection image ids: %w", err)
+	}
+	return ids, nil
+}
+
+// Images returns the images in the selection, in gallery order. Images that
+// have since been moved to the trash are left out.
+func (ss *SelectionService) Images(selectionID int) ([]Image, error) {
+	images, err := ss.GalleryService.queryImages(`
+	SELECT `+imageColumns+`
+	FROM images
+	WHERE deleted_at IS NULL
+		AND id IN (SELECT image_id FROM proof_selection_images WHERE selection_id = $1)
+	ORDER BY position, id;`, selectionID)
+	if err != nil {
+		return nil, fmt.Errorf("query selection images: %w", err)
+	}
+	return images, nil
+}
+
+// Toggle adds the image to the viewer's favourites, or removes it if it was
+// already one. The selection is created on the first favourite. userID is 0
+// for anonymous viewers. selected reports whether the image is now a
+// favourite.
+func (ss *SelectionService) Toggle(galleryID, imageID int, viewerToken string, userID int) (selected bool, err error) {
+	tx, err := ss.DB.Begin()
+	if err != nil {
+		return false, fmt.Errorf("toggle favourite: %w", err)
+	}
+	defer tx.Rollback()
+	var exists bool
+	row := tx.QueryRow(`
+	SELECT EXISTS (
+		SELECT 1 FROM images
+		WHERE id = $1 AND gallery_id = $2 AND deleted_at IS NULL);`, imageID, galleryID)
+	err = row.Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("toggle favourite: %w", err)
+	}
+	if !exists {
+		return false, fmt.Errorf("toggle favourite: %w", ErrNotFound)
+	}
+	// The no-op update makes RETURNING work for an existing selection, and
+	// locks it against a concurrent submit.
+	var selectionID int
+	var submittedAt sql.NullTime
+	row = tx.QueryRow(`
+	INSERT INTO proof_selections (gallery_id, viewer_token_hash, user_id)
+	VALUES ($1, $2, NULLIF($3, 0))
+	ON CONFLICT (gallery_id, viewer_token_hash) DO UPDATE SET gallery_id = EXCLUDED.gallery_id
+	RETURNING id, submitted_at;`, galleryID, ss.hash(viewerToken), userID)
+	err = row.Scan(&selectionID, &submittedAt)
+	if err != nil {
+		return false, fmt.Errorf("toggle favourite: %w", err)
+	}
+	if submittedAt.Valid {
+		return false, fmt.Errorf("toggle favourite: %w", ValidationError{
+			Issue: "your selection has already been submitted",
+		})
+	}
+	result, err := tx.Exec(`
+	DELETE FROM proof_selection_images
+	WHERE selection_id = $1 AND image_id = $2;`, selectionID, imageID)
+	if err != nil {
+		return false, fmt.Errorf("toggle favourite: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("toggle favourite: %w", err)
+	}
+	if n == 0 {
+		_, err = tx.Exec(`
+		INSERT INTO proof_selection_images (selection_id, image_id)
+		VALUES ($1, $2);`, selectionID, imageID)
+		if err != nil {
+			return false, fmt.Errorf("toggle favourite: %w", err)
+		}
+		selected = true
+	}
+	err = tx.Commit()
+	if err != nil {
+		return false, fmt.Errorf("toggle favourite: %w", err)
+	}
+	return selected, nil
+}
+
+// Submit sends the selection to the gallery's owner. name identifies the
+// viewer, who may not be signed in.
+func (ss *SelectionService) Submit(selection *Selection, name, note string) error {
+	name = strings.TrimSpace(name)
+	note = strings.TrimSpace(note)
+	if name == "" {
+		return fmt.Errorf("submit selection: %w", ValidationError{
+			Issue: "please tell us your name",
+		})
+	}
+	if utf8.RuneCountInString(name) > MaxSelectionNameLength {
+		return fmt.Errorf("submit selection: %w", ValidationError{
+			Issue: fmt.Sprintf("names can be at most %d characters", MaxSelectionNameLength),
+		})
+	}
+	if utf8.RuneCountInString(note) > MaxSelectionNoteLength {
+		return fmt.Errorf("submit selection: %w", ValidationError{
+			Issue: fmt.Sprintf("notes can be at most %d characters", MaxSelectionNoteLength),
+		})
+	}
+	row := ss.DB.QueryRow(`
+	UPDATE proof_selections
+	SET name = $2, note = $3, submitted_at = now()
+	WHERE id = $1 AND submitted_at IS NULL
+		AND EXISTS (SELECT 1 FROM proof_selection_images WHERE selection_id = $1)
+	RETURNING submitted_at;`, selection.ID, name, note)
+	err := row.Scan(&selection.SubmittedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("submit selection: %w", ValidationError{
+				Issue: "pick at least one favourite before submitting, and submit only once",
+			})
+		}
+		return fmt.Errorf("submit selection: %w", err)
+	}
+	selection.Name = name
+	selection.Note = note
+	return nil
+}
+
+// Submitted returns the selections submitted in the gallery, newest first.
+func (ss *SelectionService) Submitted(galleryID int) ([]Selection, error) {
+	rows, err := ss.DB.Query(`
+	SELECT `+selectionColumns+`
+	FROM proof_selections
+	WHERE gallery_id = $1 AND submitted_at IS NOT NULL
+	ORDER BY submitted_at DESC, id DESC;`, galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("query submitted selections: %w", err)
+	}
+	defer rows.Close()
+	var selections []Selection
+	for rows.Next() {
+		selection, err := scanSelection(rows)
+		if err != nil {
+			return nil, fmt.Errorf("query submitted selections: %w", err)
+		}
+		selections = append(selections, selection)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query submitted selections: %w", err)
+	}
+	return selections, nil
+}
+
+// CopyImages creates a gallery for the user holding copies of the images.
+// The copies share the stored bytes of the originals, so only images stored
+// content-addressed can be copied; older images, and any deleted in the
+// meantime, are skipped and returned in skipped. The new gallery counts
+// against the user's quotas like any other.
+func (service *GalleryService) CopyImages(userID int, title string, images []Image) (gallery *Gallery, skipped []Image, err error) {
+	gallery = &Gallery{
+		Title:  title,
+		UserID: userID,
+	}
+	gallery.ShareToken, err = rand.String(ShareTokenBytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("copy images: %w", err)
+	}
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return nil, nil, fmt.Errorf("copy images: %w", err)
+	}
+	defer tx.Rollback()
+	if service.Quotas != nil {
+		err = service.Quotas.checkGallery(tx, userID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("copy images: %w", err)
+		}
+	}
+	row := tx.QueryRow(`
+	INSERT INTO galleries (title, user_id, share_token)
+	VALUES ($1, $2, $3) RETURNING id, gallery_visibility(visibility, collection_id);`,
+		gallery.Title, gallery.UserID, gallery.ShareToken)
+	err = row.Scan(&gallery.ID, &gallery.Visibility)
+	if err != nil {
+		return nil, nil, fmt.Errorf("copy images: %w", err)
+	}
+	for _, image := range images {
+		if image.BlobHash == "" {
+			skipped = append(skipped, image)
+			continue
+		}
+		// Lock the original so it cannot be purged before tx commits. While
+		// it exists it holds a reference to the blob, so the blob's objects
+		// are still stored and nothing needs uploading.
+		err = lockBlob(tx, image.BlobHash)
+		if err != nil {
+			return nil, nil, fmt.Errorf("copy images: %w", err)
+		}
+		var originalID int
+		row := tx.QueryRow(`
+		SELECT id
+		FROM images
+		WHERE id = $1 AND blob_hash = $2 AND deleted_at IS NULL
+		FOR SHARE;`, image.ID, image.BlobHash)
+		err = row.Scan(&originalID)
+		if errors.Is(err, sql.ErrNoRows) {
+			skipped = append(skipped, image)
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("copy images: %w", err)
+		}
+		if service.Quotas != nil {
+			err = service.Quotas.checkImage(tx, gallery.ID, image.Size)
+			if err != nil {
+				return nil, nil, fmt.Errorf("copy images: %w", err)
+			}
+		}
+		_, err = service.acquireBlob(tx, image.BlobHash, image.Size, image.ContentType)
+		if err != nil {
+			return nil, nil, fmt.Errorf("copy images: %w", err)
+		}
+		image.GalleryID = gallery.ID
+		image.UploadedBy = userID
+		err = service.insertImage(tx, &image)
+		if err != nil {
+			return nil, nil, fmt.Errorf("copy images: %w", err)
+		}
+		_, err = tx.Exec(`
+		UPDATE images
+		SET caption = $2, alt_text = $3, tags = (SELECT tags FROM images WHERE id = $4)
+		WHERE id = $1;`, image.ID, image.Caption, image.AltText, originalID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("copy images: %w", err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, fmt.Errorf("copy images: %w", err)
+	}
+	return gallery, skipped, nil
+}
@@ -0,0 +1,228 @@
+package models
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// Users connect accounts at other services with OAuth. Each provider is
+// declared in the configuration with its endpoints and scopes, and its kind
+// says which API its files are read with, or that users sign in with it. A
+// provider of a known kind, eg a second Dropbox app, any OpenID Connect
+// provider or a local stand-in for either, needs no code changes.
+
+// FileProvider lists and fetches the files in a user's cloud storage. Every
+// call takes an HTTP client authorized for the user, see OAuthService.Client.
+type FileProvider interface {
+	// ListChanges returns the files and folders directly in the folder that
+	// were added or changed since the listing that returned cursor, along
+	// with the cursor to pass next time. Without a cursor, or if it expired,
+	// the whole folder is listed. The root folder is "".
+	ListChanges(client *http.Client, folder, cursor string) (entries []RemoteEntry, newCursor string, err error)
+	// Download returns the contents of a file. The caller must close it.
+	Download(client *http.Client, entry RemoteEntry) (io.ReadCloser, error)
+}
+
+// RemoteEntry is a file or folder in cloud storage. Path identifies it to the
+// provider and, for folders, is what ListChanges takes. ID stays the same when
+// the file is moved or renamed, while Rev changes whenever its contents do.
+type RemoteEntry struct {
+	ID     string
+	Name   string
+	Path   string
+	Rev    string
+	Folder bool
+	Size   int64
+}
+
+// ListFolder returns the files and folders directly in the folder.
+func ListFolder(files FileProvider, client *http.Client, folder string) ([]RemoteEntry, error) {
+	entries, _, err := files.ListChanges(client, folder, "")
+	return entries, err
+}
+
+// ProviderConfig declares an OAuth provider. Settings left empty take the
+// defaults of the provider's kind.
+type ProviderConfig struct {
+	// Name identifies the provider in URLs and the database, eg "dropbox".
+	Name string
+	// Kind selects the API the provider's files are read with. Defaults to
+	// Name.
+	Kind string
+	// Title is shown to users, eg "Dropbox".
+	Title        string
+	ClientID     string
+	ClientSecret string
+	AuthURL      string
+	TokenURL     string
+	Scopes       []string
+	// AuthParams are added to the authorization URL, eg Dropbox's
+	// token_access_type=offline.
+	AuthParams url.Values
+	// APIURL and ContentURL are the bases of the provider's API, eg to point
+	// it at a local fake.
+	APIURL     string
+	ContentURL string
+	// Issuer identifies an OpenID Connect provider. The auth, token and JWKS
+	// URLs are discovered from it unless they are set.
+	Issuer  string
+	JWKSURL string
+}
+
+// OAuthProvider is a configured provider.
+type OAuthProvider struct {
+	Name       string
+	Title      string
+	Config     *oauth2.Config
+	AuthParams url.Values
+	// Files is nil if the provider's kind has no file API.
+	Files FileProvider
+	// OIDC verifies the ID tokens of a provider users sign in with. It is nil
+	// for other providers.
+	OIDC *OIDCVerifier
+}
+
+// AuthOptions returns the provider's extra authorization URL parameters.
+func (provider *OAuthProvider) AuthOptions() []oauth2.AuthCodeOption {
+	var opts []oauth2.AuthCodeOption
+	for key, values := range provider.AuthParams {
+		for _, value := range values {
+			opts = append(opts, oauth2.SetAuthURLParam(key, value))
+		}
+	}
+	return opts
+}
+
+type providerKind struct {
+	defaults func(cfg *ProviderConfig) error
+	files    func(cfg ProviderConfig) FileProvider
+	signIn   bool
+}
+
+var providerKinds = map[string]providerKind{
+	// An "oauth" provider can be connected but has no file API; everything
+	// about it comes from the configuration.
+	"oauth": {},
+	"dropbox": {
+		defaults: func(cfg *ProviderConfig) error {
+			setDefault(&cfg.Title, "Dropbox")
+			setDefault(&cfg.APIURL, DefaultDropboxAPIURL)
+			setDefault(&cfg.ContentURL, DefaultDropboxContentURL)
+			setDefault(&cfg.AuthURL, "https://www.dropbox.com/oauth2/authorize")
+			setDefault(&cfg.TokenURL, strings.TrimSuffix(cfg.APIURL, "/")+"/oauth2/token")
+			if len(cfg.Scopes) == 0 {
+				cfg.Scopes = []string{"files.metadata.read", "files.content.read"}
+			}
+			if cfg.AuthParams == nil {
+				// Dropbox only issues a refresh token for offline access;
+				// without one a token stops working after a few hours.
+				cfg.AuthParams = url.Values{"token_access_type": {"offline"}}
+			}
+			return nil
+		},
+		files: func(cfg ProviderConfig) FileProvider {
+			return &Dropbox{APIURL: cfg.APIURL, ContentURL: cfg.ContentURL}
+		},
+	},
+	"oidc": {
+		defaults: func(cfg *ProviderConfig) error {
+			if cfg.Issuer == "" {
+				return fmt.Errorf("issuer is required")
+			}
+			if len(cfg.Scopes) == 0 {
+				cfg.Scopes = []string{"openid", "email", "profile"}
+			}
+			if cfg.AuthURL == "" || cfg.TokenURL == "" || cfg.JWKSURL == "" {
+				return discoverOIDC(cfg)
+			}
+			return nil
+		},
+		signIn: true,
+	},
+}
+
+func setDefault(s *string, value string) {
+	if *s == "" {
+		*s = value
+	}
+}
+
+// NewOAuthProvider sets up the provider declared by cfg.
+func NewOAuthProvider(cfg ProviderConfig) (*OAuthProvider, error) {
+	setDefault(&cfg.Kind, cfg.Name)
+	kind, ok := providerKinds[cfg.Kind]
+	if !ok {
+		return nil, fmt.Errorf("oauth provider %v: unknown kind %q", cfg.Name, cfg.Kind)
+	}
+	if kind.defaults != nil {
+		err := kind.defaults(&cfg)
+		if err != nil {
+			return nil, fmt.Errorf("oauth provider %v: %w", cfg.Name, err)
+		}
+	}
+	setDefault(&cfg.Title, cfg.Name)
+	if cfg.ClientID == "" || cfg.AuthURL == "" || cfg.TokenURL == "" {
+		return nil, fmt.Errorf("oauth provider %v: client ID, auth URL and token URL are required", cfg.Name)
+	}
+	provider := OAuthProvider{
+		Name:  cfg.Name,
+		Title: cfg.Title,
+		Config: &oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			Scopes:       cfg.Scopes,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  cfg.AuthURL,
+				TokenURL: cfg.TokenURL,
+			},
+		},
+		AuthParams: cfg.AuthParams,
+	}
+	if kind.files != nil {
+		provider.Files = kind.files(cfg)
+	}
+	if kind.signIn {
+		provider.OIDC = &OIDCVerifier{
+			Issuer:   cfg.Issuer,
+			ClientID: cfg.ClientID,
+			JWKSURL:  cfg.JWKSURL,
+		}
+	}
+	return &provider, nil
+}
+
+// Providers are the configured providers by name.
+type Providers map[string]*OAuthProvider
+
+// WithFiles returns the providers whose files can be imported, by name.
+func (providers Providers) WithFiles() []*OAuthProvider {
+	return providers.filter(func(provider *OAuthProvider) bool {
+		return provider.Files != nil
+	})
+}
+
+// SignIn returns the providers users can sign in with, by name.
+func (providers Providers) SignIn() []*OAuthProvider {
+	return providers.filter(func(provider *OAuthProvider) bool {
+		return provider.OIDC != nil
+	})
+}
+
+func (providers Providers) filter(keep func(provider *OAuthProvider) bool) []*OAuthProvider {
+	var list []*OAuthProvider
+	for _, provider := range providers {
+		if keep(provider) {
+			list = append(list, provider)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
@@ -0,0 +1,250 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// Quota limits what a user can store. A zero field means unlimited.
+type Quota struct {
+	// MaxBytes is the total size of all images in the user's galleries.
+	MaxBytes            int64
+	MaxImagesPerGallery int
+	MaxGalleries        int
+	MaxFileSize         int64
+}
+
+// Usage is how much of their Quota a user has used.
+type Usage struct {
+	Bytes     int64
+	Galleries int
+}
+
+// QuotaError is returned when an action would take a user over one of their
+// quotas. Issue is suitable for showing to the user.
+type QuotaError struct {
+	Issue string
+}
+
+func (qe QuotaError) Error() string {
+	return fmt.Sprintf("quota exceeded: %v", qe.Issue)
+}
+
+// QuotaService looks up and enforces user quotas. Defaults apply to every
+// user, and can be overridden per user in the user_quotas table.
+type QuotaService struct {
+	DB       *sql.DB
+	Defaults Quota
+}
+
+// ForUser returns the quota that applies to the user.
+func (qs *QuotaService) ForUser(userID int) (Quota, error) {
+	quota, err := qs.forUser(qs.DB, userID)
+	if err != nil {
+		return Quota{}, fmt.Errorf("quota for user: %w", err)
+	}
+	return quota, nil
+}
+
+// Usage returns how much the user is currently storing. Images in the trash
+// count towards the bytes used until they are purged, since they still take
+// up space.
+func (qs *QuotaService) Usage(userID int) (Usage, error) {
+	var usage Usage
+	row := qs.DB.QueryRow(`
+	SELECT
+		(SELECT COALESCE(SUM(images.size), 0)
+		 FROM images JOIN galleries ON galleries.id = images.gallery_id
+		 WHERE galleries.user_id = $1),
+		(SELECT COUNT(*) FROM galleries WHERE user_id = $1 AND deleted_at IS NULL);`, userID)
+	err := row.Scan(&usage.Bytes, &usage.Galleries)
+	if err != nil {
+		return Usage{}, fmt.Errorf("quota usage: %w", err)
+	}
+	return usage, nil
+}
+
+// CheckImage reports whether an image of the given size could currently be
+// added to the gallery. It lets resumable uploads fail before any bytes are
+// sent; the limits are enforced again when the image is created.
+func (qs *QuotaService) CheckImage(galleryID int, size int64) error {
+	tx, err := qs.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("check quota: %w", err)
+	}
+	defer tx.Rollback()
+	return qs.checkImage(tx, galleryID, size)
+}
+
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func (qs *QuotaService) forUser(q queryRower, userID int) (Quota, error) {
+	quota := qs.Defaults
+	var maxBytes, maxImages, maxGalleries, maxFileSize sql.NullInt64
+	row := q.QueryRow(`
+	SELECT max_bytes, max_images_per_gallery, max_galleries, max_file_size
+	FROM user_quotas
+	WHERE user_id = $1;`, userID)
+	err := row.Scan(&maxBytes, &maxImages, &maxGalleries, &maxFileSize)
+	if errors.Is(err, sql.ErrNoRows) {
+		return quota, nil
+	}
+	if err != nil {
+		return Quota{}, err
+	}
+	if maxBytes.Valid {
+		quota.MaxBytes = maxBytes.Int64
+	}
+	if maxImages.Valid {
+		quota.MaxImagesPerGallery = int(maxImages.Int64)
+	}
+	if maxGalleries.Valid {
+		quota.MaxGalleries = int(maxGalleries.Int64)
+	}
+	if maxFileSize.Valid {
+		quota.MaxFileSize = maxFileSize.Int64
+	}
+	return quota, nil
+}
+
+// lockUser serialises quota checks for a user until tx finishes, so that
+// concurrent uploads cannot each squeeze in under a limit. The lock does not
+// conflict with the key share locks taken by inserts referencing the user,
+// such as signing in.
+func (qs *QuotaService) lockUser(tx *sql.Tx, userID int) error {
+	var id int
+	row := tx.QueryRow(`
+	SELECT id
+	FROM users
+	WHERE id = $1
+	FOR NO KEY UPDATE;`, userID)
+	return row.Scan(&id)
+}
+
+// precheckImage checks the quota like checkImage, for turning away an upload
+// before the work of storing it. The quota still has to be checked when the
+// image is inserted.
+func (qs *QuotaService) precheckImage(galleryID int, size int64) error {
+	tx, err := qs.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("check quota: %w", err)
+	}
+	defer tx.Rollback()
+	return qs.checkImage(tx, galleryID, size)
+}
+
+// checkImage checks the quota of the gallery's owner before an image of the
+// given size is added to it in tx. The owner stays locked until tx finishes.
+func (qs *QuotaService) checkImage(tx *sql.Tx, galleryID int, size int64) error {
+	var ownerID int
+	row := tx.QueryRow(`
+	SELECT user_id
+	FROM galleries
+	WHERE id = $1;`, galleryID)
+	err := row.Scan(&ownerID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("check quota: %w", err)
+	}
+	err = qs.lockUser(tx, ownerID)
+	if err != nil {
+		return fmt.Errorf("check quota: %w", err)
+	}
+	quota, err := qs.forUser(tx, ownerID)
+	if err != nil {
+		return fmt.Errorf("check quota: %w", err)
+	}
+
+	if quota.MaxFileSize > 0 && size > quota.MaxFileSize {
+		return fileTooLarge(quota.MaxFileSize)
+	}
+	if quota.MaxImagesPerGallery > 0 {
+		var images int
+		row = tx.QueryRow(`
+		SELECT COUNT(*)
+		FROM images
+		WHERE gallery_id = $1 AND deleted_at IS NULL;`, galleryID)
+		err = row.Scan(&images)
+		if err != nil {
+			return fmt.Errorf("check quota: %w", err)
+		}
+		if images >= quota.MaxImagesPerGallery {
+			return QuotaError{
+				Issue: fmt.Sprintf("a gallery can hold at most %d images", quota.MaxImagesPerGallery),
+			}
+		}
+	}
+	if quota.MaxBytes > 0 {
+		var used int64
+		row = tx.QueryRow(`
+		SELECT COALESCE(SUM(images.size), 0)
+		FROM images JOIN galleries ON galleries.id = images.gallery_id
+		WHERE galleries.user_id = $1;`, ownerID)
+		err = row.Scan(&used)
+		if err != nil {
+			return fmt.Errorf("check quota: %w", err)
+		}
+		if used+size > quota.MaxBytes {
+			return QuotaError{
+				Issue: fmt.Sprintf("your %v of storage is full (%v used)",
+					FormatBytes(quota.MaxBytes), FormatBytes(used)),
+			}
+		}
+	}
+	return nil
+}
+
+func fileTooLarge(maxSize int64) QuotaError {
+	return QuotaError{
+		Issue: fmt.Sprintf("files can be at most %v", FormatBytes(maxSize)),
+	}
+}
+
+// checkGallery checks the user's quota before a gallery is created in tx.
+func (qs *QuotaService) checkGallery(tx *sql.Tx, userID int) error {
+	err := qs.lockUser(tx, userID)
+	if err != nil {
+		return fmt.Errorf("check quota: %w", err)
+	}
+	quota, err := qs.forUser(tx, userID)
+	if err != nil {
+		return fmt.Errorf("check quota: %w", err)
+	}
+	if quota.MaxGalleries <= 0 {
+		return nil
+	}
+	var galleries int
+	row := tx.QueryRow(`
+	SELECT COUNT(*)
+	FROM galleries
+	WHERE user_id = $1 AND deleted_at IS NULL;`, userID)
+	err = row.Scan(&galleries)
+	if err != nil {
+		return fmt.Errorf("check quota: %w", err)
+	}
+	if galleries >= quota.MaxGalleries {
+		return QuotaError{
+			Issue: fmt.Sprintf("you can have at most %d galleries", quota.MaxGalleries),
+		}
+	}
+	return nil
+}
+
+// FormatBytes formats n using the largest fitting binary unit, eg "1.5 MB".
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
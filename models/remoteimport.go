@@ -0,0 +1,44 @@
+package models
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+)
+
+// ImportFolder adds every image directly in a folder of the user's cloud
+// storage to the gallery, through CreateImage like any upload. Results are
+// reported per file as for ImportZip; files that are not images are skipped
+// without being downloaded. An error is only returned when the folder cannot
+// be listed.
+func (service *GalleryService) ImportFolder(files FileProvider, client *http.Client, galleryID, uploaderID int, folder string) ([]ZipEntryResult, error) {
+	entries, err := ListFolder(files, client, folder)
+	if err != nil {
+		return nil, fmt.Errorf("import folder: %w", err)
+	}
+	var results []ZipEntryResult
+	for _, entry := range entries {
+		if entry.Folder {
+			continue
+		}
+		result := ZipEntryResult{Name: entry.Name}
+		err := checkExtension(entry.Name, service.extensions())
+		if err == nil {
+			result.Image, err = service.importRemoteFile(files, client, galleryID, uploaderID, entry)
+		}
+		if err != nil {
+			result.Err = fmt.Errorf("import remote file %v: %w", entry.Path, err)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (service *GalleryService) importRemoteFile(files FileProvider, client *http.Client, galleryID, uploaderID int, entry RemoteEntry) (*Image, error) {
+	contents, err := files.Download(client, entry)
+	if err != nil {
+		return nil, err
+	}
+	defer contents.Close()
+	return service.CreateImage(galleryID, uploaderID, path.Base(entry.Name), contents)
+}
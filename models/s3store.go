@@ -0,0 +1,329 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Store is an ImageStore backed by any S3-compatible object store (AWS S3,
+// MinIO, ...). Requests are signed with AWS Signature Version 4 and always use
+// path-style URLs (Endpoint/Bucket/Key), which every compatible server
+// supports.
+type S3Store struct {
+	// Endpoint is the base URL of the server, eg "http://localhost:9000".
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// Client is used to make requests. Defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// unsignedPayload is used instead of hashing request bodies so uploads can be
+// streamed. The transport (TLS) is relied upon for body integrity.
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+func (s3 *S3Store) Put(key string, contents io.Reader, size int64, contentType string) error {
+	if size < 0 {
+		return fmt.Errorf("s3 store put: size of %q is unknown", key)
+	}
+	req, err := s3.request(http.MethodPut, key, nil, contents)
+	if err != nil {
+		return fmt.Errorf("s3 store put: %w", err)
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := s3.do(req)
+	if err != nil {
+		return fmt.Errorf("s3 store put: %w", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s3 *S3Store) Get(key string) (io.ReadCloser, ObjectInfo, error) {
+	req, err := s3.request(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, ObjectInfo{}, fmt.Errorf("s3 store get: %w", err)
+	}
+	resp, err := s3.do(req)
+	if err != nil {
+		return nil, ObjectInfo{}, fmt.Errorf("s3 store get: %w", err)
+	}
+	return resp.Body, s3.info(key, resp), nil
+}
+
+func (s3 *S3Store) GetRange(key string, offset int64) (io.ReadCloser, error) {
+	req, err := s3.request(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("s3 store get range: %w", err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	resp, err := s3.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3 store get range: %w", err)
+	}
+	// A server that ignores the range sends the whole object.
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 store get range: status %d", resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+func (s3 *S3Store) Stat(key string) (ObjectInfo, error) {
+	req, err := s3.request(http.MethodHead, key, nil, nil)
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("s3 store stat: %w", err)
+	}
+	resp, err := s3.do(req)
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("s3 store stat: %w", err)
+	}
+	resp.Body.Close()
+	return s3.info(key, resp), nil
+}
+
+func (s3 *S3Store) Delete(key string) error {
+	req, err := s3.request(http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return fmt.Errorf("s3 store delete: %w", err)
+	}
+	resp, err := s3.do(req)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil
+		}
+		return fmt.Errorf("s3 store delete: %w", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s3 *S3Store) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	query := url.Values{
+		"list-type": {"2"},
+		"prefix":    {prefix},
+	}
+	for {
+		req, err := s3.request(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, fmt.Errorf("s3 store list: %w", err)
+		}
+		resp, err := s3.do(req)
+		if err != nil {
+			return nil, fmt.Errorf("s3 store list: %w", err)
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3 store list: %w", err)
+		}
+		for _, c := range result.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:          c.Key,
+				Size:         c.Size,
+				LastModified: c.LastModified,
+			})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (s3 *S3Store) DeletePrefix(prefix string) error {
+	objects, err := s3.List(prefix)
+	if err != nil {
+		return fmt.Errorf("s3 store delete prefix: %w", err)
+	}
+	for _, object := range objects {
+		err = s3.Delete(object.Key)
+		if err != nil {
+			return fmt.Errorf("s3 store delete prefix: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s3 *S3Store) request(method, key string, query url.Values, body io.Reader) (*http.Request, error) {
+	endpoint, err := url.Parse(s3.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parse endpoint: %w", err)
+	}
+	endpoint.Path = "/" + s3.Bucket
+	if key != "" {
+		endpoint.Path += "/" + key
+	}
+	endpoint.RawPath = s3EscapePath(endpoint.Path)
+	endpoint.RawQuery = s3CanonicalQuery(query)
+	return http.NewRequest(method, endpoint.String(), body)
+}
+
+// do signs and sends the request, and turns non 2xx responses into errors. A
+// 404 is reported as ErrNotFound.
+func (s3 *S3Store) do(req *http.Request) (*http.Response, error) {
+	s3.sign(req, time.Now().UTC())
+	client := s3.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, fmt.Errorf("%s %s: status %d: %s", req.Method, req.URL.Path, resp.StatusCode, msg)
+}
+
+func (s3 *S3Store) info(key string, resp *http.Response) ObjectInfo {
+	info := ObjectInfo{
+		Key:         key,
+		Size:        resp.ContentLength,
+		ContentType: resp.Header.Get("Content-Type"),
+	}
+	if size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil {
+		info.Size = size
+	}
+	if lm, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.LastModified = lm
+	}
+	return info
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req, signing
+// the host, any range and every x-amz- header. The payload is left unsigned
+// unless X-Amz-Content-Sha256 is already set.
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (s3 *S3Store) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if req.Header.Get("X-Amz-Content-Sha256") == "" {
+		req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	}
+
+	headers := map[string]string{
+		"host": req.URL.Host,
+	}
+	for name := range req.Header {
+		name = strings.ToLower(name)
+		if name == "range" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	scope := date + "/" + s3.Region + "/s3/aws4_request"
+	hashedRequest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(hashedRequest[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s3.SecretAccessKey), date)
+	key = hmacSHA256(key, s3.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes everything except the unreserved characters, as
+// required by SigV4.
+func s3Escape(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			sb.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&sb, "%%%02X", c)
+	}
+	return sb.String()
+}
+
+func s3EscapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = s3Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	var pairs []string
+	for k, vs := range query {
+		for _, v := range vs {
+			pairs = append(pairs, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
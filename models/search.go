@@ -0,0 +1,98 @@
+package models
+
+import (
+	"fmt"
+)
+
+// Galleries and images carry a tsvector that triggers keep up to date (see
+// migrations/00014_search.sql). Gallery titles weigh more than descriptions,
+// and image tags more than captions, filenames and alt text.
+
+const (
+	// HighlightStart and HighlightEnd surround the matched words in
+	// SearchResult.Headline. They are private use characters that do not
+	// occur in ordinary text, so they can be swapped for markup once the
+	// headline has been escaped.
+	HighlightStart = "\ue000"
+	HighlightEnd   = "\ue001"
+)
+
+type SearchResultKind string
+
+const (
+	SearchResultGallery SearchResultKind = "gallery"
+	SearchResultImage   SearchResultKind = "image"
+)
+
+// SearchResult is a gallery or image matching a search. Filename is only set
+// for images.
+type SearchResult struct {
+	Kind         SearchResultKind
+	GalleryID    int
+	GalleryTitle string
+	Filename     string
+	Rank         float64
+	// Headline is an excerpt of the matching text, with the matched words
+	// wrapped in HighlightStart and HighlightEnd.
+	Headline string
+}
+
+// Search finds the galleries and images matching query that the user can
+// view, best matches first. userID is 0 for anonymous users, who only see
+// public galleries. The query supports web search syntax: "quoted phrases",
+// OR and -excluded words.
+func (service *GalleryService) Search(userID int, query string, offset, limit int) ([]SearchResult, error) {
+	// Headlines are only generated for the page of results that is returned,
+	// as ts_headline has to re-parse the text.
+	rows, err := service.DB.Query(`
+	WITH q AS (
+		SELECT websearch_to_tsquery('english', $2) AS query
+	), visible AS (
+		SELECT id, title, description, search
+		FROM galleries
+		WHERE deleted_at IS NULL
+			AND (user_id = $1 OR gallery_visibility(visibility, collection_id) = 'public'
+				OR id IN (
+					SELECT gallery_id
+					FROM gallery_collaborators
+					WHERE user_id = $1))
+	), matches AS (
+		SELECT 'gallery' AS kind, g.id AS gallery_id, g.title, '' AS filename,
+			ts_rank(g.search, q.query) AS rank,
+			concat_ws(' - ', g.title, NULLIF(g.description, '')) AS doc
+		FROM visible g, q
+		WHERE g.search @@ q.query
+		UNION ALL
+		SELECT 'image', g.id, g.title, i.filename,
+			ts_rank(i.search, q.query),
+			concat_ws(' - ', NULLIF(i.caption, ''), NULLIF(array_to_string(i.tags, ', '), ''), i.filename)
+		FROM images i JOIN visible g ON g.id = i.gallery_id, q
+		WHERE i.deleted_at IS NULL AND i.search @@ q.query
+		ORDER BY rank DESC, gallery_id, filename
+		LIMIT $3 OFFSET $4
+	)
+	SELECT kind, gallery_id, title, filename, rank,
+		ts_headline('english', doc, q.query,
+			'StartSel=' || $5 || ', StopSel=' || $6 || ', MaxFragments=2, MaxWords=20, MinWords=8')
+	FROM matches, q
+	ORDER BY rank DESC, gallery_id, filename;`,
+		userID, query, limit, offset, HighlightStart, HighlightEnd)
+	if err != nil {
+		return nil, fmt.Errorf("search: %w", err)
+	}
+	defer rows.Close()
+	var results []SearchResult
+	for rows.Next() {
+		var result SearchResult
+		err = rows.Scan(&result.Kind, &result.GalleryID, &result.GalleryTitle, &result.Filename,
+			&result.Rank, &result.Headline)
+		if err != nil {
+			return nil, fmt.Errorf("search: %w", err)
+		}
+		results = append(results, result)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("search: %w", err)
+	}
+	return results, nil
+}
@@ -5,7 +5,9 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"time"
 )
 
 type Session struct {
@@ -17,6 +19,15 @@ type Session struct {
 	// in our database and we cannot reverse it into a raw token
 	Token     string // 这个值不进行存储，否则攻击者会获取该值并伪造用户
 	TokenHash string
+
+	// The device the user signed in on. LastSeenAt is updated at most once a
+	// minute, see SessionSeenInterval.
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	IPAddress  string
+	UserAgent  string
+	// Current is set by Sessions for the session it was called with.
+	Current bool
 }
 
 type SessionService struct {
@@ -26,13 +37,38 @@ type SessionService struct {
 	// MinBytesPerToken const it will be ignored and MinBytesPerToken will be
 	// used
 	BytesPerToken int
+	// IdleTimeout is how long a session lasts without being used. Defaults to
+	// DefaultSessionIdleTimeout.
+	IdleTimeout time.Duration
+	// MaxAge is how long a session lasts however much it is used, so that a
+	// stolen token does not work for ever. Defaults to DefaultSessionMaxAge.
+	MaxAge time.Duration
 }
 
 const (
 	// The minimum number of bytes to be used for each session token.
 	MinBytesPerToken = 32
+	// SessionSeenInterval is how often a session's LastSeenAt is updated
+	// while it is in use, so that not every request writes to the database.
+	SessionSeenInterval = time.Minute
+	// DefaultSessionIdleTimeout is the default SessionService.IdleTimeout.
+	DefaultSessionIdleTimeout = 30 * 24 * time.Hour
+	// DefaultSessionMaxAge is the default SessionService.MaxAge.
+	DefaultSessionMaxAge = 90 * 24 * time.Hour
 )
 
+// expiry returns how long sessions last without being used, and at most.
+func (ss *SessionService) expiry() (idleTimeout, maxAge time.Duration) {
+	idleTimeout, maxAge = ss.IdleTimeout, ss.MaxAge
+	if idleTimeout == 0 {
+		idleTimeout = DefaultSessionIdleTimeout
+	}
+	if maxAge == 0 {
+		maxAge = DefaultSessionMaxAge
+	}
+	return idleTimeout, maxAge
+}
+
 // Create will create a new session for the user provided. The session token
 // will be returned as the Token field on the Session type, but only the hashed
 // session token is stored in the database.
@@ -76,7 +112,9 @@ const (
 // 	return &session, nil
 // }
 
-func (ss *SessionService) Create(userID int) (*Session, error) {
+// A user can be signed in on several devices at once, so every sign in
+// creates a new session and leaves the others alone.
+func (ss *SessionService) Create(userID int, ipAddress, userAgent string) (*Session, error) {
 	bytesPerToken := ss.BytesPerToken
 	if bytesPerToken < MinBytesPerToken {
 		bytesPerToken = MinBytesPerToken
@@ -89,14 +127,14 @@ func (ss *SessionService) Create(userID int) (*Session, error) {
 		UserID:    userID,
 		Token:     token,
 		TokenHash: ss.hash(token),
+		IPAddress: ipAddress,
+		UserAgent: userAgent,
 	}
 	row := ss.DB.QueryRow(`
-	INSERT INTO sessions (user_id, token_hash)
-	VALUES ($1, $2) ON CONFLICT (user_id) DO
-	UPDATE
-	SET token_hash = $2
-	RETURNING id;`, session.UserID, session.TokenHash)
-	err = row.Scan(&session.ID)
+	INSERT INTO sessions (user_id, token_hash, ip_address, user_agent)
+	VALUES ($1, $2, $3, $4)
+	RETURNING id, created_at, last_seen_at;`, session.UserID, session.TokenHash, ipAddress, userAgent)
+	err = row.Scan(&session.ID, &session.CreatedAt, &session.LastSeenAt)
 	if err != nil {
 		return nil, fmt.Errorf("create: %w", err)
 	}
@@ -140,15 +178,30 @@ func (ss *SessionService) Create(userID int) (*Session, error) {
 // 	return &user, nil
 // }
 
+// User also records that the session is still in use. Expired sessions are
+// not found.
 func (ss *SessionService) User(token string) (*User, error) {
 	tokenHash := ss.hash(token)
+	idleTimeout, maxAge := ss.expiry()
 	var user User
 	// SELECT 表示
 	row := ss.DB.QueryRow(
-		`SELECT users.id,users.email,users.password_hash
-		FROM sessions
-		JOIN users ON users.id = sessions.user_id
-		WHERE sessions.token_hash = $1;`, tokenHash)
+		`WITH valid AS (
+			SELECT id, user_id, last_seen_at
+			FROM sessions
+			WHERE token_hash = $1
+				AND last_seen_at > now() - make_interval(secs => $3)
+				AND created_at > now() - make_interval(secs => $4)
+		), seen AS (
+			UPDATE sessions
+			SET last_seen_at = now()
+			FROM valid
+			WHERE sessions.id = valid.id AND valid.last_seen_at < now() - make_interval(secs => $2)
+		)
+		SELECT users.id,users.email,users.password_hash
+		FROM valid
+		JOIN users ON users.id = valid.user_id;`, tokenHash, SessionSeenInterval.Seconds(),
+		idleTimeout.Seconds(), maxAge.Seconds())
 	err := row.Scan(&user.ID, &user.Email, &user.PasswordHash)
 	if err != nil {
 		return nil, fmt.Errorf("user: %w", err)
@@ -156,6 +209,42 @@ func (ss *SessionService) User(token string) (*User, error) {
 	return &user, nil
 }
 
+// Sessions returns every session of the user signed in with token, most
+// recently used first.
+func (ss *SessionService) Sessions(token string) ([]Session, error) {
+	tokenHash := ss.hash(token)
+	idleTimeout, maxAge := ss.expiry()
+	rows, err := ss.DB.Query(`
+	SELECT id, user_id, token_hash, created_at, last_seen_at, ip_address, user_agent
+	FROM sessions
+	WHERE user_id = (
+			SELECT user_id
+			FROM sessions
+			WHERE token_hash = $1)
+		AND last_seen_at > now() - make_interval(secs => $2)
+		AND created_at > now() - make_interval(secs => $3)
+	ORDER BY last_seen_at DESC, id DESC;`, tokenHash, idleTimeout.Seconds(), maxAge.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("query sessions: %w", err)
+	}
+	defer rows.Close()
+	var sessions []Session
+	for rows.Next() {
+		var session Session
+		err = rows.Scan(&session.ID, &session.UserID, &session.TokenHash, &session.CreatedAt,
+			&session.LastSeenAt, &session.IPAddress, &session.UserAgent)
+		if err != nil {
+			return nil, fmt.Errorf("query sessions: %w", err)
+		}
+		session.Current = session.TokenHash == tokenHash
+		sessions = append(sessions, session)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query sessions: %w", err)
+	}
+	return sessions, nil
+}
+
 // 验证用户session的方法：从请求的cookies获得session token；
 // 如果一个session token存在，对其hash，如果不存在，则表明用户没有login
 // 一旦有了hashed token，我们就会使用相同的token hash查找数据库，这将会帮助我们决定当前的user
@@ -197,6 +286,52 @@ func (ss *SessionService) Delete(token string) error {
 	return nil
 }
 
+// DeleteByID signs the user signed in with token out on the device of one of
+// their sessions, and reports whether it was the session for token.
+// ErrNotFound is returned if the session belongs to someone else.
+func (ss *SessionService) DeleteByID(token string, sessionID int) (current bool, err error) {
+	tokenHash := ss.hash(token)
+	row := ss.DB.QueryRow(`
+	DELETE FROM sessions
+	WHERE id = $1 AND user_id = (
+		SELECT user_id
+		FROM sessions
+		WHERE token_hash = $2)
+	RETURNING token_hash = $2;`, sessionID, tokenHash)
+	err = row.Scan(&current)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, ErrNotFound
+		}
+		return false, fmt.Errorf("delete session: %w", err)
+	}
+	return current, nil
+}
+
+// DeleteAll signs the user out everywhere.
+func (ss *SessionService) DeleteAll(userID int) error {
+	_, err := ss.DB.Exec(`
+	DELETE FROM sessions
+	WHERE user_id = $1;`, userID)
+	if err != nil {
+		return fmt.Errorf("delete sessions: %w", err)
+	}
+	return nil
+}
+
 // 如何使得用户等出，
 // Delete or invalidate the session in the database
 // Delete the user's session cookie
+
+// DeleteExpired removes the sessions that have expired.
+func (ss *SessionService) DeleteExpired() error {
+	idleTimeout, maxAge := ss.expiry()
+	_, err := ss.DB.Exec(`
+	DELETE FROM sessions
+	WHERE last_seen_at <= now() - make_interval(secs => $1)
+		OR created_at <= now() - make_interval(secs => $2);`, idleTimeout.Seconds(), maxAge.Seconds())
+	if err != nil {
+		return fmt.Errorf("delete expired sessions: %w", err)
+	}
+	return nil
+}
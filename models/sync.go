@@ -0,0 +1,298 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A gallery can be linked to a folder in its owner's cloud storage, eg their
+// Dropbox, and kept in sync by a background worker. Each sync imports the
+// images added to the folder since the last one, and imports changed images
+// again, moving the old copy to the trash. Images removed from the folder stay
+// in the gallery.
+
+// DefaultSyncInterval is how often a linked folder is synced when
+// SyncService.Interval is not set.
+const DefaultSyncInterval = 15 * time.Minute
+
+// GallerySync is the link between a gallery and a remote folder.
+type GallerySync struct {
+	GalleryID int
+	// UserID is the user whose account the folder is read with. Imported
+	// images are uploaded as them.
+	UserID   int
+	Provider string
+	Folder   string
+	// LastSyncedAt is zero until the first sync has run.
+	LastSyncedAt time.Time
+	// LastError describes what went wrong in the last sync, if anything. It
+	// is suitable for showing to the user.
+	LastError string
+
+	cursor string
+}
+
+type SyncService struct {
+	DB             *sql.DB
+	OAuthService   *OAuthService
+	GalleryService *GalleryService
+	// Providers are the configured OAuth providers. Folders can be linked at
+	// those with a file API.
+	Providers Providers
+	// Interval is how often each linked folder is synced. Defaults to
+	// DefaultSyncInterval.
+	Interval time.Duration
+}
+
+func (ss *SyncService) interval() time.Duration {
+	if ss.Interval <= 0 {
+		return DefaultSyncInterval
+	}
+	return ss.Interval
+}
+
+// Link keeps the gallery in sync with the folder in the user's account,
+// replacing any folder it was linked to before. The first sync runs as soon
+// as the worker gets to it.
+func (ss *SyncService) Link(galleryID, userID int, provider, folder string) (*GallerySync, error) {
+	if p, ok := ss.Providers[provider]; !ok || p.Files == nil {
+		return nil, fmt.Errorf("link gallery: %w", ValidationError{
+			Issue: fmt.Sprintf("folders cannot be synced from %v", provider),
+		})
+	}
+	sync := GallerySync{
+		GalleryID: galleryID,
+		UserID:    userID,
+		Provider:  provider,
+		Folder:    folder,
+	}
+	_, err := ss.DB.Exec(`
+	INSERT INTO gallery_syncs (gallery_id, user_id, provider, folder)
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (gallery_id) DO UPDATE
+	SET user_id = EXCLUDED.user_id, provider = EXCLUDED.provider, folder = EXCLUDED.folder,
+		cursor = '', next_sync_at = now(), last_synced_at = NULL, last_error = '';`,
+		galleryID, userID, provider, folder)
+	if err != nil {
+		return nil, fmt.Errorf("link gallery: %w", err)
+	}
+	return &sync, nil
+}
+
+// ByGalleryID returns the gallery's link, or ErrNotFound if it is not linked
+// to a folder.
+func (ss *SyncService) ByGalleryID(galleryID int) (*GallerySync, error) {
+	row := ss.DB.QueryRow(`
+	SELECT gallery_id, user_id, provider, folder, cursor, last_synced_at, last_error
+	FROM gallery_syncs
+	WHERE gallery_id = $1;`, galleryID)
+	sync, err := scanGallerySync(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("query gallery sync: %w", err)
+	}
+	return &sync, nil
+}
+
+func scanGallerySync(row scanner) (GallerySync, error) {
+	var sync GallerySync
+	var lastSyncedAt sql.NullTime
+	err := row.Scan(&sync.GalleryID, &sync.UserID, &sync.Provider, &sync.Folder, &sync.cursor,
+		&lastSyncedAt, &sync.LastError)
+	sync.LastSyncedAt = lastSyncedAt.Time
+	return sync, err
+}
+
+// Unlink stops syncing the gallery. The images imported so far are kept.
+func (ss *SyncService) Unlink(galleryID int) error {
+	_, err := ss.DB.Exec(`
+	DELETE FROM gallery_syncs
+	WHERE gallery_id = $1;`, galleryID)
+	if err != nil {
+		return fmt.Errorf("unlink gallery: %w", err)
+	}
+	return nil
+}
+
+// SyncSoon moves the gallery's next sync forward to the worker's next run.
+func (ss *SyncService) SyncSoon(galleryID int) error {
+	result, err := ss.DB.Exec(`
+	UPDATE gallery_syncs
+	SET next_sync_at = now()
+	WHERE gallery_id = $1;`, galleryID)
+	if err != nil {
+		return fmt.Errorf("sync gallery soon: %w", err)
+	}
+	return requireRow(result, "sync gallery soon")
+}
+
+// SyncDue syncs every linked gallery whose next sync is due. Each gallery is
+// claimed before it is synced, so several workers can run at once. Problems
+// with a gallery are recorded in its LastError; unexpected ones are returned
+// as well, once every gallery has had its turn.
+func (ss *SyncService) SyncDue() error {
+	var errs []error
+	for {
+		// Galleries in the trash are skipped until they are restored.
+		row := ss.DB.QueryRow(`
+		UPDATE gallery_syncs
+		SET next_sync_at = now() + make_interval(secs => $1)
+		WHERE gallery_id = (
+			SELECT gallery_syncs.gallery_id
+			FROM gallery_syncs
+			JOIN galleries ON galleries.id = gallery_syncs.gallery_id
+			WHERE gallery_syncs.next_sync_at <= now() AND galleries.deleted_at IS NULL
+			ORDER BY gallery_syncs.next_sync_at
+			LIMIT 1
+			FOR UPDATE OF gallery_syncs SKIP LOCKED)
+		RETURNING gallery_id, user_id, provider, folder, cursor, last_synced_at, last_error;`,
+			ss.interval().Seconds())
+		sync, err := scanGallerySync(row)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return errors.Join(errs...)
+			}
+			return fmt.Errorf("sync due galleries: %w", err)
+		}
+		err = ss.sync(&sync)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("sync gallery %d: %w", sync.GalleryID, err))
+		}
+	}
+}
+
+// sync imports what changed in the gallery's folder and records the outcome.
+// Errors the user can fix, such as an expired connection, are only recorded.
+func (ss *SyncService) sync(sync *GallerySync) error {
+	cursor, problems, syncErr := ss.importChanges(sync)
+	if syncErr != nil {
+		// The cursor is kept, so the next sync retries the files that were
+		// not imported.
+		cursor = sync.cursor
+		var issue string
+		issue, syncErr = ss.errorIssue(sync, syncErr)
+		problems = append([]string{issue}, problems...)
+	}
+	_, err := ss.DB.Exec(`
+	UPDATE gallery_syncs
+	SET cursor = $2, last_synced_at = now(), last_error = $3
+	WHERE gallery_id = $1;`, sync.GalleryID, cursor, strings.Join(problems, " "))
+	if err != nil {
+		return fmt.Errorf("record gallery sync: %w", err)
+	}
+	return syncErr
+}
+
+// importChanges imports the images added or changed since the sync's cursor
+// and returns the new cursor. Images that cannot be imported because they are
+// invalid or over quota are reported in problems and skipped for good; any
+// other error stops the sync.
+func (ss *SyncService) importChanges(sync *GallerySync) (cursor string, problems []string, err error) {
+	provider, ok := ss.Providers[sync.Provider]
+	if !ok || provider.Files == nil {
+		return "", nil, fmt.Errorf("import changes: provider %q is not configured", sync.Provider)
+	}
+	client, err := ss.OAuthService.Client(context.Background(), provider.Config, sync.UserID, sync.Provider)
+	if err != nil {
+		return "", nil, err
+	}
+	entries, cursor, err := provider.Files.ListChanges(client, sync.Folder, sync.cursor)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, entry := range entries {
+		if entry.Folder || !ss.GalleryService.IsImageFilename(entry.Name) {
+			continue
+		}
+		issue, err := ss.importEntry(provider.Files, client, sync, entry)
+		if err != nil {
+			return "", problems, err
+		}
+		if issue != "" {
+			problems = append(problems, fmt.Sprintf("%v was not imported: %v.", entry.Name, issue))
+		}
+	}
+	return cursor, problems, nil
+}
+
+// importEntry imports a file unless the same revision was imported before.
+// If the file cannot be imported, issue says why.
+func (ss *SyncService) importEntry(files FileProvider, client *http.Client, sync *GallerySync, entry RemoteEntry) (issue string, err error) {
+	var rev string
+	var previousID sql.NullInt64
+	row := ss.DB.QueryRow(`
+	SELECT rev, image_id
+	FROM gallery_sync_files
+	WHERE gallery_id = $1 AND remote_id = $2;`, sync.GalleryID, entry.ID)
+	err = row.Scan(&rev, &previousID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("import synced file: %w", err)
+	}
+	if rev == entry.Rev {
+		return "", nil
+	}
+	image, err := ss.GalleryService.importRemoteFile(files, client, sync.GalleryID, sync.UserID, entry)
+	if err != nil {
+		var fileErr FileError
+		var quotaErr QuotaError
+		switch {
+		case errors.As(err, &fileErr):
+			issue = fileErr.Issue
+		case errors.As(err, &quotaErr):
+			issue = quotaErr.Issue
+		default:
+			return "", fmt.Errorf("import synced file: %w", err)
+		}
+	}
+	var imageID sql.NullInt64
+	if image != nil {
+		imageID = sql.NullInt64{Int64: int64(image.ID), Valid: true}
+	}
+	// The revision is recorded even if it could not be imported, so it is
+	// not tried again until it changes.
+	_, err = ss.DB.Exec(`
+	INSERT INTO gallery_sync_files (gallery_id, remote_id, rev, image_id)
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (gallery_id, remote_id) DO UPDATE
+	SET rev = EXCLUDED.rev, image_id = COALESCE(EXCLUDED.image_id, gallery_sync_files.image_id);`,
+		sync.GalleryID, entry.ID, entry.Rev, imageID)
+	if err != nil {
+		return "", fmt.Errorf("import synced file: %w", err)
+	}
+	if image != nil && previousID.Valid {
+		// The new copy replaces the previous one, which can still be
+		// restored from the trash.
+		_, err = ss.DB.Exec(`
+		UPDATE images
+		SET deleted_at = now()
+		WHERE id = $1 AND deleted_at IS NULL;`, previousID.Int64)
+		if err != nil {
+			return "", fmt.Errorf("import synced file: %w", err)
+		}
+	}
+	return issue, nil
+}
+
+// errorIssue describes an error that stopped a sync to the user. err is
+// returned if it is unexpected.
+func (ss *SyncService) errorIssue(sync *GallerySync, err error) (string, error) {
+	title := sync.Provider
+	if provider, ok := ss.Providers[sync.Provider]; ok {
+		title = provider.Title
+	}
+	switch {
+	case errors.Is(err, ErrReconnect):
+		return fmt.Sprintf("The %v connection has expired. Connect %v again to resume syncing.", title, title), nil
+	case errors.Is(err, ErrNotFound):
+		// Either the account was disconnected or the folder is gone.
+		return fmt.Sprintf("The folder could not be found. Check that %v is connected and the folder still exists.", title), nil
+	}
+	return fmt.Sprintf("%v could not be reached. The sync will be retried.", title), err
+}
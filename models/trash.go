@@ -0,0 +1,281 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Deleting a gallery or image only moves it to the trash, from where its
+// owner can restore it. PurgeTrash permanently removes anything that has been
+// in the trash for longer than the retention period and frees its storage.
+
+// DefaultTrashRetention is how long deleted galleries and images are kept
+// when no other retention period is configured.
+const DefaultTrashRetention = 30 * 24 * time.Hour
+
+// Delete moves the gallery, along with its images, to the trash.
+func (service *GalleryService) Delete(id int) error {
+	result, err := service.DB.Exec(`
+	UPDATE galleries
+	SET deleted_at = now()
+	WHERE id = $1 AND deleted_at IS NULL;`, id)
+	if err != nil {
+		return fmt.Errorf("delete gallery by id: %w", err)
+	}
+	return requireRow(result, "delete gallery by id")
+}
+
+// DeleteImage moves the image to the trash.
+func (service *GalleryService) DeleteImage(galleryID int, filename string) error {
+	result, err := service.DB.Exec(`
+	UPDATE images
+	SET deleted_at = now()
+	WHERE gallery_id = $1 AND filename = $2 AND deleted_at IS NULL;`, galleryID, filename)
+	if err != nil {
+		return fmt.Errorf("deleting image: %w", err)
+	}
+	return requireRow(result, "deleting image")
+}
+
+// TrashedGalleries returns the user's galleries that are in the trash, most
+// recently deleted first.
+func (service *GalleryService) TrashedGalleries(userID int) ([]Gallery, error) {
+	rows, err := service.DB.Query(`
+	SELECT id, title, gallery_visibility(visibility, collection_id), deleted_at
+	FROM galleries
+	WHERE user_id = $1 AND deleted_at IS NOT NULL
+	ORDER BY deleted_at DESC;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("query trashed galleries: %w", err)
+	}
+	defer rows.Close()
+	var galleries []Gallery
+	for rows.Next() {
+		gallery := Gallery{
+			UserID: userID,
+		}
+		err := rows.Scan(&gallery.ID, &gallery.Title, &gallery.Visibility, &gallery.DeletedAt)
+		if err != nil {
+			return nil, fmt.Errorf("query trashed galleries: %w", err)
+		}
+		galleries = append(galleries, gallery)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query trashed galleries: %w", err)
+	}
+	return galleries, nil
+}
+
+// TrashedImages returns the images the user deleted from galleries that are
+// not themselves in the trash, most recently deleted first.
+func (service *GalleryService) TrashedImages(userID int) ([]Image, error) {
+	rows, err := service.DB.Query(`
+	SELECT `+imageColumns+`
+	FROM images
+	WHERE deleted_at IS NOT NULL AND gallery_id IN (
+		SELECT id FROM galleries WHERE user_id = $1 AND deleted_at IS NULL)
+	ORDER BY deleted_at DESC;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("query trashed images: %w", err)
+	}
+	defer rows.Close()
+	var images []Image
+	for rows.Next() {
+		image, err := scanImage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("query trashed images: %w", err)
+		}
+		images = append(images, image)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query trashed images: %w", err)
+	}
+	return images, nil
+}
+
+// RestoreGallery takes one of the user's galleries out of the trash. Images
+// that were deleted before the gallery stay in the trash. A QuotaError is
+// returned if the user has as many galleries as they can have.
+func (service *GalleryService) RestoreGallery(userID, galleryID int) error {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("restore gallery: %w", err)
+	}
+	defer tx.Rollback()
+	if service.Quotas != nil {
+		err = service.Quotas.checkGallery(tx, userID)
+		if err != nil {
+			return fmt.Errorf("restore gallery: %w", err)
+		}
+	}
+	result, err := tx.Exec(`
+	UPDATE galleries
+	SET deleted_at = NULL
+	WHERE id = $1 AND user_id = $2 AND deleted_at IS NOT NULL;`, galleryID, userID)
+	if err != nil {
+		return fmt.Errorf("restore gallery: %w", err)
+	}
+	err = requireRow(result, "restore gallery")
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("restore gallery: %w", err)
+	}
+	return nil
+}
+
+// RestoreImage takes one of the user's images out of the trash. A QuotaError
+// is returned if its gallery is full.
+func (service *GalleryService) RestoreImage(userID, imageID int) error {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("restore image: %w", err)
+	}
+	defer tx.Rollback()
+	var galleryID int
+	row := tx.QueryRow(`
+	SELECT gallery_id
+	FROM images
+	WHERE id = $1 AND deleted_at IS NOT NULL AND gallery_id IN (
+		SELECT id FROM galleries WHERE user_id = $2 AND deleted_at IS NULL);`, imageID, userID)
+	err = row.Scan(&galleryID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("restore image: %w", ErrNotFound)
+		}
+		return fmt.Errorf("restore image: %w", err)
+	}
+	if service.Quotas != nil {
+		// Trashed images still count against the storage quota, so no
+		// more space is needed and only the number of images is checked.
+		err = service.Quotas.checkImage(tx, galleryID, 0)
+		if err != nil {
+			return fmt.Errorf("restore image: %w", err)
+		}
+	}
+	result, err := tx.Exec(`
+	UPDATE images
+	SET deleted_at = NULL
+	WHERE id = $1 AND deleted_at IS NOT NULL;`, imageID)
+	if err != nil {
+		return fmt.Errorf("restore image: %w", err)
+	}
+	err = requireRow(result, "restore image")
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("restore image: %w", err)
+	}
+	return nil
+}
+
+// PurgeGallery permanently deletes one of the user's trashed galleries
+// without waiting for the retention period.
+func (service *GalleryService) PurgeGallery(userID, galleryID int) error {
+	var id int
+	row := service.DB.QueryRow(`
+	SELECT id
+	FROM galleries
+	WHERE id = $1 AND user_id = $2 AND deleted_at IS NOT NULL;`, galleryID, userID)
+	err := row.Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("purge gallery: %w", ErrNotFound)
+		}
+		return fmt.Errorf("purge gallery: %w", err)
+	}
+	return service.purgeGallery(id)
+}
+
+// PurgeImage permanently deletes one of the user's trashed images without
+// waiting for the retention period.
+func (service *GalleryService) PurgeImage(userID, imageID int) error {
+	var id int
+	row := service.DB.QueryRow(`
+	SELECT images.id
+	FROM images JOIN galleries ON galleries.id = images.gallery_id
+	WHERE images.id = $1 AND galleries.user_id = $2 AND images.deleted_at IS NOT NULL;`, imageID, userID)
+	err := row.Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("purge image: %w", ErrNotFound)
+		}
+		return fmt.Errorf("purge image: %w", err)
+	}
+	return service.purgeImage(id)
+}
+
+// PurgeTrash permanently deletes galleries and images that have been in the
+// trash for longer than retention. A failure to purge one item does not stop
+// the others; all errors are returned together.
+func (service *GalleryService) PurgeTrash(retention time.Duration) error {
+	cutoff := time.Now().Add(-retention)
+	galleryIDs, err := service.expiredIDs(`
+	SELECT id
+	FROM galleries
+	WHERE deleted_at < $1;`, cutoff)
+	if err != nil {
+		return fmt.Errorf("purge trash: %w", err)
+	}
+	imageIDs, err := service.expiredIDs(`
+	SELECT images.id
+	FROM images JOIN galleries ON galleries.id = images.gallery_id
+	WHERE images.deleted_at < $1 AND galleries.deleted_at IS NULL;`, cutoff)
+	if err != nil {
+		return fmt.Errorf("purge trash: %w", err)
+	}
+	var errs []error
+	for _, id := range galleryIDs {
+		err = service.purgeGallery(id)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, id := range imageIDs {
+		err = service.purgeImage(id)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("purge trash: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+func (service *GalleryService) expiredIDs(query string, cutoff time.Time) ([]int, error) {
+	rows, err := service.DB.Query(query, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// requireRow returns ErrNotFound if the statement behind result did not
+// affect any rows.
+func requireRow(result sql.Result, op string) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n == 0 {
+		return fmt.Errorf("%s: %w", op, ErrNotFound)
+	}
+	return nil
+}
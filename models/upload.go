@@ -0,0 +1,306 @@
+package models
+
+import (
+	"Gallery/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"time"
+)
+
+// Upload is a resumable upload of a single image. The client sends the file
+// in chunks, each appended at Offset, and the image is created once Offset
+// reaches Size. Chunks are kept in the gallery's ImageStore so that any
+// server instance can accept the next one.
+type Upload struct {
+	ID        string
+	GalleryID int
+	UserID    int
+	Filename  string
+	Size      int64
+	Offset    int64
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Complete reports whether every byte of the upload has been received.
+func (upload *Upload) Complete() bool {
+	return upload.Offset == upload.Size
+}
+
+type UploadService struct {
+	DB *sql.DB
+	// GalleryService creates the image once an upload completes. Its store
+	// also holds the chunks.
+	GalleryService *GalleryService
+}
+
+const (
+	// MaxUploadSize is the largest file accepted by a resumable upload.
+	MaxUploadSize = 200 << 20
+	// MaxUploadChunk is the largest chunk accepted in a single request.
+	MaxUploadChunk = 16 << 20
+	// UploadExpiry is how long an unfinished upload is kept after the last
+	// chunk was received.
+	UploadExpiry = 24 * time.Hour
+)
+
+func uploadPrefix(id string) string {
+	return fmt.Sprintf("uploads/%s/", id)
+}
+
+// chunkKey names chunks by their zero padded offset so that listing the
+// upload prefix returns them in order.
+func chunkKey(id string, offset int64) string {
+	return fmt.Sprintf("%s%020d", uploadPrefix(id), offset)
+}
+
+func (us *UploadService) Create(galleryID, userID int, filename string, size int64) (*Upload, error) {
+	filename = path.Base(filename)
+	err := checkExtension(filename, us.GalleryService.extensions())
+	if err != nil {
+		return nil, fmt.Errorf("create upload: %w", err)
+	}
+	if size <= 0 || size > MaxUploadSize {
+		return nil, fmt.Errorf("create upload: %w", FileError{
+			Issue: fmt.Sprintf("file size must be between 1 and %d bytes", MaxUploadSize),
+		})
+	}
+	if quotas := us.GalleryService.Quotas; quotas != nil {
+		err = quotas.CheckImage(galleryID, size)
+		if err != nil {
+			return nil, fmt.Errorf("create upload: %w", err)
+		}
+	}
+	idBytes, err := rand.Bytes(16)
+	if err != nil {
+		return nil, fmt.Errorf("create upload: %w", err)
+	}
+	upload := Upload{
+		ID:        hex.EncodeToString(idBytes),
+		GalleryID: galleryID,
+		UserID:    userID,
+		Filename:  filename,
+		Size:      size,
+	}
+	row := us.DB.QueryRow(`
+	INSERT INTO uploads (id, gallery_id, user_id, filename, size)
+	VALUES ($1, $2, $3, $4, $5)
+	RETURNING created_at, updated_at;`,
+		upload.ID, upload.GalleryID, upload.UserID, upload.Filename, upload.Size)
+	err = row.Scan(&upload.CreatedAt, &upload.UpdatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("create upload: %w", err)
+	}
+	return &upload, nil
+}
+
+func (us *UploadService) ByID(id string) (*Upload, error) {
+	upload := Upload{
+		ID: id,
+	}
+	row := us.DB.QueryRow(`
+	SELECT gallery_id, user_id, filename, size, "offset", created_at, updated_at
+	FROM uploads
+	WHERE id = $1;`, id)
+	err := row.Scan(&upload.GalleryID, &upload.UserID, &upload.Filename, &upload.Size,
+		&upload.Offset, &upload.CreatedAt, &upload.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("query upload by id: %w", err)
+	}
+	return &upload, nil
+}
+
+// WriteChunk stores n bytes read from chunk at the given offset. If offset is
+// not where the upload currently ends ErrUploadOffset is returned and
+// upload.Offset is refreshed, so the client can resume from there. A chunk
+// that fails part way is discarded entirely.
+func (us *UploadService) WriteChunk(upload *Upload, offset int64, chunk io.Reader, n int64) error {
+	if n < 0 || offset+n > upload.Size {
+		return fmt.Errorf("write chunk: %w", FileError{Issue: "chunk extends past the end of the file"})
+	}
+	tx, err := us.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("write chunk: %w", err)
+	}
+	defer tx.Rollback()
+
+	// The row lock serialises chunks of the same upload, so a retried request
+	// racing the original cannot append the same bytes twice.
+	row := tx.QueryRow(`
+	SELECT "offset"
+	FROM uploads
+	WHERE id = $1
+	FOR UPDATE;`, upload.ID)
+	err = row.Scan(&upload.Offset)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("write chunk: %w", err)
+	}
+	if upload.Offset != offset {
+		return ErrUploadOffset
+	}
+	if n == 0 {
+		return nil
+	}
+
+	// If the commit fails the cleanup worker removes the chunk, unless a
+	// retry has written it again by then.
+	cleanupID, err := us.GalleryService.queueCleanup("chunk", fmt.Sprintf("%s/%d", upload.ID, offset))
+	if err != nil {
+		return fmt.Errorf("write chunk: %w", err)
+	}
+	err = cancelCleanup(tx, cleanupID)
+	if err != nil {
+		return fmt.Errorf("write chunk: %w", err)
+	}
+	store := us.GalleryService.store()
+	key := chunkKey(upload.ID, offset)
+	err = store.Put(key, io.LimitReader(chunk, n), n, "application/octet-stream")
+	if err != nil {
+		store.Delete(key)
+		return fmt.Errorf("write chunk: %w", err)
+	}
+	_, err = tx.Exec(`
+	UPDATE uploads
+	SET "offset" = $2, updated_at = now()
+	WHERE id = $1;`, upload.ID, offset+n)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return fmt.Errorf("write chunk: %w", err)
+	}
+	upload.Offset = offset + n
+	return nil
+}
+
+// Finish creates the image from a complete upload and removes the upload,
+// queueing its chunks for cleanup. If the file is rejected (a FileError or
+// QuotaError) the upload is removed as well; other errors leave it in place
+// to be retried.
+func (us *UploadService) Finish(upload *Upload) (*Image, error) {
+	if !upload.Complete() {
+		return nil, fmt.Errorf("finish upload: only %d of %d bytes received", upload.Offset, upload.Size)
+	}
+	tx, err := us.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("finish upload: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Holding the row lock while the image is created stops a retried
+	// request from creating it a second time.
+	result, err := tx.Exec(`
+	DELETE FROM uploads
+	WHERE id = $1;`, upload.ID)
+	if err != nil {
+		return nil, fmt.Errorf("finish upload: %w", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("finish upload: %w", err)
+	}
+	if deleted == 0 {
+		// Another request finished the upload while we waited for the lock.
+		return nil, ErrNotFound
+	}
+	store := us.GalleryService.store()
+	chunks, err := store.List(uploadPrefix(upload.ID))
+	if err != nil {
+		return nil, fmt.Errorf("finish upload: %w", err)
+	}
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].Key < chunks[j].Key
+	})
+	contents := &chunkReader{store: store, chunks: chunks}
+	image, err := us.GalleryService.CreateImage(upload.GalleryID, upload.UserID, upload.Filename, contents)
+	contents.Close()
+	if err != nil {
+		var fileErr FileError
+		var quotaErr QuotaError
+		if errors.As(err, &fileErr) || errors.As(err, &quotaErr) {
+			tx.Commit()
+		}
+		return nil, fmt.Errorf("finish upload: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("finish upload: %w", err)
+	}
+	return image, nil
+}
+
+// Delete cancels an upload. The chunks received so far are queued for
+// cleanup.
+func (us *UploadService) Delete(upload *Upload) error {
+	_, err := us.DB.Exec(`
+	DELETE FROM uploads
+	WHERE id = $1;`, upload.ID)
+	if err != nil {
+		return fmt.Errorf("delete upload: %w", err)
+	}
+	return nil
+}
+
+// DeleteExpired removes uploads that have not received a chunk within
+// UploadExpiry.
+func (us *UploadService) DeleteExpired() error {
+	_, err := us.DB.Exec(`
+	DELETE FROM uploads
+	WHERE updated_at < $1;`, time.Now().Add(-UploadExpiry))
+	if err != nil {
+		return fmt.Errorf("delete expired uploads: %w", err)
+	}
+	return nil
+}
+
+// chunkReader reads the chunks of an upload one after another, opening each
+// only when the previous one is exhausted.
+type chunkReader struct {
+	store   ImageStore
+	chunks  []ObjectInfo
+	current io.ReadCloser
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if cr.current == nil {
+			if len(cr.chunks) == 0 {
+				return 0, io.EOF
+			}
+			rc, _, err := cr.store.Get(cr.chunks[0].Key)
+			if err != nil {
+				return 0, err
+			}
+			cr.current = rc
+			cr.chunks = cr.chunks[1:]
+		}
+		n, err := cr.current.Read(p)
+		if err == io.EOF {
+			cr.current.Close()
+			cr.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (cr *chunkReader) Close() error {
+	if cr.current != nil {
+		return cr.current.Close()
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strconv"
+)
+
+// ImageSize is a fixed-width variant generated for every uploaded image.
+type ImageSize struct {
+	Name  string
+	Width int
+}
+
+var (
+	SizeThumb  = ImageSize{Name: "thumb", Width: 320}
+	SizeMedium = ImageSize{Name: "medium", Width: 800}
+	SizeLarge  = ImageSize{Name: "large", Width: 1600}
+
+	// ImageSizes lists the variants generated for each image, largest first.
+	ImageSizes = []ImageSize{SizeLarge, SizeMedium, SizeThumb}
+)
+
+const (
+	// MaxImagePixels is the largest image (width * height) that will be decoded
+	// to generate variants. It guards against decompression bombs. Decoding
+	// and resizing one this large holds around 320MB. Larger images are stored
+	// all the same, but are served at full size.
+	MaxImagePixels = 40_000_000
+	// MaxConcurrentVariants is how many images can have their variants
+	// generated at once, which bounds the memory used by concurrent uploads.
+	MaxConcurrentVariants = 2
+)
+
+// variantSlots is a semaphore holding one token per variant generation in
+// progress. Variants are generated before the transaction recording the
+// image begins (see uploadBlob), so waiting for a slot holds no locks.
+var variantSlots = make(chan struct{}, MaxConcurrentVariants)
+
+// ParseImageSize looks up a variant by name ("thumb") or width ("320").
+func ParseImageSize(s string) (ImageSize, bool) {
+	width, _ := strconv.Atoi(s)
+	for _, size := range ImageSizes {
+		if size.Name == s || size.Width == width {
+			return size, true
+		}
+	}
+	return ImageSize{}, false
+}
+
+func (service *GalleryService) variantKey(hash string, width int) string {
+	return fmt.Sprintf("variants/%d/%s", width, hash)
+}
+
+// legacyVariantKey locates the variants of images stored before blobs were
+// introduced.
+func (service *GalleryService) legacyVariantKey(galleryID, width int, filename string) string {
+	return fmt.Sprintf("%svariants/%d/%s", service.galleryPrefix(galleryID), width, filename)
+}
+
+// createVariants decodes the blob and stores a resized copy for every
+// ImageSize narrower than it. The EXIF orientation is applied since the
+// variants carry no metadata. Sizes that would be upscaled, and every size of
+// an image over MaxImagePixels, are skipped and served from the original
+// instead.
+func (service *GalleryService) createVariants(hash, contentType string, orientation int, original io.ReadSeeker) error {
+	cfg, _, err := image.DecodeConfig(original)
+	if err != nil {
+		return FileError{Issue: fmt.Sprintf("unable to decode image: %v", err)}
+	}
+	if cfg.Width*cfg.Height > MaxImagePixels {
+		return nil
+	}
+	variantSlots <- struct{}{}
+	defer func() { <-variantSlots }()
+	_, err = original.Seek(0, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("create variants: %w", err)
+	}
+	src, _, err := image.Decode(original)
+	if err != nil {
+		return FileError{Issue: fmt.Sprintf("unable to decode image: %v", err)}
+	}
+	src = orient(src, orientation)
+
+	// Sizes are ordered largest first, so each variant is resized from the
+	// previous one rather than from the full-size original.
+	for _, size := range ImageSizes {
+		key := service.variantKey(hash, size.Width)
+		if src.Bounds().Dx() <= size.Width {
+			continue
+		}
+		src = resize(src, size.Width)
+		var buf bytes.Buffer
+		err = encodeImage(&buf, src, contentType)
+		if err != nil {
+			return fmt.Errorf("create variants: %w", err)
+		}
+		err = service.store().Put(key, &buf, int64(buf.Len()), contentType)
+		if err != nil {
+			return fmt.Errorf("create variants: %w", err)
+		}
+	}
+	return nil
+}
+
+func (service *GalleryService) deleteVariants(hash string) error {
+	for _, size := range ImageSizes {
+		err := service.store().Delete(service.variantKey(hash, size.Width))
+		if err != nil {
+			return fmt.Errorf("delete variants: %w", err)
+		}
+	}
+	return nil
+}
+
+func encodeImage(w io.Writer, img image.Image, contentType string) error {
+	switch contentType {
+	case "image/png":
+		return png.Encode(w, img)
+	case "image/gif":
+		return gif.Encode(w, img, nil)
+	default:
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: 85})
+	}
+}
+
+// resize scales src down to the given width, keeping its aspect ratio. Each
+// destination pixel is the average of the source pixels it covers (a box
+// filter), which is cheap and looks good for downscaling.
+func resize(src image.Image, width int) image.Image {
+	sb := src.Bounds()
+	height := sb.Dy() * width / sb.Dx()
+	if height < 1 {
+		height = 1
+	}
+	rgba, ok := src.(*image.RGBA)
+	if !ok || rgba.Rect.Min != (image.Point{}) {
+		rgba = image.NewRGBA(image.Rect(0, 0, sb.Dx(), sb.Dy()))
+		draw.Draw(rgba, rgba.Bounds(), src, sb.Min, draw.Src)
+	}
+	sw, sh := rgba.Bounds().Dx(), rgba.Bounds().Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*sh/height, (y+1)*sh/height
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0, x1 := x*sw/width, (x+1)*sw/width
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				row := rgba.Pix[sy*rgba.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r += uint64(p[0])
+					g += uint64(p[1])
+					b += uint64(p[2])
+					a += uint64(p[3])
+					n++
+				}
+			}
+			d := dst.Pix[y*dst.Stride+x*4:]
+			d[0] = uint8(r / n)
+			d[1] = uint8(g / n)
+			d[2] = uint8(b / n)
+			d[3] = uint8(a / n)
+		}
+	}
+	return dst
+}
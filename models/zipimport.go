@@ -0,0 +1,129 @@
+package models
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+const (
+	// MaxZipSize is the largest archive accepted by ImportZip.
+	MaxZipSize = 2 << 30
+	// MaxZipEntries is the most files an archive may contain.
+	MaxZipEntries = 5000
+	// MaxZipUncompressedSize is the most bytes that will be extracted from a
+	// single archive in total.
+	MaxZipUncompressedSize = 8 << 30
+	// MaxZipRatio is the highest compression ratio accepted for an entry.
+	// Images barely compress, so a much higher ratio means a decompression
+	// bomb rather than a photo.
+	MaxZipRatio = 100
+)
+
+// ZipEntryResult is the outcome of importing one file from an archive. Err
+// is set when the entry was skipped.
+type ZipEntryResult struct {
+	Name  string
+	Image *Image
+	Err   error
+}
+
+// ImportZip adds every image in a ZIP archive to the gallery. Each entry is
+// validated like a normal upload by CreateImage, and entries that fail are
+// reported individually without stopping the import. An error is only
+// returned when the archive as a whole cannot be read.
+//
+// Only the base name of each entry is used, so paths inside the archive can
+// never escape the gallery, but entries with absolute or ".." paths are still
+// rejected as they only appear in malicious archives.
+func (service *GalleryService) ImportZip(galleryID, uploaderID int, contents io.Reader) ([]ZipEntryResult, error) {
+	// archive/zip needs random access to read the central directory at the
+	// end of the file, so the archive has to be spooled first.
+	tmp, err := spoolTemp(io.LimitReader(contents, MaxZipSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("import zip: %w", err)
+	}
+	defer removeTemp(tmp)
+	size, err := tmp.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, fmt.Errorf("import zip: %w", err)
+	}
+	if size > MaxZipSize {
+		return nil, fmt.Errorf("import zip: %w", FileError{
+			Issue: fmt.Sprintf("archive is larger than %v", FormatBytes(MaxZipSize)),
+		})
+	}
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil {
+		return nil, fmt.Errorf("import zip: %w", FileError{Issue: "not a valid zip archive"})
+	}
+	if len(zr.File) > MaxZipEntries {
+		return nil, fmt.Errorf("import zip: %w", FileError{
+			Issue: fmt.Sprintf("archive contains more than %d files", MaxZipEntries),
+		})
+	}
+
+	var results []ZipEntryResult
+	var extracted uint64
+	for _, f := range zr.File {
+		// Directories and the resource forks added by macOS are not images
+		// and are not worth reporting.
+		if f.FileInfo().IsDir() || strings.HasPrefix(f.Name, "__MACOSX/") {
+			continue
+		}
+		result := ZipEntryResult{Name: f.Name}
+		err := checkZipEntry(f, extracted)
+		if err == nil {
+			extracted += f.UncompressedSize64
+			result.Image, err = service.importZipEntry(galleryID, uploaderID, f)
+		}
+		if err != nil {
+			result.Err = fmt.Errorf("import zip entry %v: %w", f.Name, err)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (service *GalleryService) importZipEntry(galleryID, uploaderID int, f *zip.File) (*Image, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, FileError{Issue: fmt.Sprintf("unable to read entry: %v", err)}
+	}
+	defer rc.Close()
+	// archive/zip fails the read if an entry inflates beyond the size its
+	// header declares, so the checks on UncompressedSize64 hold.
+	image, err := service.CreateImage(galleryID, uploaderID, path.Base(f.Name), rc)
+	if errors.Is(err, zip.ErrFormat) || errors.Is(err, zip.ErrChecksum) {
+		return nil, FileError{Issue: fmt.Sprintf("corrupt entry: %v", err)}
+	}
+	return image, err
+}
+
+// checkZipEntry rejects unsafe entries before any of them is decompressed.
+// extracted is the number of bytes extracted from the archive so far.
+func checkZipEntry(f *zip.File, extracted uint64) error {
+	name := f.Name
+	if strings.Contains(name, `\`) || !fs.ValidPath(name) {
+		return FileError{Issue: "unsafe path"}
+	}
+	switch strings.ToLower(path.Ext(name)) {
+	case ".zip", ".tar", ".gz", ".tgz", ".bz2", ".xz", ".rar", ".7z":
+		return FileError{Issue: "nested archives are not supported"}
+	}
+	if f.UncompressedSize64 > MaxUploadSize {
+		return FileError{Issue: fmt.Sprintf("file is larger than %v", FormatBytes(MaxUploadSize))}
+	}
+	if f.UncompressedSize64 > 1<<20 &&
+		(f.CompressedSize64 == 0 || f.UncompressedSize64/f.CompressedSize64 > MaxZipRatio) {
+		return FileError{Issue: "file is compressed suspiciously well"}
+	}
+	if extracted+f.UncompressedSize64 > MaxZipUncompressedSize {
+		return FileError{Issue: fmt.Sprintf("archive expands to more than %v", FormatBytes(MaxZipUncompressedSize))}
+	}
+	return nil
+}